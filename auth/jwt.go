@@ -4,10 +4,9 @@ import (
 	"github.com/go-chi/jwtauth"
 )
 
-var TokenAuth *jwtauth.JWTAuth
-
-func MakeToken(email string) (string, error) {
-	_, tokenString, err := TokenAuth.Encode(map[string]interface{}{"email": email})
+// MakeToken signs a token for the user with the given email.
+func MakeToken(tokenAuth *jwtauth.JWTAuth, email string) (string, error) {
+	_, tokenString, err := tokenAuth.Encode(map[string]interface{}{"email": email})
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,23 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/jgsheppa/mongo-go/models"
+)
+
+type Cache struct {
+	mc models.MagazineCache
+}
+
+func NewCache(mc models.MagazineCache) *Cache {
+	return &Cache{
+		mc,
+	}
+}
+
+// Stats reports the hits, misses and size of the magazine cache for
+// monitoring.
+func (c *Cache) Stats(w http.ResponseWriter, r *http.Request) (any, error) {
+	return c.mc.Stats(), nil
+}
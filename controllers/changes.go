@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/errors"
+	"github.com/jgsheppa/mongo-go/models"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// changeHeartbeat is how often an idle change feed tells the client it
+	// is still open, and where it would resume.
+	changeHeartbeat = 15 * time.Second
+	// changeRetry is the reconnect delay, in milliseconds, EventSource
+	// clients are asked to use.
+	changeRetry = 2000
+)
+
+// changeMessage is a control message of the WebSocket change feed. Changes
+// themselves are sent as models.MagazineChange.
+type changeMessage struct {
+	ID    string          `json:"id,omitempty"`
+	Type  string          `json:"type"`
+	Error *errors.Problem `json:"error,omitempty"`
+}
+
+// MagazineChanges streams the creates, updates and deletes of magazines as
+// they happen. It speaks Server-Sent Events, or WebSocket when the client
+// asks to upgrade. Each change carries its resume token as its id; idle
+// feeds send heartbeats with the current token, so a client that
+// reconnects with the last token it saw misses nothing.
+func (m *Magazine) MagazineChanges(w http.ResponseWriter, r *http.Request) (any, error) {
+	opts := changeOptions(r)
+	opts.Wait = changeHeartbeat
+
+	feed, err := m.ms.Changes(r.Context(), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer feed.Close()
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, websocketChanges(w, r, feed, m.allowedOrigins)
+	}
+	return nil, eventStreamChanges(w, r, feed)
+}
+
+// eventStreamChanges writes the feed as a text/event-stream. Heartbeats are
+// events without data, which EventSource does not dispatch but whose id it
+// still remembers for Last-Event-ID.
+func eventStreamChanges(w http.ResponseWriter, r *http.Request, feed models.ChangeFeed) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", changeRetry); err != nil {
+		return nil
+	}
+
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		change, err := feed.Next(r.Context())
+		if r.Context().Err() != nil {
+			return nil
+		}
+		if err != nil {
+			// Tell the client why the feed ended before it reconnects.
+			data, _ := json.Marshal(errors.FromError(err))
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+			return err
+		}
+
+		if change == nil {
+			_, err = fmt.Fprintf(w, "id: %s\n: heartbeat\n\n", feed.ResumeToken())
+		} else {
+			_, err = writeChangeEvent(w, change)
+		}
+		if err != nil {
+			// The client went away.
+			return nil
+		}
+	}
+}
+
+// writeChangeEvent writes change as one server-sent event named after its
+// type.
+func writeChangeEvent(w io.Writer, change *models.MagazineChange) (int, error) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return 0, err
+	}
+	return fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", change.ID, change.Type, data)
+}
+
+// websocketChanges sends every change as a JSON text message. Heartbeats
+// and the error that ends a feed are sent as changeMessage.
+//
+// Browsers let any page open a WebSocket, cookies included, and leave it to
+// the server to check where the page came from. The handshake is refused
+// with a 403 unless the Origin is one of allowedOrigins; clients that are
+// not browsers send no Origin and are let through.
+func websocketChanges(w http.ResponseWriter, r *http.Request, feed models.ChangeFeed, allowedOrigins []string) error {
+	var feedErr error
+	server := websocket.Server{Handshake: checkOrigin(allowedOrigins), Handler: func(ws *websocket.Conn) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		// Clients only ever close the connection, so anything they send is
+		// read and dropped until they do.
+		go func() {
+			defer cancel()
+			io.Copy(io.Discard, ws)
+		}()
+
+		for {
+			change, err := feed.Next(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				feedErr = err
+				websocket.JSON.Send(ws, changeMessage{Type: "error", Error: errors.FromError(err)})
+				return
+			}
+
+			if change == nil {
+				err = websocket.JSON.Send(ws, changeMessage{ID: feed.ResumeToken(), Type: "heartbeat"})
+			} else {
+				err = websocket.JSON.Send(ws, change)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}}
+	server.ServeHTTP(w, r)
+	return feedErr
+}
+
+// checkOrigin returns a WebSocket handshake that refuses the origins not
+// in allowed.
+func checkOrigin(allowed []string) func(*websocket.Config, *http.Request) error {
+	return func(config *websocket.Config, r *http.Request) error {
+		origin := r.Header.Get("Origin")
+		if origin != "" && !originAllowed(origin, allowed) {
+			return fmt.Errorf("origin %q is not allowed", origin)
+		}
+		return nil
+	}
+}
+
+// originAllowed reports whether origin matches one of allowed, which may
+// hold one wildcard each like the CORS configuration.
+func originAllowed(origin string, allowed []string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if prefix, suffix, wildcard := strings.Cut(pattern, "*"); wildcard {
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		} else if origin == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jgsheppa/mongo-go/models"
+	"golang.org/x/net/websocket"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://app.example.com", "https://*.example.org"}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"https://shop.example.org", true},
+		{"https://example.org", false},
+		{"http://app.example.com", false},
+		{"https://evil.example.net", false},
+	}
+
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin, allowed); got != tt.want {
+			t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestWebsocketChangesChecksOrigin(t *testing.T) {
+	services, err := models.NewMemoryServices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMagazine(services.Magazine, []string{"https://app.example.com"})
+	server := httptest.NewServer(Handler(m.MagazineChanges))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	if _, err := websocket.Dial(url, "", "https://evil.example.net"); err == nil {
+		t.Error("Dial() from a foreign origin succeeded")
+	}
+
+	ws, err := websocket.Dial(url, "", "https://app.example.com")
+	if err != nil {
+		t.Fatalf("Dial() from an allowed origin error = %v", err)
+	}
+	ws.Close()
+}
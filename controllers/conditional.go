@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/models"
+)
+
+// magazineETag returns the strong entity tag of a magazine, which is its
+// version.
+func magazineETag(magazine *models.Magazine) string {
+	return fmt.Sprintf(`"%d"`, magazine.Version)
+}
+
+// contentETag returns a strong entity tag derived from a response body, for
+// responses such as listings that have no single version.
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// checkNotModified sets the ETag and Last-Modified validators of a GET
+// response. If the request's If-None-Match or, when that is absent,
+// If-Modified-Since header shows the client already holds this
+// representation, it writes a 304 Not Modified and returns true.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	current := false
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		current = etagMatches(header, etag)
+	} else if header := r.Header.Get("If-Modified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		// HTTP dates have a resolution of one second.
+		current = err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+
+	if current {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return current
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison RFC 7232 prescribes for that header.
+func etagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion returns the magazine version a write must find, as named
+// by the If-Match header. It returns zero when the header is missing or "*",
+// meaning any existing version may be replaced. A list of tags names several
+// versions, so current is read to pick the one the magazine is at; a single
+// tag is left for the write itself to check. Weak or malformed tags can
+// never match, and a header without any other tag is a conflict.
+func ifMatchVersion(r *http.Request, current func() (*models.Magazine, error)) (int64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	versions := []int64{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		version, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+		if err == nil && version >= 1 {
+			versions = append(versions, version)
+		}
+	}
+
+	switch len(versions) {
+	case 0:
+		return 0, models.ErrVersionConflict
+	case 1:
+		return versions[0], nil
+	}
+
+	magazine, err := current()
+	if err != nil {
+		return 0, err
+	}
+	for _, version := range versions {
+		if version == magazine.Version {
+			return version, nil
+		}
+	}
+	return 0, models.ErrVersionConflict
+}
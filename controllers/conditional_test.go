@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestCheckNotModified(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no validators", nil, false},
+		{"matching etag", map[string]string{"If-None-Match": `"a", "3"`}, true},
+		{"weak matching etag", map[string]string{"If-None-Match": `W/"3"`}, true},
+		{"stale etag", map[string]string{"If-None-Match": `"2"`}, false},
+		{"not modified since", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, true},
+		{"modified since", map[string]string{"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)}, false},
+		{"etag wins over date", map[string]string{
+			"If-None-Match":     `"2"`,
+			"If-Modified-Since": modified.Format(http.TimeFormat),
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/magazines/1", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+
+			got := checkNotModified(rr, req, `"3"`, modified)
+			if got != tt.want {
+				t.Errorf("checkNotModified() = %v, want %v", got, tt.want)
+			}
+			if got && rr.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusNotModified)
+			}
+			if rr.Header().Get("ETag") != `"3"` {
+				t.Errorf("ETag = %q, want %q", rr.Header().Get("ETag"), `"3"`)
+			}
+		})
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    int64
+		wantErr error
+		reads   int
+	}{
+		{"no header", "", 0, nil, 0},
+		{"any version", "*", 0, nil, 0},
+		{"single tag", `"2"`, 2, nil, 0},
+		{"list with current version", `"1", "3"`, 3, nil, 1},
+		{"list without current version", `"1", "2"`, 0, models.ErrVersionConflict, 1},
+		{"weak tags are skipped", `W/"3", "2"`, 2, nil, 0},
+		{"only weak tags", `W/"3"`, 0, models.ErrVersionConflict, 0},
+		{"malformed tag", `3`, 0, models.ErrVersionConflict, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/magazines/1", nil)
+			if tt.header != "" {
+				req.Header.Set("If-Match", tt.header)
+			}
+			reads := 0
+			current := func() (*models.Magazine, error) {
+				reads++
+				return &models.Magazine{Version: 3}, nil
+			}
+
+			got, err := ifMatchVersion(req, current)
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("ifMatchVersion() = %d, %v, want %d, %v", got, err, tt.want, tt.wantErr)
+			}
+			if reads != tt.reads {
+				t.Errorf("read the magazine %d times, want %d", reads, tt.reads)
+			}
+		})
+	}
+
+	t.Run("list for a missing magazine", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", "/magazines/1", nil)
+		req.Header.Set("If-Match", `"1", "2"`)
+		_, err := ifMatchVersion(req, func() (*models.Magazine, error) { return nil, mongo.ErrNoDocuments })
+		if err != mongo.ErrNoDocuments {
+			t.Errorf("ifMatchVersion() error = %v, want ErrNoDocuments", err)
+		}
+	})
+}
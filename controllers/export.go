@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/errors"
+	"github.com/jgsheppa/mongo-go/models"
+)
+
+// exportFlushEvery is the number of magazines written between flushes.
+const exportFlushEvery = 100
+
+// exportWriter writes a stream of magazines in one export format.
+type exportWriter interface {
+	begin() error
+	write(magazine *models.Magazine) error
+	end() error
+}
+
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+	newWriter   func(w io.Writer) exportWriter
+}{
+	"ndjson": {"application/x-ndjson", "ndjson", newNDJSONExport},
+	"csv":    {"text/csv; charset=utf-8", "csv", newCSVExport},
+	"json":   {"application/json", "json", newJSONExport},
+}
+
+// ExportMagazines streams every magazine matching the listing filters and
+// sort straight from the database to the client as NDJSON, CSV or a JSON
+// array. The export stops as soon as the client goes away.
+func (m *Magazine) ExportMagazines(w http.ResponseWriter, r *http.Request) (any, error) {
+	values := r.URL.Query()
+	name := values.Get("format")
+	if name == "" {
+		name = "ndjson"
+	}
+	values.Del("format")
+
+	format, ok := exportFormats[name]
+	if !ok {
+		return nil, errors.BadRequest(errors.CodeInvalidQuery, "format must be ndjson, csv or json")
+	}
+
+	opts, err := parseListOptions(values)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="magazines.`+format.extension+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	out := format.newWriter(w)
+	written := 0
+
+	err = out.begin()
+	if err == nil {
+		err = m.ms.Stream(r.Context(), opts, func(magazine *models.Magazine) error {
+			if err := out.write(magazine); err != nil {
+				return err
+			}
+			written++
+			if flusher != nil && written%exportFlushEvery == 0 {
+				flusher.Flush()
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = out.end()
+	}
+
+	// The status line has already been sent, so all that is left to do on
+	// failure is to stop writing and cut the response short.
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("exporting magazines failed after %d rows: %v", written, err)
+		}
+		return nil, nil
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil, nil
+}
+
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func newNDJSONExport(w io.Writer) exportWriter {
+	return &ndjsonExport{enc: json.NewEncoder(w)}
+}
+
+func (e *ndjsonExport) begin() error { return nil }
+
+func (e *ndjsonExport) write(magazine *models.Magazine) error {
+	return e.enc.Encode(magazine)
+}
+
+func (e *ndjsonExport) end() error { return nil }
+
+type jsonExport struct {
+	w     io.Writer
+	first bool
+}
+
+func newJSONExport(w io.Writer) exportWriter {
+	return &jsonExport{w: w, first: true}
+}
+
+func (e *jsonExport) begin() error {
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonExport) write(magazine *models.Magazine) error {
+	b, err := json.Marshal(magazine)
+	if err != nil {
+		return err
+	}
+	if !e.first {
+		b = append([]byte(","), b...)
+	}
+	e.first = false
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonExport) end() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer) exportWriter {
+	return &csvExport{w: csv.NewWriter(w)}
+}
+
+func (e *csvExport) begin() error {
+	return e.w.Write([]string{"id", "title", "price", "category", "publisher", "publicationYear", "version", "updatedAt"})
+}
+
+func (e *csvExport) write(magazine *models.Magazine) error {
+	year := ""
+	if magazine.PublicationYear != 0 {
+		year = strconv.Itoa(magazine.PublicationYear)
+	}
+	err := e.w.Write([]string{
+		magazine.ID.Hex(),
+		magazine.Title,
+		magazine.Price.String(),
+		magazine.Category,
+		magazine.Publisher,
+		year,
+		strconv.FormatInt(magazine.Version, 10),
+		magazine.UpdatedAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	// Flush through to the response so the periodic http.Flusher calls
+	// actually send data.
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExport) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
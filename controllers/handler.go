@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/jgsheppa/mongo-go/errors"
+)
+
+// Handler is an HTTP handler that returns its response body or an error
+// instead of writing them. Its ServeHTTP method does the writing:
+//
+//   - an error is rendered as a problem document by errors.Write, or by the
+//     errors.Writer given to Handle;
+//   - a Response is encoded as JSON with its own status code;
+//   - any other non-nil value is encoded as JSON with 200 OK;
+//   - nil is answered with 204 No Content.
+//
+// A handler that writes the response itself, such as a redirect, a 304 Not
+// Modified or a streamed export, returns nil and ServeHTTP leaves it alone.
+type Handler func(w http.ResponseWriter, r *http.Request) (any, error)
+
+// Response is returned by a Handler that needs a status other than 200 OK.
+type Response struct {
+	Status int
+	Body   any
+}
+
+// Created returns a 201 Created response.
+func Created(body any) Response {
+	return Response{Status: http.StatusCreated, Body: body}
+}
+
+// Handle returns h as an http.Handler that logs internal errors to logger.
+// A nil logger logs through the standard logger, as ServeHTTP does.
+func Handle(h Handler, logger middleware.LoggerInterface) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, errors.Writer{Logger: logger})
+	})
+}
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, errors.Writer{})
+}
+
+func (h Handler) serve(w http.ResponseWriter, r *http.Request, ew errors.Writer) {
+	rw := &responseWriter{ResponseWriter: w}
+	res, err := h(rw, r)
+
+	if rw.wroteHeader {
+		// The status line is gone, so an error can only be logged.
+		if err != nil {
+			ew.Logf("%s %s: error after response was written: %v", r.Method, r.URL.Path, err)
+		}
+		return
+	}
+	if err != nil {
+		ew.Write(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if response, ok := res.(Response); ok {
+		status, res = response.Status, response.Body
+	}
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Encode before writing the header so an encoding failure can still be
+	// reported as an error.
+	body, err := json.Marshal(res)
+	if err != nil {
+		ew.Write(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// responseWriter records whether a Handler wrote the response itself.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the wrapper.
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection through the
+// wrapper.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	w.wroteHeader = true
+	return hijacker.Hijack()
+}
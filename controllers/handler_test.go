@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jgsheppa/mongo-go/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    Handler
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{
+			name: "value",
+			handler: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return map[string]int{"count": 1}, nil
+			},
+			wantStatus: http.StatusOK,
+			wantType:   "application/json",
+			wantBody:   `{"count":1}` + "\n",
+		},
+		{
+			name: "created",
+			handler: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return Created(map[string]int{"count": 1}), nil
+			},
+			wantStatus: http.StatusCreated,
+			wantType:   "application/json",
+			wantBody:   `{"count":1}` + "\n",
+		},
+		{
+			name: "no content",
+			handler: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return nil, nil
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name: "error",
+			handler: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				return nil, mongo.ErrNoDocuments
+			},
+			wantStatus: http.StatusNotFound,
+			wantType:   errors.ContentType,
+		},
+		{
+			name: "written by handler",
+			handler: func(w http.ResponseWriter, r *http.Request) (any, error) {
+				http.Redirect(w, r, "/magazines", http.StatusFound)
+				return nil, nil
+			},
+			wantStatus: http.StatusFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, httptest.NewRequest("GET", "/magazines", nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantType != "" && rr.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", rr.Header().Get("Content-Type"), tt.wantType)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// recordingLogger keeps the lines logged to it.
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Print(v ...any) {
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+func TestHandleLogsToLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	handler := Handle(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		return nil, fmt.Errorf("connection reset")
+	}, logger)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/magazines", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "GET /magazines: connection reset") {
+		t.Errorf("logged %q, want the internal error", logger.lines)
+	}
+}
@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"encoding/json"
+	"mime"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jgsheppa/mongo-go/errors"
@@ -13,218 +15,284 @@ import (
 
 type Magazine struct {
 	ms models.MagazineService
+	// allowedOrigins are the origins, as in the CORS configuration, whose
+	// pages may open the WebSocket change feed.
+	allowedOrigins []string
 }
 
-type Response struct {
-	Message      string
-	Error        bool
-	ErrorMessage error
-	StatusCode   int
-}
-
-func NewMagazine(ms models.MagazineService) *Magazine {
+func NewMagazine(ms models.MagazineService, allowedOrigins []string) *Magazine {
 	return &Magazine{
 		ms,
+		allowedOrigins,
 	}
 }
 
-func (m *Magazine) MagazineById(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
+func (m *Magazine) MagazineById(w http.ResponseWriter, r *http.Request) (any, error) {
 	id := chi.URLParam(r, "magazineId")
 	magazine, err := m.ms.FindById(id)
 
 	if err != nil {
-		responseError := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(magazine)
-}
+	if checkNotModified(w, r, magazineETag(magazine), magazine.UpdatedAt) {
+		return nil, nil
+	}
 
-func (m *Magazine) MagazineBySlug(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	return magazine, nil
+}
 
+func (m *Magazine) MagazineBySlug(w http.ResponseWriter, r *http.Request) (any, error) {
 	slug := chi.URLParam(r, "magazineSlug")
 	magazine, err := m.ms.FindBySlug(slug)
 
 	if err != nil {
-		responseError := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
+	}
+
+	// The slug belonged to an earlier title of the magazine.
+	if magazine.Slug != slug {
+		http.Redirect(w, r, "/magazines/slug/"+magazine.Slug, http.StatusMovedPermanently)
+		return nil, nil
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(magazine)
+	if checkNotModified(w, r, magazineETag(magazine), magazine.UpdatedAt) {
+		return nil, nil
+	}
+
+	return magazine, nil
 }
 
-func (m *Magazine) GetAllMagazines(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func (m *Magazine) GetAllMagazines(w http.ResponseWriter, r *http.Request) (any, error) {
+	opts, err := listOptions(r)
+	if err != nil {
+		return nil, err
+	}
 
-	magazines, err := m.ms.FindAll()
+	page, err := m.ms.FindAll(opts)
+	if err != nil {
+		return nil, err
+	}
 
+	if page.NextCursor != "" {
+		w.Header().Set("Link", nextLink(r, page.NextCursor))
+	}
+
+	body, err := json.Marshal(page)
 	if err != nil {
-		responseError := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(magazines)
-}
+	// A listing has no Last-Modified: the newest updatedAt on a page does
+	// not change when a magazine is removed from it.
+	if checkNotModified(w, r, contentETag(body), time.Time{}) {
+		return nil, nil
+	}
 
-func (m *Magazine) DeleteMagazine(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	return json.RawMessage(body), nil
+}
 
+func (m *Magazine) DeleteMagazine(w http.ResponseWriter, r *http.Request) (any, error) {
 	id := chi.URLParam(r, "magazineId")
-	res, err := m.ms.Delete(id)
+	version, err := ifMatchVersion(r, func() (*models.Magazine, error) { return m.ms.FindById(id) })
+	if err != nil {
+		return nil, err
+	}
 
+	magazine, err := m.ms.Delete(id, version)
 	if err != nil {
-		responseError := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
 
-	deletedCount := strconv.Itoa(int(res.DeletedCount))
+	return magazine, nil
+}
+
+// TrashedMagazines lists the magazines in the trash. It accepts the same
+// parameters as GetAllMagazines.
+func (m *Magazine) TrashedMagazines(w http.ResponseWriter, r *http.Request) (any, error) {
+	opts, err := listOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	opts.Trashed = true
 
-	jsonMessage := Response{
-		Message:      "Documents deleted: " + deletedCount,
-		Error:        false,
-		ErrorMessage: nil,
-		StatusCode:   http.StatusAccepted,
+	page, err := m.ms.FindAll(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(jsonMessage)
+	if page.NextCursor != "" {
+		w.Header().Set("Link", nextLink(r, page.NextCursor))
+	}
 
+	return page, nil
 }
 
-func (m *Magazine) CreateMagazine(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	jsonMessage := Response{}
-
-	title := chi.URLParam(r, "title")
-	price := chi.URLParam(r, "price")
-	priceInt, err := primitive.ParseDecimal128(price)
+func (m *Magazine) RestoreMagazine(w http.ResponseWriter, r *http.Request) (any, error) {
+	id := chi.URLParam(r, "magazineId")
+	magazine, err := m.ms.Restore(id)
 	if err != nil {
-		responseError := errors.InternalError("Conversion from string to float failed", err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
-	magazine := models.Magazine{
-		ID:    primitive.NewObjectID(),
-		Title: title,
-		Price: priceInt,
+
+	w.Header().Set("ETag", magazineETag(magazine))
+	return magazine, nil
+}
+
+func (m *Magazine) CreateMagazine(w http.ResponseWriter, r *http.Request) (any, error) {
+	var magazine models.Magazine
+	if err := decodeJSON(w, r, &magazine); err != nil {
+		return nil, errors.BadRequest(errors.CodeInvalidBody, err.Error())
 	}
-	res, err := m.ms.Create(magazine)
+	magazine.ID = primitive.NewObjectID()
+
+	created, err := m.ms.Create(magazine)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("ETag", magazineETag(created))
+	return Created(created), nil
+}
 
+func (m *Magazine) UpdateMagazine(w http.ResponseWriter, r *http.Request) (any, error) {
+	id := chi.URLParam(r, "magazineId")
+	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		responseError := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
 
-	jsonMessage = Response{
-		Message:      "Document created. Unique id is : " + res.InsertedID.(primitive.ObjectID).Hex(),
-		Error:        false,
-		ErrorMessage: nil,
-		StatusCode:   http.StatusAccepted,
+	var magazine models.Magazine
+	if err := decodeJSON(w, r, &magazine); err != nil {
+		return nil, errors.BadRequest(errors.CodeInvalidBody, err.Error())
+	}
+	magazine.ID = objectId
+
+	// If-Match takes precedence over a version sent in the body.
+	if r.Header.Get("If-Match") != "" {
+		magazine.Version, err = ifMatchVersion(r, func() (*models.Magazine, error) { return m.ms.FindById(id) })
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(jsonMessage)
-}
+	updated, err := m.ms.UpdateById(magazine)
+	if err != nil {
+		return nil, err
+	}
 
-func (m *Magazine) UpdateMagazine(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", magazineETag(updated))
+	return updated, nil
+}
 
-	jsonMessage := Response{}
+// PatchMagazine applies a JSON Merge Patch (RFC 7396) or a JSON Patch
+// (RFC 6902) document to a magazine, depending on the request Content-Type.
+func (m *Magazine) PatchMagazine(w http.ResponseWriter, r *http.Request) (any, error) {
+	var parse func([]byte) (*models.MagazinePatch, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/merge-patch+json", "application/json":
+		parse = models.ParseMergePatch
+	case "application/json-patch+json":
+		parse = models.ParseJSONPatch
+	default:
+		return nil, errors.UnsupportedMediaType(mediaType)
+	}
 
-	id := chi.URLParam(r, "id")
-	objectId, err := primitive.ObjectIDFromHex(id)
+	body, err := readBody(w, r)
 	if err != nil {
-		responseError := errors.InternalError("Error converting primitve to string", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, errors.BadRequest(errors.CodeInvalidBody, err.Error())
 	}
 
-	title := chi.URLParam(r, "title")
-	price := chi.URLParam(r, "price")
-	priceInt, err := primitive.ParseDecimal128(price)
+	patch, err := parse(body)
 	if err != nil {
-		responseError := errors.InternalError("Conversion from string to float failed", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
 
-	magazine := models.Magazine{
-		ID:    objectId,
-		Title: title,
-		Price: priceInt,
+	id := chi.URLParam(r, "magazineId")
+	patch.Version, err = ifMatchVersion(r, func() (*models.Magazine, error) { return m.ms.FindById(id) })
+	if err != nil {
+		return nil, err
 	}
 
-	res, err := m.ms.UpdateById(magazine)
+	magazine, err := m.ms.Patch(id, *patch)
 	if err != nil {
-		errorResponse := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(errorResponse)
-		return
+		return nil, err
 	}
 
-	count := strconv.Itoa(int(res.UpsertedCount))
+	w.Header().Set("ETag", magazineETag(magazine))
+	return magazine, nil
+}
 
-	jsonMessage = Response{
-		Message:      "Documents created: " + count,
-		Error:        false,
-		ErrorMessage: nil,
-		StatusCode:   http.StatusAccepted,
+// ImportMagazines streams an NDJSON or CSV file of magazines from the request
+// body and upserts them. With ?dryRun=true the rows are only validated.
+func (m *Magazine) ImportMagazines(w http.ResponseWriter, r *http.Request) (any, error) {
+	dryRun := false
+	if param := r.URL.Query().Get("dryRun"); param != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(param)
+		if err != nil {
+			return nil, errors.BadRequest(errors.CodeInvalidQuery, "dryRun must be true or false")
+		}
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(jsonMessage)
-}
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	var rows models.RowReader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson":
+		rows = models.NewNDJSONReader(body)
+	case "text/csv":
+		var err error
+		rows, err = models.NewCSVReader(body)
+		if err != nil {
+			return nil, errors.BadRequest(errors.CodeInvalidBody, err.Error())
+		}
+	default:
+		return nil, errors.UnsupportedMediaType(mediaType)
+	}
 
-func (m *Magazine) AggregateMagazinePrice(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	report, err := m.ms.ImportMagazines(rows, dryRun)
+	if err != nil {
+		return nil, err
+	}
 
-	price := chi.URLParam(r, "price")
+	return report, nil
+}
 
-	res, err := m.ms.AggregateByPrice(price)
+// PriceStats returns the minimum, maximum, average and median price of the
+// magazines matching the listing filters, optionally per ?groupBy= field.
+func (m *Magazine) PriceStats(w http.ResponseWriter, r *http.Request) (any, error) {
+	opts, err := aggregateOptions(r.URL.Query())
 	if err != nil {
-		errorResponse := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(errorResponse)
-		return
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(res)
+	return m.ms.PriceStats(opts)
 }
 
-func (m *Magazine) SearchMagazines(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// PriceHistogram counts the magazines matching the listing filters per price
+// bucket. The buckets are either given as ?boundaries=0,10,20 or left to
+// Mongo with ?buckets=5.
+func (m *Magazine) PriceHistogram(w http.ResponseWriter, r *http.Request) (any, error) {
+	opts, err := histogramOptions(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
 
-	term := chi.URLParam(r, "term")
-	field := chi.URLParam(r, "field")
+	return m.ms.PriceHistogram(opts)
+}
 
-	res, err := m.ms.Search(field, term)
+// SearchMagazines searches magazines for ?q=, in every searchable field or
+// only in ?field=. The hits are paged with ?limit= and ?offset=. The result
+// counts the hits per facet value; listing filters such as ?category=News
+// narrow the hits to the selected values.
+func (m *Magazine) SearchMagazines(w http.ResponseWriter, r *http.Request) (any, error) {
+	opts, err := searchOptions(r.URL.Query())
 	if err != nil {
-		errorResponse := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(errorResponse)
-		return
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(res)
+	return m.ms.Search(opts)
 }
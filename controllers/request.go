@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jgsheppa/mongo-go/models"
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxBodyBytes caps the size of JSON request bodies at 1 MiB.
+	maxBodyBytes = 1048576
+	// maxImportBytes caps the size of bulk import files at 32 MiB.
+	maxImportBytes = 32 << 20
+)
+
+// decodeJSON decodes a single JSON object from the request body into dst.
+// Fields that dst does not declare are rejected, as are bodies larger than
+// maxBodyBytes or bodies containing more than one JSON value.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(dst); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			return fmt.Errorf("request body must not be larger than %d bytes", maxBodyBytes)
+		case errors.Is(err, io.EOF):
+			return errors.New("request body must not be empty")
+		default:
+			return err
+		}
+	}
+
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return errors.New("request body must only contain a single JSON object")
+	}
+
+	return nil
+}
+
+// readBody reads the whole request body, refusing bodies larger than
+// maxBodyBytes.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, fmt.Errorf("request body must not be larger than %d bytes", maxBodyBytes)
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// listOptions reads the filter, sort, limit and cursor query parameters of a
+// magazine listing request.
+func listOptions(r *http.Request) (models.ListOptions, error) {
+	return parseListOptions(r.URL.Query())
+}
+
+func parseListOptions(values url.Values) (models.ListOptions, error) {
+	q, err := models.MagazineFields.Parse(values)
+	if err != nil {
+		return models.ListOptions{}, err
+	}
+
+	opts := models.ListOptions{
+		Filter: q.Filter,
+		Sort:   q.Sort,
+		Limit:  query.DefaultLimit,
+		Cursor: values.Get("cursor"),
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 || n > query.MaxLimit {
+			return opts, &query.Error{Param: "limit", Message: fmt.Sprintf("must be a number between 1 and %d", query.MaxLimit)}
+		}
+		opts.Limit = n
+	}
+
+	return opts, nil
+}
+
+// nextLink builds an RFC 8288 Link header value pointing at the page after
+// the current one. All other query parameters of r are kept.
+func nextLink(r *http.Request, cursor string) string {
+	params := r.URL.Query()
+	params.Set("cursor", cursor)
+
+	next := url.URL{Path: r.URL.Path, RawQuery: params.Encode()}
+	return fmt.Sprintf(`<%s>; rel="next"`, next.String())
+}
+
+// searchOptions reads the q, field, limit and offset parameters of a search
+// request. Every other parameter is a listing filter, which is how clients
+// select facet values.
+func searchOptions(values url.Values) (models.SearchOptions, error) {
+	opts := models.SearchOptions{
+		Field: values.Get("field"),
+		Term:  values.Get("q"),
+		Limit: query.DefaultLimit,
+	}
+
+	filters := cloneValues(values)
+	for _, param := range []string{"q", "field", "offset"} {
+		filters.Del(param)
+	}
+	q, err := models.MagazineFields.Parse(filters)
+	if err != nil {
+		return opts, err
+	}
+	opts.Filter = q.Filter
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 || n > query.MaxLimit {
+			return opts, &query.Error{Param: "limit", Message: fmt.Sprintf("must be a number between 1 and %d", query.MaxLimit)}
+		}
+		opts.Limit = n
+	}
+	if offset := values.Get("offset"); offset != "" {
+		n, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil || n < 0 {
+			return opts, &query.Error{Param: "offset", Message: "must be a number of at least 0"}
+		}
+		opts.Offset = n
+	}
+
+	return opts, nil
+}
+
+// changeOptions reads the id and field parameters of a change feed request,
+// each a comma separated list that may also be repeated, and the resume
+// token. The token comes from the Last-Event-ID header that EventSource
+// sends when it reconnects, or from the lastEventId parameter for clients
+// that cannot set headers.
+func changeOptions(r *http.Request) models.ChangeOptions {
+	values := r.URL.Query()
+	opts := models.ChangeOptions{
+		ResumeAfter: r.Header.Get("Last-Event-ID"),
+		IDs:         splitList(values["id"]),
+		Fields:      splitList(values["field"]),
+	}
+	if opts.ResumeAfter == "" {
+		opts.ResumeAfter = values.Get("lastEventId")
+	}
+	return opts
+}
+
+// splitList splits comma separated values and drops empty items.
+func splitList(values []string) []string {
+	items := []string{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// aggregateOptions reads the groupBy parameter and the listing filters of an
+// aggregation request.
+func aggregateOptions(values url.Values) (models.AggregateOptions, error) {
+	values = cloneValues(values)
+	groupBy := values.Get("groupBy")
+	values.Del("groupBy")
+
+	q, err := models.MagazineFields.Parse(values)
+	if err != nil {
+		return models.AggregateOptions{}, err
+	}
+	opts := models.AggregateOptions{Filter: q.Filter}
+
+	if groupBy != "" {
+		opts.GroupBy, err = models.MagazineFields.GroupPath(groupBy)
+		if err != nil {
+			return models.AggregateOptions{}, err
+		}
+	}
+	return opts, nil
+}
+
+// histogramOptions reads the bucket parameters of a price histogram request:
+// either ascending boundaries or a number of buckets.
+func histogramOptions(values url.Values) (models.HistogramOptions, error) {
+	values = cloneValues(values)
+	boundaries, buckets := values.Get("boundaries"), values.Get("buckets")
+	values.Del("boundaries")
+	values.Del("buckets")
+
+	agg, err := aggregateOptions(values)
+	if err != nil {
+		return models.HistogramOptions{}, err
+	}
+	opts := models.HistogramOptions{AggregateOptions: agg}
+
+	switch {
+	case boundaries != "" && buckets != "":
+		return opts, &query.Error{Param: "boundaries", Message: "cannot be combined with buckets"}
+	case boundaries != "":
+		opts.Boundaries, err = parseBoundaries(boundaries)
+		if err != nil {
+			return opts, &query.Error{Param: "boundaries", Message: err.Error()}
+		}
+	default:
+		opts.Buckets = 10
+		if buckets != "" {
+			n, err := strconv.Atoi(buckets)
+			if err != nil || n < 1 || n > models.MaxHistogramBuckets {
+				return opts, &query.Error{Param: "buckets", Message: fmt.Sprintf("must be a number between 1 and %d", models.MaxHistogramBuckets)}
+			}
+			opts.Buckets = n
+		}
+	}
+	return opts, nil
+}
+
+func parseBoundaries(raw string) ([]primitive.Decimal128, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) < 2 || len(parts) > models.MaxHistogramBuckets+1 {
+		return nil, fmt.Errorf("must list between 2 and %d prices", models.MaxHistogramBuckets+1)
+	}
+
+	boundaries := make([]primitive.Decimal128, 0, len(parts))
+	var previous *big.Float
+	for _, part := range parts {
+		d, err := primitive.ParseDecimal128(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a decimal number", part)
+		}
+		// Decimal128 values cannot be compared directly, so the order is
+		// checked on their exact big.Float value.
+		value, ok := new(big.Float).SetString(d.String())
+		if !ok {
+			return nil, fmt.Errorf("%q is not a finite number", part)
+		}
+		if previous != nil && value.Cmp(previous) <= 0 {
+			return nil, errors.New("prices must be in ascending order")
+		}
+		previous = value
+		boundaries = append(boundaries, d)
+	}
+	return boundaries, nil
+}
+
+func cloneValues(values url.Values) url.Values {
+	clone := make(url.Values, len(values))
+	for k, v := range values {
+		clone[k] = v
+	}
+	return clone
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jgsheppa/mongo-go/models"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"valid body", `{"title": "Wired 2024", "price": "9.99"}`, false},
+		{"unknown field", `{"title": "Wired", "price": "9.99", "admin": true}`, true},
+		{"empty body", ``, true},
+		{"two objects", `{"title": "Wired"}{"title": "Vogue"}`, true},
+		{"too large", `{"title": "` + strings.Repeat("a", maxBodyBytes) + `"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/magazines", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			var magazine models.Magazine
+			err := decodeJSON(rr, req, &magazine)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHistogramOptions(t *testing.T) {
+	tests := []struct {
+		query       string
+		wantBuckets int
+		wantEdges   int
+		wantGroupBy string
+		wantErr     bool
+	}{
+		{"", 10, 0, "", false},
+		{"buckets=4&groupBy=title", 4, 0, "title", false},
+		{"boundaries=0,9.99,20&price[gte]=1", 0, 3, "", false},
+		{"boundaries=0,20,10", 0, 0, "", true},
+		{"boundaries=0", 0, 0, "", true},
+		{"boundaries=0,10&buckets=3", 0, 0, "", true},
+		{"buckets=1000", 0, 0, "", true},
+		{"groupBy=price", 0, 0, "", true},
+		{"groupBy=slug", 0, 0, "", true},
+	}
+
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		opts, err := histogramOptions(values)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("histogramOptions(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if opts.Buckets != tt.wantBuckets || len(opts.Boundaries) != tt.wantEdges || opts.GroupBy != tt.wantGroupBy {
+			t.Errorf("histogramOptions(%q) = %+v", tt.query, opts)
+		}
+	}
+}
+
+func TestChangeOptions(t *testing.T) {
+	req := httptest.NewRequest("GET", "/magazines/changes?id=a,b&id=c&field=price,+title,&lastEventId=from-query", nil)
+	req.Header.Set("Last-Event-ID", "from-header")
+
+	opts := changeOptions(req)
+	if strings.Join(opts.IDs, " ") != "a b c" {
+		t.Errorf("IDs = %v, want [a b c]", opts.IDs)
+	}
+	if strings.Join(opts.Fields, " ") != "price title" {
+		t.Errorf("Fields = %v, want [price title]", opts.Fields)
+	}
+	if opts.ResumeAfter != "from-header" {
+		t.Errorf("ResumeAfter = %q, want the Last-Event-ID header", opts.ResumeAfter)
+	}
+
+	req.Header.Del("Last-Event-ID")
+	if opts := changeOptions(req); opts.ResumeAfter != "from-query" {
+		t.Errorf("ResumeAfter = %q, want the lastEventId parameter", opts.ResumeAfter)
+	}
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jgsheppa/mongo-go/errors"
+	"github.com/jgsheppa/mongo-go/models"
+)
+
+type Search struct {
+	ss models.SearchService
+}
+
+func NewSearch(ss models.SearchService) *Search {
+	return &Search{
+		ss,
+	}
+}
+
+func (s *Search) Synonyms(w http.ResponseWriter, r *http.Request) (any, error) {
+	return s.ss.Synonyms()
+}
+
+func (s *Search) SynonymSet(w http.ResponseWriter, r *http.Request) (any, error) {
+	return s.ss.SynonymSet(chi.URLParam(r, "name"))
+}
+
+// PutSynonymSet creates or replaces the synonym set named in the path.
+func (s *Search) PutSynonymSet(w http.ResponseWriter, r *http.Request) (any, error) {
+	var set models.SynonymSet
+	if err := decodeJSON(w, r, &set); err != nil {
+		return nil, errors.BadRequest(errors.CodeInvalidBody, err.Error())
+	}
+	set.Name = chi.URLParam(r, "name")
+
+	return s.ss.PutSynonymSet(set)
+}
+
+func (s *Search) DeleteSynonymSet(w http.ResponseWriter, r *http.Request) (any, error) {
+	return nil, s.ss.DeleteSynonymSet(chi.URLParam(r, "name"))
+}
+
+// SyncIndex creates or updates the search index from the configured
+// searchable fields and returns the definition that was applied.
+func (s *Search) SyncIndex(w http.ResponseWriter, r *http.Request) (any, error) {
+	return s.ss.SyncIndex()
+}
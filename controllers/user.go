@@ -1,9 +1,6 @@
 package controllers
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
 	"net/http"
 	"time"
 
@@ -19,49 +16,39 @@ type LoginForm struct {
 }
 
 type User struct {
-	us models.UserService
+	us        models.UserService
+	tokenAuth *jwtauth.JWTAuth
+	// clock tells the time login and logout cookies expire from.
+	clock func() time.Time
 }
 
-func NewUser(ms models.UserService) *User {
+func NewUser(us models.UserService, tokenAuth *jwtauth.JWTAuth, clock func() time.Time) *User {
 	return &User{
-		ms,
+		us,
+		tokenAuth,
+		clock,
 	}
 }
 
-func (u *User) Login(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
+func (u *User) Login(w http.ResponseWriter, r *http.Request) (any, error) {
 	var login LoginForm
-
-	body, err := io.ReadAll(io.LimitReader(r.Body, 1048576))
-	if err != nil {
-		fmt.Printf("err from ReadAll: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if err := json.Unmarshal(body, &login); err != nil {
-		fmt.Printf("err from unmarshall: %v", err)
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if err := decodeJSON(w, r, &login); err != nil {
+		return nil, errors.BadRequest(errors.CodeInvalidBody, err.Error())
 	}
 
 	user, err := u.us.Authenticate(login.Email, login.Password)
 	if err != nil {
-		json.NewEncoder(w).Encode(err)
-		return
+		return nil, err
 	}
 
-	token, err := auth.MakeToken(user.Email)
+	token, err := auth.MakeToken(u.tokenAuth, user.Email)
 	if err != nil {
-		json.NewEncoder(w).Encode(err)
-		return
+		return nil, err
 	}
 
 	http.SetCookie(w, &http.Cookie{
 		HttpOnly: true,
-		Expires:  time.Now().Add(7 * 24 * time.Hour),
+		Expires:  u.clock().Add(7 * 24 * time.Hour),
 		SameSite: http.SameSiteLaxMode,
 		Path:     "/",
 		Secure:   true,
@@ -70,43 +57,34 @@ func (u *User) Login(w http.ResponseWriter, r *http.Request) {
 	})
 
 	http.Redirect(w, r, "/magazines", http.StatusFound)
+	return nil, nil
 }
 
-func (u *User) Logout(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
+func (u *User) Logout(w http.ResponseWriter, r *http.Request) (any, error) {
 	cookie := http.Cookie{
 		Name:     "jwt",
 		Value:    "",
-		Expires:  time.Now(),
+		Expires:  u.clock(),
 		HttpOnly: true,
 		Secure:   true,
 		Path:     "/",
 	}
 	http.SetCookie(w, &cookie)
 	http.Redirect(w, r, "/magazines", http.StatusFound)
+	return nil, nil
 }
 
-func (u *User) GetUser(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
+func (u *User) GetUser(w http.ResponseWriter, r *http.Request) (any, error) {
 	_, claims, err := jwtauth.FromContext(r.Context())
 	if err != nil {
-		responseError := errors.InternalError("JSON web token context failed", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
 
-	email := claims["email"].(string)
+	email, _ := claims["email"].(string)
 	user, err := u.us.ByEmail(email)
 	if err != nil {
-		responseError := errors.NotFound(err)
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(responseError)
-		return
+		return nil, err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
+	return user, nil
 }
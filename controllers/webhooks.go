@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jgsheppa/mongo-go/errors"
+	"github.com/jgsheppa/mongo-go/models"
+)
+
+type Webhooks struct {
+	ws models.WebhookService
+}
+
+func NewWebhooks(ws models.WebhookService) *Webhooks {
+	return &Webhooks{
+		ws,
+	}
+}
+
+func (h *Webhooks) Webhooks(w http.ResponseWriter, r *http.Request) (any, error) {
+	return h.ws.Webhooks()
+}
+
+func (h *Webhooks) Webhook(w http.ResponseWriter, r *http.Request) (any, error) {
+	return h.ws.Webhook(chi.URLParam(r, "webhookId"))
+}
+
+// CreateWebhook registers a URL for the listed events. The response is the
+// only one that carries the webhook's signing secret.
+func (h *Webhooks) CreateWebhook(w http.ResponseWriter, r *http.Request) (any, error) {
+	var hook models.Webhook
+	if err := decodeJSON(w, r, &hook); err != nil {
+		return nil, errors.BadRequest(errors.CodeInvalidBody, err.Error())
+	}
+
+	created, err := h.ws.CreateWebhook(hook)
+	if err != nil {
+		return nil, err
+	}
+	return Created(created), nil
+}
+
+func (h *Webhooks) DeleteWebhook(w http.ResponseWriter, r *http.Request) (any, error) {
+	return nil, h.ws.DeleteWebhook(chi.URLParam(r, "webhookId"))
+}
+
+// Deliveries lists the deliveries of a webhook, optionally only those with
+// the status given in the status parameter.
+func (h *Webhooks) Deliveries(w http.ResponseWriter, r *http.Request) (any, error) {
+	return h.ws.Deliveries(chi.URLParam(r, "webhookId"), r.URL.Query().Get("status"))
+}
+
+// DeadLetters lists the deliveries of every webhook that failed all their
+// attempts.
+func (h *Webhooks) DeadLetters(w http.ResponseWriter, r *http.Request) (any, error) {
+	return h.ws.DeadLetters()
+}
+
+// ReplayDelivery queues a delivery to be sent again.
+func (h *Webhooks) ReplayDelivery(w http.ResponseWriter, r *http.Request) (any, error) {
+	delivery, err := h.ws.ReplayDelivery(chi.URLParam(r, "deliveryId"))
+	if err != nil {
+		return nil, err
+	}
+	return Response{Status: http.StatusAccepted, Body: delivery}, nil
+}
@@ -1,42 +1,199 @@
+// Package errors renders API errors as RFC 7807 problem details and maps
+// the errors returned by the models layer and the Mongo driver onto them.
 package errors
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/jgsheppa/mongo-go/models"
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var ErrNoToken = errors.New("no token found or token is invalid")
 
-type ErrorResponse struct {
-	Message      string
-	Error        bool
-	ErrorMessage error
-	StatusCode   int
+// ContentType is the media type of problem responses.
+const ContentType = "application/problem+json"
+
+// Stable problem codes. Clients may rely on these; messages may change.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeInvalidBody          = "invalid_body"
+	CodeInvalidID            = "invalid_id"
+	CodeInvalidDecimal       = "invalid_decimal"
+	CodeInvalidQuery         = "invalid_query"
+	CodeInvalidPatch         = "invalid_patch"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodeDuplicateKey         = "duplicate_key"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeRateLimited          = "rate_limited"
+	CodeTimeout              = "timeout"
+	CodeResumeTokenExpired   = "resume_token_expired"
+	CodeUnavailable          = "unavailable"
+	CodeInternal             = "internal_error"
+)
+
+// Problem is an RFC 7807 problem details object. Code identifies the kind of
+// problem; Errors carries field-level details for validation failures and
+// CorrelationID ties an internal error to the server log.
+type Problem struct {
+	Type          string      `json:"type"`
+	Title         string      `json:"title"`
+	Status        int         `json:"status"`
+	Detail        string      `json:"detail,omitempty"`
+	Instance      string      `json:"instance,omitempty"`
+	Code          string      `json:"code"`
+	CorrelationID string      `json:"correlationId,omitempty"`
+	Errors        interface{} `json:"errors,omitempty"`
 }
 
-func NotFound(err error) ErrorResponse {
-	return ErrorResponse{
-		Message:      "Document not found",
-		Error:        true,
-		ErrorMessage: err,
-		StatusCode:   http.StatusNotFound,
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
 	}
+	return p.Title
 }
 
-func InternalError(message string, err error) ErrorResponse {
-	return ErrorResponse{
-		Message:      message,
-		Error:        true,
-		ErrorMessage: err,
-		StatusCode:   http.StatusInternalServerError,
+// New returns a problem with the given status, code and detail message.
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "/problems/" + strings.ReplaceAll(code, "_", "-"),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
 	}
 }
 
-func Unauthorized(err error) ErrorResponse {
-	return ErrorResponse{
-		Message:      "Unauthorized",
-		Error:        true,
-		ErrorMessage: err,
-		StatusCode:   http.StatusUnauthorized,
+func BadRequest(code, detail string) *Problem {
+	return New(http.StatusBadRequest, code, detail)
+}
+
+func NotFound(detail string) *Problem {
+	return New(http.StatusNotFound, CodeNotFound, detail)
+}
+
+func Unauthorized(err error) *Problem {
+	return New(http.StatusUnauthorized, CodeUnauthorized, err.Error())
+}
+
+func UnsupportedMediaType(mediaType string) *Problem {
+	return New(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "unsupported media type: "+mediaType)
+}
+
+// FromError classifies err. Problems pass through unchanged; anything that
+// is not recognised becomes a 500 internal error.
+func FromError(err error) *Problem {
+	var problem *Problem
+	var invalid *models.ValidationError
+	var queryErr *query.Error
+	var hexErr hex.InvalidByteError
+
+	switch {
+	case errors.As(err, &problem):
+		return problem
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return NotFound("the requested document does not exist")
+	case mongo.IsDuplicateKeyError(err):
+		return New(http.StatusConflict, CodeDuplicateKey, "a document with the same unique key already exists")
+	case errors.Is(err, primitive.ErrInvalidHex), errors.As(err, &hexErr):
+		return BadRequest(CodeInvalidID, "id must be a 24 character hex string")
+	case isDecimalError(err):
+		return BadRequest(CodeInvalidDecimal, err.Error())
+	case errors.As(err, &invalid):
+		p := New(http.StatusUnprocessableEntity, CodeValidationFailed, "the document has invalid fields")
+		p.Errors = invalid.Fields
+		return p
+	case errors.As(err, &queryErr), errors.Is(err, query.ErrInvalidCursor):
+		return BadRequest(CodeInvalidQuery, err.Error())
+	case errors.Is(err, models.ErrInvalidPatch):
+		return BadRequest(CodeInvalidPatch, err.Error())
+	case errors.Is(err, models.ErrPatchTestFailed):
+		return New(http.StatusConflict, CodeConflict, err.Error())
+	case errors.Is(err, models.ErrInvalidCredentials):
+		return Unauthorized(err)
+	case errors.Is(err, models.ErrVersionConflict):
+		return New(http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
+	case errors.Is(err, models.ErrChangeHistoryLost):
+		return New(http.StatusGone, CodeResumeTokenExpired, models.ErrChangeHistoryLost.Error())
+	case errors.Is(err, models.ErrChangesUnavailable):
+		return New(http.StatusServiceUnavailable, CodeUnavailable, models.ErrChangesUnavailable.Error())
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err):
+		return New(http.StatusGatewayTimeout, CodeTimeout, "the database did not answer in time")
+	default:
+		return New(http.StatusInternalServerError, CodeInternal, "an unexpected error occurred")
 	}
 }
+
+// isDecimalError reports whether err came from parsing a Decimal128. The
+// driver does not export a sentinel for malformed numbers, so its message is
+// matched instead.
+func isDecimalError(err error) bool {
+	return errors.Is(err, primitive.ErrParseNaN) ||
+		errors.Is(err, primitive.ErrParseInf) ||
+		errors.Is(err, primitive.ErrParseNegInf) ||
+		strings.Contains(err.Error(), "as a decimal128")
+}
+
+// Writer renders errors as application/problem+json responses. Internal
+// errors are logged to Logger together with a correlation ID that is also
+// sent to the client, so a report can be matched to the log line. A nil
+// Logger logs through the standard logger.
+type Writer struct {
+	Logger middleware.LoggerInterface
+}
+
+// Write renders err as an application/problem+json response.
+func (ew Writer) Write(w http.ResponseWriter, r *http.Request, err error) {
+	problem := *FromError(err)
+	problem.Instance = r.URL.Path
+
+	if problem.Status >= http.StatusInternalServerError {
+		problem.CorrelationID = correlationID(r)
+		ew.Logf("[%s] %s %s: %v", problem.CorrelationID, r.Method, r.URL.Path, err)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// Logf logs a formatted line to the Logger of ew.
+func (ew Writer) Logf(format string, v ...any) {
+	if ew.Logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	ew.Logger.Print(fmt.Sprintf(format, v...))
+}
+
+// Write renders err with a Writer that logs through the standard logger.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	Writer{}.Write(w, r, err)
+}
+
+// correlationID returns the request ID assigned by the RequestID middleware,
+// or a fresh random ID if there is none.
+func correlationID(r *http.Request) string {
+	if id := middleware.GetReqID(r.Context()); id != "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
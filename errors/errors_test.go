@@ -0,0 +1,74 @@
+package errors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jgsheppa/mongo-go/models"
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestFromError(t *testing.T) {
+	_, hexErr := primitive.ObjectIDFromHex("not-an-id")
+	_, decimalErr := primitive.ParseDecimal128("cheap")
+
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{mongo.ErrNoDocuments, http.StatusNotFound, CodeNotFound},
+		{mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}}, http.StatusConflict, CodeDuplicateKey},
+		{hexErr, http.StatusBadRequest, CodeInvalidID},
+		{decimalErr, http.StatusBadRequest, CodeInvalidDecimal},
+		{&models.ValidationError{Fields: []models.FieldError{{Field: "title"}}}, http.StatusUnprocessableEntity, CodeValidationFailed},
+		{&query.Error{Param: "sort"}, http.StatusBadRequest, CodeInvalidQuery},
+		{fmt.Errorf("operation 0: %w", models.ErrInvalidPatch), http.StatusBadRequest, CodeInvalidPatch},
+		{models.ErrVersionConflict, http.StatusPreconditionFailed, CodePreconditionFailed},
+		{fmt.Errorf("%w: resume token not found", models.ErrChangeHistoryLost), http.StatusGone, CodeResumeTokenExpired},
+		{fmt.Errorf("find: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, CodeTimeout},
+		{errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+	}
+
+	for _, tt := range tests {
+		got := FromError(tt.err)
+		if got.Status != tt.wantStatus || got.Code != tt.wantCode {
+			t.Errorf("FromError(%v) = %d %s, want %d %s", tt.err, got.Status, got.Code, tt.wantStatus, tt.wantCode)
+		}
+	}
+}
+
+func TestWriteInternalError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/magazines", nil)
+
+	Write(rr, req, errors.New("connection reset"))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if got := rr.Header().Get("Content-Type"); got != ContentType {
+		t.Errorf("Content-Type = %q, want %q", got, ContentType)
+	}
+
+	var problem Problem
+	if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.CorrelationID == "" {
+		t.Error("internal error has no correlation ID")
+	}
+	if problem.Detail == "connection reset" {
+		t.Error("internal error leaks its cause to the client")
+	}
+	if problem.Instance != "/magazines" {
+		t.Errorf("Instance = %q, want %q", problem.Instance, "/magazines")
+	}
+}
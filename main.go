@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -10,15 +12,13 @@ import (
 	"github.com/go-chi/cors"
 	"github.com/go-chi/httprate"
 	"github.com/go-chi/jwtauth"
-	"github.com/jgsheppa/mongo-go/auth"
 	"github.com/jgsheppa/mongo-go/controllers"
+	"github.com/jgsheppa/mongo-go/errors"
 	middlewares "github.com/jgsheppa/mongo-go/middlewares"
 	"github.com/jgsheppa/mongo-go/models"
 	"github.com/spf13/viper"
 )
 
-var TokenAuth *jwtauth.JWTAuth
-
 func init() {
 	viper.SetConfigName("config")               // name of config file (without extension)
 	viper.SetConfigType("yaml")                 // REQUIRED if the config file does not have the extension in the name
@@ -35,121 +35,324 @@ func init() {
 		}
 	}
 
-	Secret := viper.GetString("JWT_SECRET")
-	TokenAuth = jwtauth.New("HS256", []byte(Secret), nil)
+	// Cache-Control values for magazine reads. Clients revalidate with the
+	// ETag and Last-Modified validators once these expire.
+	viper.SetDefault("CACHE_CONTROL_MAGAZINE", "public, max-age=60")
+	viper.SetDefault("CACHE_CONTROL_MAGAZINES", "no-cache")
+	// How long deleted magazines stay in the trash before they are purged.
+	viper.SetDefault("TRASH_RETENTION", "720h")
+	// Search backend: "atlas" for Atlas Search, "text" for a plain $text
+	// index that works on any MongoDB deployment. SEARCH_FIELDS may map
+	// field names to a weight, analyzer and autocomplete flag to replace the
+	// default searchable fields.
+	viper.SetDefault("SEARCH_BACKEND", "text")
+	// How often due webhook deliveries are sent.
+	viper.SetDefault("WEBHOOK_INTERVAL", "5s")
+	// How often the events of magazine writes are published from the
+	// outbox.
+	viper.SetDefault("OUTBOX_INTERVAL", "1s")
+	// Size and entry lifetime of the in-process magazine cache. Other
+	// instances' writes reach the cache through the change feed; the TTL
+	// bounds how stale entries get when the database has none.
+	viper.SetDefault("MAGAZINE_CACHE_SIZE", 10000)
+	viper.SetDefault("MAGAZINE_CACHE_TTL", "1m")
 }
 
 func main() {
 	MONGO_URI := viper.GetString("mongodb")
-	PASSWORD_PEPPER := viper.GetString("PASSWORD_PEPPER")
-	// Inject secrets
-	auth.TokenAuth = TokenAuth
-	models.PasswordPepper = PASSWORD_PEPPER
 
-	s := CreateNewServer()
-	s.MountHandlers(MONGO_URI)
+	search := models.SearchConfig{Backend: viper.GetString("SEARCH_BACKEND")}
+	must(viper.UnmarshalKey("SEARCH_FIELDS", &search.Fields))
+
+	cache := models.CacheConfig{
+		Size: viper.GetInt("MAGAZINE_CACHE_SIZE"),
+		TTL:  viper.GetDuration("MAGAZINE_CACHE_TTL"),
+	}
+
+	services, err := models.NewServices(MONGO_URI, search, cache)
+	must(err)
+	startWorkers(context.Background(), services)
+
+	config := DefaultMiddlewareConfig()
+	config.CacheControlMagazine = viper.GetString("CACHE_CONTROL_MAGAZINE")
+	config.CacheControlMagazines = viper.GetString("CACHE_CONTROL_MAGAZINES")
+
+	s := CreateNewServer(
+		WithServices(services),
+		WithTokenAuth(jwtauth.New("HS256", []byte(viper.GetString("JWT_SECRET")), nil)),
+		WithPepper(viper.GetString("PASSWORD_PEPPER")),
+		WithMiddleware(config),
+	)
+	must(s.MountHandlers())
 	http.ListenAndServe(":3000", s.Router)
 }
 
+// startWorkers runs the background jobs of services until ctx is done.
+func startWorkers(ctx context.Context, services *models.Services) {
+	go services.PurgeTrash(ctx, viper.GetDuration("TRASH_RETENTION"), time.Hour)
+	go services.DispatchOutbox(ctx, viper.GetDuration("OUTBOX_INTERVAL"))
+	go services.DeliverWebhooks(ctx, viper.GetDuration("WEBHOOK_INTERVAL"))
+	go services.MagazineCache.WatchChanges(ctx, 5*time.Second)
+}
+
 func must(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
 
+// Server is the HTTP API. Everything it depends on is given to
+// CreateNewServer, so several servers can run side by side in one process.
 type Server struct {
 	Router   *chi.Mux
 	Services *models.Services
+
+	tokenAuth  *jwtauth.JWTAuth
+	pepper     string
+	clock      func() time.Time
+	logger     middleware.LoggerInterface
+	middleware MiddlewareConfig
+}
+
+// MiddlewareConfig tunes the middleware every request goes through.
+type MiddlewareConfig struct {
+	// Timeout bounds every request but those of the change feed. Zero
+	// disables it.
+	Timeout time.Duration
+	// RateLimit is the number of requests a client IP may make per
+	// RateWindow. Zero disables rate limiting.
+	RateLimit  int
+	RateWindow time.Duration
+	// AllowedOrigins are the CORS origins, which may contain a wildcard.
+	AllowedOrigins []string
+	// CacheControlMagazine and CacheControlMagazines are the Cache-Control
+	// values of single magazine reads and of listings.
+	CacheControlMagazine  string
+	CacheControlMagazines string
+}
+
+// DefaultMiddlewareConfig returns the middleware configuration servers get
+// unless they are given another.
+func DefaultMiddlewareConfig() MiddlewareConfig {
+	return MiddlewareConfig{
+		Timeout:    3 * time.Minute,
+		RateLimit:  100,
+		RateWindow: time.Minute,
+		// TODO: improve CORS once API has frontend
+		AllowedOrigins:        []string{"https://*", "http://*"},
+		CacheControlMagazine:  "public, max-age=60",
+		CacheControlMagazines: "no-cache",
+	}
+}
+
+// Option configures a Server built by CreateNewServer.
+type Option func(*Server)
+
+// WithServices sets the services the handlers are backed by.
+func WithServices(services *models.Services) Option {
+	return func(s *Server) {
+		s.Services = services
+	}
+}
+
+// WithTokenAuth sets what signs the tokens of logged in users and verifies
+// them on protected routes.
+func WithTokenAuth(tokenAuth *jwtauth.JWTAuth) Option {
+	return func(s *Server) {
+		s.tokenAuth = tokenAuth
+	}
+}
+
+// WithPepper sets the pepper appended to passwords on login.
+func WithPepper(pepper string) Option {
+	return func(s *Server) {
+		s.pepper = pepper
+	}
+}
+
+// WithClock sets the clock login cookies expire by. It defaults to
+// time.Now. The services keep their own, see models.WithClock.
+func WithClock(clock func() time.Time) Option {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
+// WithLogger sets where requests and internal errors are logged. It
+// defaults to standard output. The services and their workers log where
+// models.WithLogger tells them to.
+func WithLogger(logger middleware.LoggerInterface) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
 }
 
-func CreateNewServer() *Server {
-	s := &Server{}
+// WithMiddleware replaces DefaultMiddlewareConfig.
+func WithMiddleware(config MiddlewareConfig) Option {
+	return func(s *Server) {
+		s.middleware = config
+	}
+}
+
+func CreateNewServer(opts ...Option) *Server {
+	s := &Server{
+		clock:      time.Now,
+		middleware: DefaultMiddlewareConfig(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
 	s.Router = chi.NewRouter()
 	return s
 }
 
-func (s *Server) MountHandlers(mongoURI string) {
-	services, err := models.NewServices(mongoURI)
-	if err != nil {
-		panic(err)
+// MountHandlers registers the middleware and routes of the server. Routes
+// of services that are nil, such as webhooks on in-memory services, are
+// left out.
+func (s *Server) MountHandlers() error {
+	if s.Services == nil || s.Services.Magazine == nil || s.Services.User == nil {
+		return fmt.Errorf("server needs magazine and user services")
 	}
-	must(err)
+	if s.tokenAuth == nil {
+		return fmt.Errorf("server needs a token signer")
+	}
+
+	magazineController := controllers.NewMagazine(s.Services.Magazine, s.middleware.AllowedOrigins)
+	userController := controllers.NewUser(models.NewUserService(s.Services.User, s.pepper), s.tokenAuth, s.clock)
 
-	magazineController := controllers.NewMagazine(services.Magazine)
-	userController := controllers.NewUser(services.User)
+	// Internal errors are logged next to the requests they belong to.
+	errorWriter := errors.Writer{Logger: s.logger}
+	handle := func(h controllers.Handler) http.Handler {
+		return controllers.Handle(h, s.logger)
+	}
 
-	s.Router.Use(middleware.Logger)
+	s.Router.Use(middleware.RequestID)
+	if s.logger != nil {
+		s.Router.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: s.logger, NoColor: true}))
+	} else {
+		s.Router.Use(middleware.Logger)
+	}
 	s.Router.Use(middleware.Recoverer)
-	s.Router.Use(middleware.Timeout(time.Minute * 3))
+	if s.middleware.Timeout > 0 {
+		// The change feed stays open for as long as the client listens.
+		s.Router.Use(middlewares.Skip(isChangeFeed, middleware.Timeout(s.middleware.Timeout)))
+	}
 	s.Router.Use(middleware.StripSlashes)
-	// TODO: improve CORS once API has frontend
 	s.Router.Use(cors.Handler(cors.Options{
-		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
-		AllowedOrigins: []string{"https://*", "http://*"},
+		AllowedOrigins: s.middleware.AllowedOrigins,
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "If-Match", "If-None-Match", "If-Modified-Since", "Last-Event-ID"},
+		ExposedHeaders:   []string{"Link", "ETag", "Last-Modified"},
 		AllowCredentials: false,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
-	// Enable httprate request limiter of 100 requests per minute.
-	s.Router.Use(httprate.Limit(100, 1*time.Minute, httprate.WithKeyFuncs(httprate.KeyByIP), httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
-		// We can send custom responses for the rate limited requests, e.g. a JSON message
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusTooManyRequests)
-		w.Write([]byte(`{"error": "Too many requests"}`))
-	})))
+	if s.middleware.RateLimit > 0 {
+		// Enable httprate request limiter, counting the requests of each IP.
+		s.Router.Use(httprate.Limit(s.middleware.RateLimit, s.middleware.RateWindow, httprate.WithKeyFuncs(httprate.KeyByIP), httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
+			errorWriter.Write(w, r, errors.New(http.StatusTooManyRequests, errors.CodeRateLimited, "too many requests"))
+		})))
+	}
 
 	s.Router.Get("/", HelloWorld)
 
+	cacheMagazine := middlewares.CacheControl(s.middleware.CacheControlMagazine)
+	cacheMagazines := middlewares.CacheControl(s.middleware.CacheControlMagazines)
+
 	s.Router.Route("/magazines", func(r chi.Router) {
-		r.Get("/", magazineController.GetAllMagazines)
-		r.Get("/slug/{magazineSlug:[a-zA-Z ]+}", magazineController.MagazineBySlug)
+		r.With(cacheMagazines).Method(http.MethodGet, "/", handle(magazineController.GetAllMagazines))
+		r.Method(http.MethodGet, "/export", handle(magazineController.ExportMagazines))
+		r.Method(http.MethodGet, "/changes", handle(magazineController.MagazineChanges))
+		if s.Services.MagazineCache != nil {
+			cacheController := controllers.NewCache(s.Services.MagazineCache)
+			r.Method(http.MethodGet, "/cache/stats", handle(cacheController.Stats))
+		}
+		r.With(cacheMagazine).Method(http.MethodGet, "/slug/{magazineSlug:[a-z0-9]+(?:-[a-z0-9]+)*}", handle(magazineController.MagazineBySlug))
 
 		// Protected update routes
 		r.Group(func(r chi.Router) {
-			r.Use(jwtauth.Verifier(auth.TokenAuth))
-			r.Use(jwtauth.Authenticator)
+			r.Use(jwtauth.Verifier(s.tokenAuth))
+			r.Use(middlewares.Authenticator)
 
-			r.Post("/{title}/{price}", magazineController.CreateMagazine)
-			r.Put("/{id}/{title}/{price}", magazineController.UpdateMagazine)
+			r.Method(http.MethodPost, "/", handle(magazineController.CreateMagazine))
+			r.Method(http.MethodPost, "/import", handle(magazineController.ImportMagazines))
+			r.Method(http.MethodGet, "/trash", handle(magazineController.TrashedMagazines))
 		})
 
-		r.Route("/search", func(r chi.Router) {
-			r.Get("/{field:[a-zA-Z ]+}/{term:[a-zA-Z ]+}", magazineController.SearchMagazines)
-		})
+		r.Method(http.MethodGet, "/search", handle(magazineController.SearchMagazines))
 
 		r.Route("/{magazineId}", func(r chi.Router) {
-			r.Get("/", magazineController.MagazineById)
+			r.With(cacheMagazine).Method(http.MethodGet, "/", handle(magazineController.MagazineById))
 
 			r.Group(func(r chi.Router) {
-				r.Use(jwtauth.Verifier(auth.TokenAuth))
-				r.Use(jwtauth.Authenticator)
+				r.Use(jwtauth.Verifier(s.tokenAuth))
+				r.Use(middlewares.Authenticator)
 
-				r.Delete("/", magazineController.DeleteMagazine)
+				r.Method(http.MethodPut, "/", handle(magazineController.UpdateMagazine))
+				r.Method(http.MethodPatch, "/", handle(magazineController.PatchMagazine))
+				r.Method(http.MethodDelete, "/", handle(magazineController.DeleteMagazine))
+				r.Method(http.MethodPost, "/restore", handle(magazineController.RestoreMagazine))
 			})
 		})
 
 		r.Route("/aggregations", func(r chi.Router) {
-			r.Get("/price/{price}", magazineController.AggregateMagazinePrice)
+			r.Method(http.MethodGet, "/price/stats", handle(magazineController.PriceStats))
+			r.Method(http.MethodGet, "/price/histogram", handle(magazineController.PriceHistogram))
 		})
 	})
 
+	// Search administration
+	if s.Services.Search != nil {
+		searchController := controllers.NewSearch(s.Services.Search)
+		s.Router.Route("/search", func(r chi.Router) {
+			r.Use(jwtauth.Verifier(s.tokenAuth))
+			r.Use(middlewares.Authenticator)
+
+			r.Method(http.MethodGet, "/synonyms", handle(searchController.Synonyms))
+			r.Method(http.MethodGet, "/synonyms/{name}", handle(searchController.SynonymSet))
+			r.Method(http.MethodPut, "/synonyms/{name}", handle(searchController.PutSynonymSet))
+			r.Method(http.MethodDelete, "/synonyms/{name}", handle(searchController.DeleteSynonymSet))
+			r.Method(http.MethodPost, "/index", handle(searchController.SyncIndex))
+		})
+	}
+
+	// Webhook administration
+	if s.Services.Webhook != nil {
+		webhookController := controllers.NewWebhooks(s.Services.Webhook)
+		s.Router.Route("/webhooks", func(r chi.Router) {
+			r.Use(jwtauth.Verifier(s.tokenAuth))
+			r.Use(middlewares.Authenticator)
+
+			r.Method(http.MethodGet, "/", handle(webhookController.Webhooks))
+			r.Method(http.MethodPost, "/", handle(webhookController.CreateWebhook))
+			r.Method(http.MethodGet, "/dead-letters", handle(webhookController.DeadLetters))
+			r.Method(http.MethodPost, "/deliveries/{deliveryId}/replay", handle(webhookController.ReplayDelivery))
+			r.Method(http.MethodGet, "/{webhookId}", handle(webhookController.Webhook))
+			r.Method(http.MethodDelete, "/{webhookId}", handle(webhookController.DeleteWebhook))
+			r.Method(http.MethodGet, "/{webhookId}/deliveries", handle(webhookController.Deliveries))
+		})
+	}
+
 	s.Router.Route("/user", func(r chi.Router) {
 		r.Group(func(r chi.Router) {
-			r.Use(jwtauth.Verifier(auth.TokenAuth))
+			r.Use(jwtauth.Verifier(s.tokenAuth))
 			r.Use(middlewares.Authenticator)
 
-			r.Get("/me", userController.GetUser)
+			r.Method(http.MethodGet, "/me", handle(userController.GetUser))
 		})
 
 		r.Group(func(r chi.Router) {
-			r.Post("/login", userController.Login)
-			r.Post("/logout", userController.Logout)
+			r.Method(http.MethodPost, "/login", handle(userController.Login))
+			r.Method(http.MethodPost, "/logout", handle(userController.Logout))
 		})
 	})
+	return nil
+}
+
+// isChangeFeed matches requests for the magazine change feed.
+func isChangeFeed(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/magazines/changes"
 }
 
 // HelloWorld api Handler
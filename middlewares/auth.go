@@ -1,7 +1,6 @@
 package middleware
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"github.com/go-chi/jwtauth"
@@ -14,16 +13,12 @@ func Authenticator(next http.Handler) http.Handler {
 		token, _, err := jwtauth.FromContext(r.Context())
 
 		if err != nil {
-			response := errors.Unauthorized(err)
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(response)
+			errors.Write(w, r, errors.Unauthorized(err))
 			return
 		}
 
 		if token == nil || jwt.Validate(token) != nil {
-			response := errors.Unauthorized(errors.ErrNoToken)
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(response)
+			errors.Write(w, r, errors.Unauthorized(errors.ErrNoToken))
 			return
 		}
 
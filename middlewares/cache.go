@@ -0,0 +1,16 @@
+package middleware
+
+import "net/http"
+
+// CacheControl sets the Cache-Control header of every response that passes
+// through it to value. An empty value leaves responses untouched.
+func CacheControl(value string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if value != "" {
+				w.Header().Set("Cache-Control", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import "net/http"
+
+// Skip applies mw to every request except those matched by skip, such as
+// long-lived streams that a request timeout would cut off.
+func Skip(skip func(r *http.Request) bool, mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
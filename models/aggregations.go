@@ -0,0 +1,278 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// MaxHistogramBuckets caps the number of buckets of a price histogram.
+	MaxHistogramBuckets = 100
+	// maxHistogramGroups caps the number of groups a histogram may be split
+	// into, since every group runs its own bucket stage.
+	maxHistogramGroups = 50
+	// aggregateTimeout bounds the run time of a single aggregation.
+	aggregateTimeout = 10 * time.Second
+)
+
+// AggregateOptions selects the magazines an aggregation runs over. Filter is
+// usually built by MagazineFields.Parse. GroupBy is the document path to
+// group the figures by, as returned by MagazineFields.GroupPath; empty
+// aggregates over all matching magazines at once.
+type AggregateOptions struct {
+	Filter  bson.D
+	GroupBy string
+}
+
+// HistogramOptions describes the buckets of a price histogram. Either
+// Boundaries lists ascending bucket edges, with each bucket holding the
+// prices from its lower edge up to but excluding its upper edge, or Buckets
+// asks Mongo to pick that many evenly filled buckets itself.
+type HistogramOptions struct {
+	AggregateOptions
+	Boundaries []primitive.Decimal128
+	Buckets    int
+}
+
+// PriceStats summarizes the prices of one group of magazines. Group is
+// omitted when the figures were not grouped.
+type PriceStats struct {
+	Group  interface{}          `bson:"group" json:"group,omitempty"`
+	Count  int64                `bson:"count" json:"count"`
+	Min    primitive.Decimal128 `bson:"min" json:"min"`
+	Max    primitive.Decimal128 `bson:"max" json:"max"`
+	Avg    primitive.Decimal128 `bson:"avg" json:"avg"`
+	Median primitive.Decimal128 `bson:"median" json:"median"`
+}
+
+// PriceHistogram counts the magazines of one group per price bucket.
+type PriceHistogram struct {
+	Group   interface{}   `json:"group,omitempty"`
+	Buckets []PriceBucket `json:"buckets"`
+}
+
+// PriceBucket holds the number of magazines priced from Min up to but
+// excluding Max. The last bucket chosen by Mongo also includes Max.
+type PriceBucket struct {
+	Min   primitive.Decimal128 `json:"min"`
+	Max   primitive.Decimal128 `json:"max"`
+	Count int64                `json:"count"`
+}
+
+// pricedStages are the leading stages of every price aggregation. They pick
+// the live magazines matching filter that have a price and convert the price
+// to Decimal128, so that all arithmetic after them stays in decimal.
+func pricedStages(filter bson.D) mongo.Pipeline {
+	hasPrice := bson.D{{Key: "price", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: query.And(filter, live, hasPrice)}},
+		{{Key: "$addFields", Value: bson.D{{Key: "price", Value: bson.D{{Key: "$toDecimal", Value: "$price"}}}}}},
+	}
+}
+
+// groupKey is the expression magazines are grouped by.
+func groupKey(path string) interface{} {
+	if path == "" {
+		return bson.D{{Key: "$literal", Value: nil}}
+	}
+	return "$" + path
+}
+
+func (mM *mongoMagazine) PriceStats(opts AggregateOptions) ([]PriceStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), aggregateTimeout)
+	defer cancel()
+
+	// The prices are sorted before they are pushed, so the median can be
+	// read off the middle of each group's price list.
+	half := bson.D{{Key: "$toInt", Value: bson.D{{Key: "$floor", Value: bson.D{{Key: "$divide", Value: bson.A{"$count", 2}}}}}}}
+	upperMiddle := bson.D{{Key: "$arrayElemAt", Value: bson.A{"$prices", half}}}
+	lowerMiddle := bson.D{{Key: "$arrayElemAt", Value: bson.A{"$prices", bson.D{{Key: "$subtract", Value: bson.A{half, 1}}}}}}
+	median := bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$mod", Value: bson.A{"$count", 2}}}, 1}}},
+		upperMiddle,
+		bson.D{{Key: "$divide", Value: bson.A{
+			bson.D{{Key: "$add", Value: bson.A{lowerMiddle, upperMiddle}}},
+			bson.D{{Key: "$toDecimal", Value: 2}},
+		}}},
+	}}}
+
+	pipeline := append(pricedStages(opts.Filter),
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "price", Value: 1}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: groupKey(opts.GroupBy)},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "min", Value: bson.D{{Key: "$min", Value: "$price"}}},
+			{Key: "max", Value: bson.D{{Key: "$max", Value: "$price"}}},
+			{Key: "avg", Value: bson.D{{Key: "$avg", Value: "$price"}}},
+			{Key: "prices", Value: bson.D{{Key: "$push", Value: "$price"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "group", Value: "$_id"},
+			{Key: "count", Value: 1},
+			{Key: "min", Value: 1},
+			{Key: "max", Value: 1},
+			{Key: "avg", Value: 1},
+			{Key: "median", Value: median},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "group", Value: 1}}}},
+	)
+
+	db := mM.collection("magazines")
+	cursor, err := db.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []PriceStats{}
+	if err := cursor.All(ctx, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// rawBucket is a bucket as returned by $bucket, whose _id is the lower
+// boundary, or by $bucketAuto, whose _id holds both edges.
+type rawBucket struct {
+	ID    bson.RawValue `bson:"_id"`
+	Count int64         `bson:"count"`
+}
+
+func (mM *mongoMagazine) PriceHistogram(opts HistogramOptions) ([]PriceHistogram, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), aggregateTimeout)
+	defer cancel()
+
+	db := mM.collection("magazines")
+	pipeline := append(pricedStages(opts.Filter), bucketStages(opts)...)
+
+	if opts.GroupBy == "" {
+		cursor, err := db.Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		var raw []rawBucket
+		if err := cursor.All(ctx, &raw); err != nil {
+			return nil, err
+		}
+		buckets, err := priceBuckets(opts, raw)
+		if err != nil {
+			return nil, err
+		}
+		return []PriceHistogram{{Buckets: buckets}}, nil
+	}
+
+	// $bucket and $bucketAuto cannot group, so every group gets its own
+	// sub-pipeline in a $facet.
+	groups, err := db.Distinct(ctx, opts.GroupBy, query.And(opts.Filter, live))
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) > maxHistogramGroups {
+		return nil, &query.Error{Param: "groupBy", Message: fmt.Sprintf("splits the histogram into more than %d groups", maxHistogramGroups)}
+	}
+	if len(groups) == 0 {
+		return []PriceHistogram{}, nil
+	}
+
+	facets := bson.D{}
+	for i, group := range groups {
+		match := bson.D{{Key: "$match", Value: bson.D{{Key: opts.GroupBy, Value: group}}}}
+		facets = append(facets, bson.E{Key: fmt.Sprintf("g%d", i), Value: append(mongo.Pipeline{match}, bucketStages(opts)...)})
+	}
+	pipeline = append(pricedStages(opts.Filter), bson.D{{Key: "$facet", Value: facets}})
+
+	cursor, err := db.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []map[string][]rawBucket
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("price histogram: expected one facet document, got %d", len(results))
+	}
+
+	histograms := make([]PriceHistogram, 0, len(groups))
+	for i, group := range groups {
+		buckets, err := priceBuckets(opts, results[0][fmt.Sprintf("g%d", i)])
+		if err != nil {
+			return nil, err
+		}
+		histograms = append(histograms, PriceHistogram{Group: group, Buckets: buckets})
+	}
+	return histograms, nil
+}
+
+// bucketStages builds the stages that count priced magazines per bucket.
+func bucketStages(opts HistogramOptions) mongo.Pipeline {
+	count := bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}
+
+	if len(opts.Boundaries) == 0 {
+		return mongo.Pipeline{{{Key: "$bucketAuto", Value: bson.D{
+			{Key: "groupBy", Value: "$price"},
+			{Key: "buckets", Value: opts.Buckets},
+			{Key: "output", Value: count},
+		}}}}
+	}
+
+	// $bucket fails on prices outside the boundaries, so they are dropped
+	// first.
+	boundaries := bson.A{}
+	for _, b := range opts.Boundaries {
+		boundaries = append(boundaries, b)
+	}
+	inRange := bson.D{{Key: "price", Value: bson.D{
+		{Key: "$gte", Value: opts.Boundaries[0]},
+		{Key: "$lt", Value: opts.Boundaries[len(opts.Boundaries)-1]},
+	}}}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: inRange}},
+		{{Key: "$bucket", Value: bson.D{
+			{Key: "groupBy", Value: "$price"},
+			{Key: "boundaries", Value: boundaries},
+			{Key: "output", Value: count},
+		}}},
+	}
+}
+
+// priceBuckets converts the raw output of bucketStages. With fixed
+// boundaries it also fills in the empty buckets that $bucket leaves out.
+func priceBuckets(opts HistogramOptions, raw []rawBucket) ([]PriceBucket, error) {
+	buckets := []PriceBucket{}
+
+	if len(opts.Boundaries) == 0 {
+		for _, r := range raw {
+			var edges struct {
+				Min primitive.Decimal128 `bson:"min"`
+				Max primitive.Decimal128 `bson:"max"`
+			}
+			if err := r.ID.Unmarshal(&edges); err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, PriceBucket{Min: edges.Min, Max: edges.Max, Count: r.Count})
+		}
+		return buckets, nil
+	}
+
+	counts := map[string]int64{}
+	for _, r := range raw {
+		lower, ok := r.ID.Decimal128OK()
+		if !ok {
+			return nil, fmt.Errorf("price histogram: unexpected bucket id %v", r.ID)
+		}
+		counts[lower.String()] = r.Count
+	}
+	for i := 0; i < len(opts.Boundaries)-1; i++ {
+		lower := opts.Boundaries[i]
+		buckets = append(buckets, PriceBucket{Min: lower, Max: opts.Boundaries[i+1], Count: counts[lower.String()]})
+	}
+	return buckets, nil
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPriceBucketsFillsEmptyBuckets(t *testing.T) {
+	decimal := func(s string) primitive.Decimal128 {
+		d, _ := primitive.ParseDecimal128(s)
+		return d
+	}
+	rawDecimal := func(s string) bson.RawValue {
+		_, data, _ := bson.MarshalValue(decimal(s))
+		return bson.RawValue{Type: bsontype.Decimal128, Value: data}
+	}
+
+	opts := HistogramOptions{Boundaries: []primitive.Decimal128{decimal("0"), decimal("10"), decimal("20"), decimal("30")}}
+	raw := []rawBucket{{ID: rawDecimal("0"), Count: 3}, {ID: rawDecimal("20"), Count: 1}}
+
+	buckets, err := priceBuckets(opts, raw)
+	if err != nil {
+		t.Fatalf("priceBuckets() error = %v", err)
+	}
+
+	want := []struct {
+		min, max string
+		count    int64
+	}{{"0", "10", 3}, {"10", "20", 0}, {"20", "30", 1}}
+	if len(buckets) != len(want) {
+		t.Fatalf("got %d buckets, want %d", len(buckets), len(want))
+	}
+	for i, w := range want {
+		b := buckets[i]
+		if b.Min.String() != w.min || b.Max.String() != w.max || b.Count != w.count {
+			t.Errorf("bucket %d = [%s, %s) %d, want [%s, %s) %d", i, b.Min, b.Max, b.Count, w.min, w.max, w.count)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache stores encoded values by key. Implementations must be safe for
+// concurrent use and count their own hits and misses.
+type Cache interface {
+	// Get returns the value stored under key, unless it has expired.
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+	// Clear removes every entry.
+	Clear()
+	Stats() CacheStats
+}
+
+// CacheStats counts how a cache has been used since it was created.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+// CacheConfig sizes the in-process magazine cache.
+type CacheConfig struct {
+	// Size is the most entries the cache holds before it evicts the least
+	// recently used one.
+	Size int
+	// TTL is how long an entry is served before it is read again.
+	TTL time.Duration
+}
+
+// NewLRUCache returns an in-process cache of at most size entries, each of
+// which expires ttl after it was set.
+func NewLRUCache(size int, ttl time.Duration) Cache {
+	if size < 1 {
+		size = 1
+	}
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		clock:   time.Now,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+var _ Cache = &lruCache{}
+
+type lruCache struct {
+	size  int
+	ttl   time.Duration
+	clock func() time.Time
+
+	mu sync.Mutex
+	// order holds the entries from the most to the least recently used.
+	order   *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok && c.clock().After(element.Value.(*lruEntry).expiresAt) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) Set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.clock().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value, entry.expiresAt = value, expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *lruCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *lruCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+func (c *lruCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	return stats
+}
+
+func (c *lruCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry).key)
+}
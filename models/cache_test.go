@@ -0,0 +1,43 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewLRUCache(2, time.Minute).(*lruCache)
+	cache.clock = func() time.Time { return clock }
+
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("a was not cached")
+	}
+	// b is now the least recently used entry.
+	cache.Set("c", []byte("3"))
+	if _, ok := cache.Get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	if value, ok := cache.Get("c"); !ok || string(value) != "3" {
+		t.Errorf("Get(c) = %q, %v", value, ok)
+	}
+
+	clock = clock.Add(2 * time.Minute)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("a did not expire")
+	}
+
+	want := CacheStats{Hits: 2, Misses: 2, Evictions: 1, Entries: 1}
+	if got := cache.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	cache.Delete("c")
+	cache.Set("d", []byte("4"))
+	cache.Clear()
+	if got := cache.Stats().Entries; got != 0 {
+		t.Errorf("%d entries left after Clear", got)
+	}
+}
@@ -0,0 +1,305 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Change types.
+const (
+	// ChangeCreate is sent for a new magazine and for one restored from
+	// the trash.
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	// ChangeDelete is sent when a magazine is moved to the trash. Purging
+	// it later sends nothing.
+	ChangeDelete = "delete"
+)
+
+var (
+	// ErrChangeHistoryLost is returned when a change feed cannot be resumed
+	// because the change it should resume after is no longer in the oplog.
+	ErrChangeHistoryLost = errors.New("the change to resume after is too old, start a new feed")
+	// ErrChangesUnavailable is returned when the database cannot stream
+	// changes, which needs a replica set or sharded cluster.
+	ErrChangesUnavailable = errors.New("the database does not support change feeds")
+)
+
+// Mongo error codes of failed change streams.
+const (
+	codeInvalidResumeToken      = 260
+	codeChangeStreamFatal       = 280
+	codeChangeStreamHistoryLost = 286
+	codeChangeStreamUnsupported = 40573
+)
+
+// changeFields lists the fields a change feed can be filtered on.
+var changeFields = map[string]bool{
+	"title":           true,
+	"slug":            true,
+	"price":           true,
+	"category":        true,
+	"publisher":       true,
+	"publicationYear": true,
+}
+
+// bookkeepingFields change with every write, so they are left out of the
+// fields of an update.
+var bookkeepingFields = map[string]bool{
+	"updatedAt":     true,
+	"version":       true,
+	"previousSlugs": true,
+}
+
+// MagazineChange is one create, update or delete of a magazine. ID is the
+// resume token of the change; a feed started with it as ResumeAfter
+// continues with the change after this one.
+type MagazineChange struct {
+	ID         string             `json:"id"`
+	Type       string             `json:"type"`
+	MagazineID primitive.ObjectID `json:"magazineId"`
+	// Magazine is the magazine as it is stored after the change. It is nil
+	// for deletes, and for updates of a magazine that has been deleted
+	// since.
+	Magazine *Magazine `json:"magazine,omitempty"`
+	// Fields lists the fields an update changed. It is empty when the
+	// whole magazine was replaced.
+	Fields []string  `json:"fields,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// ChangeOptions selects the changes of a feed. IDs and Fields are
+// optional: IDs limits the feed to those magazines, and Fields limits
+// updates to the ones that changed one of those fields. Creates and deletes
+// are always sent. An empty ResumeAfter starts with the next change. Wait is
+// how long ChangeFeed.Next waits for a change before it gives up.
+type ChangeOptions struct {
+	ResumeAfter string
+	IDs         []string
+	Fields      []string
+	Wait        time.Duration
+}
+
+// ChangeFeed is an open feed of magazine changes.
+type ChangeFeed interface {
+	// Next returns the next change, or nil if none arrived within the
+	// feed's Wait.
+	Next(ctx context.Context) (*MagazineChange, error)
+	// ResumeToken returns the position of the feed, which is ahead of the
+	// last change Next returned when later changes were filtered out.
+	ResumeToken() string
+	Close() error
+}
+
+// changeEvent is the part of a change stream event a feed reads.
+type changeEvent struct {
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      *Magazine `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// Changes opens a feed of the changes of the magazines selected by opts. It
+// reads them from a Mongo change stream, so it needs a replica set.
+func (mM *mongoMagazine) Changes(ctx context.Context, opts ChangeOptions) (ChangeFeed, error) {
+	ids, err := changeIDs(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	match := bson.D{{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"insert", "update", "replace"}}}}}
+	if len(ids) > 0 {
+		match = append(match, bson.E{Key: "documentKey._id", Value: bson.D{{Key: "$in", Value: ids}}})
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}}
+
+	streamOpts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if opts.Wait > 0 {
+		streamOpts.SetMaxAwaitTime(opts.Wait)
+	}
+	if opts.ResumeAfter != "" {
+		streamOpts.SetResumeAfter(bson.D{{Key: "_data", Value: opts.ResumeAfter}})
+	}
+
+	db := mM.collection("magazines")
+	stream, err := db.Watch(ctx, pipeline, streamOpts)
+	if err != nil {
+		return nil, changeStreamError(err)
+	}
+	return &mongoChangeFeed{stream: stream, fields: opts.Fields}, nil
+}
+
+type mongoChangeFeed struct {
+	stream *mongo.ChangeStream
+	fields []string
+}
+
+func (f *mongoChangeFeed) Next(ctx context.Context) (*MagazineChange, error) {
+	// TryNext waits up to the stream's max await time for a batch, so an
+	// empty batch ends the wait.
+	for f.stream.TryNext(ctx) {
+		event := changeEvent{}
+		if err := f.stream.Decode(&event); err != nil {
+			return nil, err
+		}
+		change, ok := magazineChange(event)
+		if !ok || !changesField(change, f.fields) {
+			continue
+		}
+		change.ID = resumeToken(f.stream.Current.Lookup("_id").Document())
+		return change, nil
+	}
+	if err := f.stream.Err(); err != nil {
+		return nil, changeStreamError(err)
+	}
+	return nil, nil
+}
+
+func (f *mongoChangeFeed) ResumeToken() string {
+	return resumeToken(f.stream.ResumeToken())
+}
+
+func (f *mongoChangeFeed) Close() error {
+	return f.stream.Close(context.Background())
+}
+
+// changeIDs checks the magazine ids and fields opts selects and returns
+// the ids.
+func changeIDs(opts ChangeOptions) (bson.A, error) {
+	ids := bson.A{}
+	for _, id := range opts.IDs {
+		objectId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, &query.Error{Param: "id", Message: fmt.Sprintf("%q is not a magazine id", id)}
+		}
+		ids = append(ids, objectId)
+	}
+	for _, field := range opts.Fields {
+		if !changeFields[field] {
+			return nil, &query.Error{Param: "field", Message: fmt.Sprintf("cannot follow changes of %q", field)}
+		}
+	}
+	return ids, nil
+}
+
+// resumeToken returns the string form of a change stream resume token.
+func resumeToken(token bson.Raw) string {
+	if token == nil {
+		return ""
+	}
+	data, _ := token.Lookup("_data").StringValueOK()
+	return data
+}
+
+// changeStreamError maps the errors of a change stream that clients can act
+// on to ErrChangeHistoryLost and ErrChangesUnavailable.
+func changeStreamError(err error) error {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	switch {
+	case serverErr.HasErrorCode(codeChangeStreamHistoryLost),
+		serverErr.HasErrorCode(codeChangeStreamFatal),
+		serverErr.HasErrorCode(codeInvalidResumeToken):
+		return fmt.Errorf("%w: %v", ErrChangeHistoryLost, err)
+	case serverErr.HasErrorCode(codeChangeStreamUnsupported):
+		return fmt.Errorf("%w: %v", ErrChangesUnavailable, err)
+	}
+	return err
+}
+
+// magazineChange turns a change stream event into a MagazineChange. Soft
+// deletes and restores are updates in Mongo but are reported as deletes and
+// creates. It returns false for operations that are not magazine writes.
+func magazineChange(event changeEvent) (*MagazineChange, bool) {
+	change := &MagazineChange{
+		MagazineID: event.DocumentKey.ID,
+		Magazine:   event.FullDocument,
+		Time:       time.Unix(int64(event.ClusterTime.T), 0).UTC(),
+	}
+
+	switch event.OperationType {
+	case "insert":
+		change.Type = ChangeCreate
+	case "replace":
+		change.Type = ChangeUpdate
+	case "update":
+		fields := updatedFields(event.UpdateDescription.UpdatedFields, event.UpdateDescription.RemovedFields)
+		switch {
+		case fields["deletedAt"] == updatedField:
+			change.Type = ChangeDelete
+			change.Magazine = nil
+		case fields["deletedAt"] == removedField:
+			change.Type = ChangeCreate
+		default:
+			change.Type = ChangeUpdate
+			for field := range fields {
+				if !bookkeepingFields[field] {
+					change.Fields = append(change.Fields, field)
+				}
+			}
+			sort.Strings(change.Fields)
+		}
+	default:
+		return nil, false
+	}
+
+	if change.Magazine != nil && change.Magazine.DeletedAt != nil {
+		// The magazine has been deleted since; its delete follows.
+		change.Magazine = nil
+	}
+	return change, true
+}
+
+const (
+	updatedField = 1
+	removedField = 2
+)
+
+// updatedFields returns the top-level fields an update set or removed.
+func updatedFields(updated bson.Raw, removed []string) map[string]int {
+	fields := map[string]int{}
+	elements, _ := updated.Elements()
+	for _, element := range elements {
+		field, _, _ := strings.Cut(element.Key(), ".")
+		fields[field] = updatedField
+	}
+	for _, path := range removed {
+		field, _, _ := strings.Cut(path, ".")
+		fields[field] = removedField
+	}
+	return fields
+}
+
+// changesField reports whether change should be sent to a feed following
+// fields.
+func changesField(change *MagazineChange, fields []string) bool {
+	if len(fields) == 0 || change.Type != ChangeUpdate || len(change.Fields) == 0 {
+		return true
+	}
+	for _, field := range fields {
+		for _, changed := range change.Fields {
+			if field == changed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func updateEvent(t *testing.T, set bson.D, removed []string, magazine *Magazine) changeEvent {
+	t.Helper()
+	updated, err := bson.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := changeEvent{OperationType: "update", FullDocument: magazine}
+	event.DocumentKey.ID = primitive.NewObjectID()
+	event.UpdateDescription.UpdatedFields = updated
+	event.UpdateDescription.RemovedFields = removed
+	return event
+}
+
+func TestMagazineChange(t *testing.T) {
+	deletedAt := time.Now()
+	magazine := &Magazine{Title: "Wired"}
+
+	tests := []struct {
+		name         string
+		event        changeEvent
+		wantType     string
+		wantFields   []string
+		wantMagazine bool
+	}{
+		{
+			name:         "insert",
+			event:        changeEvent{OperationType: "insert", FullDocument: magazine},
+			wantType:     ChangeCreate,
+			wantMagazine: true,
+		},
+		{
+			name:         "update",
+			event:        updateEvent(t, bson.D{{Key: "price", Value: "9.99"}, {Key: "version", Value: 2}, {Key: "previousSlugs.0", Value: "wired"}}, []string{"category"}, magazine),
+			wantType:     ChangeUpdate,
+			wantFields:   []string{"category", "price"},
+			wantMagazine: true,
+		},
+		{
+			name:     "soft delete",
+			event:    updateEvent(t, bson.D{{Key: "deletedAt", Value: deletedAt}}, nil, &Magazine{DeletedAt: &deletedAt}),
+			wantType: ChangeDelete,
+		},
+		{
+			name:         "restore",
+			event:        updateEvent(t, bson.D{{Key: "updatedAt", Value: deletedAt}}, []string{"deletedAt"}, magazine),
+			wantType:     ChangeCreate,
+			wantMagazine: true,
+		},
+		{
+			name:       "update of a magazine deleted since",
+			event:      updateEvent(t, bson.D{{Key: "title", Value: "Vogue"}}, nil, &Magazine{DeletedAt: &deletedAt}),
+			wantType:   ChangeUpdate,
+			wantFields: []string{"title"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change, ok := magazineChange(tt.event)
+			if !ok {
+				t.Fatal("magazineChange() skipped the event")
+			}
+			if change.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", change.Type, tt.wantType)
+			}
+			if !reflect.DeepEqual(change.Fields, tt.wantFields) {
+				t.Errorf("Fields = %v, want %v", change.Fields, tt.wantFields)
+			}
+			if (change.Magazine != nil) != tt.wantMagazine {
+				t.Errorf("Magazine = %v, want it set: %v", change.Magazine, tt.wantMagazine)
+			}
+		})
+	}
+
+	if _, ok := magazineChange(changeEvent{OperationType: "delete"}); ok {
+		t.Error("magazineChange() reported a purge")
+	}
+}
+
+func TestChangesField(t *testing.T) {
+	update := &MagazineChange{Type: ChangeUpdate, Fields: []string{"price"}}
+	create := &MagazineChange{Type: ChangeCreate}
+
+	if !changesField(update, nil) {
+		t.Error("an unfiltered feed dropped an update")
+	}
+	if !changesField(update, []string{"title", "price"}) {
+		t.Error("an update of a followed field was dropped")
+	}
+	if changesField(update, []string{"title"}) {
+		t.Error("an update of another field was sent")
+	}
+	if !changesField(create, []string{"title"}) {
+		t.Error("a create was dropped")
+	}
+}
@@ -0,0 +1,597 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The contract tests run every MagazineDB and UserDB implementation through
+// the same cases, so the in-memory backends keep behaving like Mongo. The
+// Mongo backend is only tested when MONGODB_TEST_URI is set. Every test
+// then gets a database of its own, which is dropped when it ends.
+
+type magazineBackend struct {
+	name string
+	open func(t *testing.T) MagazineDB
+}
+
+func magazineBackends(t *testing.T) []magazineBackend {
+	backends := []magazineBackend{{
+		name: "memory",
+		open: func(t *testing.T) MagazineDB { return NewMemoryMagazineDB() },
+	}}
+
+	if client := testMongoClient(t); client != nil {
+		backends = append(backends, magazineBackend{
+			name: "mongo",
+			open: func(t *testing.T) MagazineDB {
+				database := testDatabase(t, client)
+				return &mongoMagazine{
+					db:       client,
+					database: database,
+					search:   &textSearch{db: client, database: database, fields: DefaultSearchFields},
+				}
+			},
+		})
+	}
+	return backends
+}
+
+type userBackend struct {
+	name string
+	open func(t *testing.T, users ...User) UserDB
+}
+
+func userBackends(t *testing.T) []userBackend {
+	backends := []userBackend{{
+		name: "memory",
+		open: func(t *testing.T, users ...User) UserDB {
+			db, err := NewMemoryUserDB(users...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+	}}
+
+	if client := testMongoClient(t); client != nil {
+		backends = append(backends, userBackend{
+			name: "mongo",
+			open: func(t *testing.T, users ...User) UserDB {
+				database := testDatabase(t, client)
+				collection := client.Database(database).Collection("authentication")
+				for _, user := range users {
+					if user.ID.IsZero() {
+						user.ID = primitive.NewObjectID()
+					}
+					if _, err := collection.InsertOne(context.Background(), user); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return &userMongo{db: client, database: database}
+			},
+		})
+	}
+	return backends
+}
+
+// testMongoClient connects to MONGODB_TEST_URI, or returns nil if it is not
+// set.
+func testMongoClient(t *testing.T) *mongo.Client {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connecting to MONGODB_TEST_URI: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+// testDatabase names a new database for a test and drops it once the test
+// is done.
+func testDatabase(t *testing.T, client *mongo.Client) string {
+	name := "contract_" + primitive.NewObjectID().Hex()
+	t.Cleanup(func() {
+		if err := client.Database(name).Drop(context.Background()); err != nil {
+			t.Errorf("dropping %s: %v", name, err)
+		}
+	})
+	return name
+}
+
+func forEachMagazineDB(t *testing.T, test func(t *testing.T, db MagazineDB)) {
+	for _, backend := range magazineBackends(t) {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t))
+		})
+	}
+}
+
+func decimal(t *testing.T, s string) primitive.Decimal128 {
+	t.Helper()
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// sameNumber compares decimals by value, since backends may differ in the
+// number of trailing zeros of computed figures.
+func sameNumber(t *testing.T, got primitive.Decimal128, want string) bool {
+	t.Helper()
+	x, ok := decimalRat(got)
+	y, _ := new(big.Rat).SetString(want)
+	return ok && x.Cmp(y) == 0
+}
+
+func mustCreate(t *testing.T, db MagazineDB, magazine Magazine) *Magazine {
+	t.Helper()
+	created, err := db.Create(magazine)
+	if err != nil {
+		t.Fatalf("Create(%q) error = %v", magazine.Title, err)
+	}
+	return created
+}
+
+func TestMagazineDBCreateAndFind(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		first := mustCreate(t, db, Magazine{Title: "Wired", Price: decimal(t, "5.99")})
+		second := mustCreate(t, db, Magazine{Title: "Wired", Price: decimal(t, "6.99")})
+		if first.Version != 1 || first.Slug != "wired" || second.Slug != "wired-2" {
+			t.Errorf("created version %d with slugs %q and %q", first.Version, first.Slug, second.Slug)
+		}
+
+		found, err := db.FindById(first.ID.Hex())
+		if err != nil || found.Title != "Wired" || found.Price.String() != "5.99" {
+			t.Errorf("FindById() = %+v, %v", found, err)
+		}
+		found, err = db.FindBySlug("wired-2")
+		if err != nil || found.ID != second.ID {
+			t.Errorf("FindBySlug(wired-2) = %+v, %v", found, err)
+		}
+
+		if _, err := db.FindById(primitive.NewObjectID().Hex()); err != mongo.ErrNoDocuments {
+			t.Errorf("FindById(unknown) error = %v, want ErrNoDocuments", err)
+		}
+		if _, err := db.FindBySlug("vogue"); err != mongo.ErrNoDocuments {
+			t.Errorf("FindBySlug(unknown) error = %v, want ErrNoDocuments", err)
+		}
+		if _, err := db.FindById("not-an-id"); !errors.Is(err, primitive.ErrInvalidHex) {
+			t.Errorf("FindById(not-an-id) error = %v, want ErrInvalidHex", err)
+		}
+		if _, err := db.Create(Magazine{ID: first.ID, Title: "Vogue", Price: decimal(t, "4")}); !mongo.IsDuplicateKeyError(err) {
+			t.Errorf("Create() with a taken id error = %v, want a duplicate key error", err)
+		}
+	})
+}
+
+func TestMagazineDBUpdate(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		created := mustCreate(t, db, Magazine{Title: "Wired", Price: decimal(t, "5.99"), Category: "Tech"})
+
+		renamed := Magazine{ID: created.ID, Title: "Wired UK", Price: decimal(t, "6.50"), Version: 1}
+		updated, err := db.UpdateById(renamed)
+		if err != nil {
+			t.Fatalf("UpdateById() error = %v", err)
+		}
+		if updated.Version != 2 || updated.Slug != "wired-uk" || !reflect.DeepEqual(updated.PreviousSlugs, []string{"wired"}) || updated.Category != "" {
+			t.Errorf("UpdateById() = %+v", updated)
+		}
+		if found, err := db.FindBySlug("wired"); err != nil || found.Slug != "wired-uk" {
+			t.Errorf("FindBySlug(previous slug) = %+v, %v", found, err)
+		}
+
+		if _, err := db.UpdateById(renamed); err != ErrVersionConflict {
+			t.Errorf("UpdateById() at a stale version error = %v, want ErrVersionConflict", err)
+		}
+		if _, err := db.UpdateById(Magazine{ID: primitive.NewObjectID(), Title: "Vogue", Price: decimal(t, "4")}); err != mongo.ErrNoDocuments {
+			t.Errorf("UpdateById(unknown) error = %v, want ErrNoDocuments", err)
+		}
+
+		patch := MagazinePatch{
+			Set:     bson.D{{Key: "price", Value: decimal(t, "7.25")}, {Key: "publisher", Value: "Condé Nast"}},
+			Version: 2,
+		}
+		patched, err := db.Patch(created.ID.Hex(), patch)
+		if err != nil {
+			t.Fatalf("Patch() error = %v", err)
+		}
+		if patched.Version != 3 || patched.Price.String() != "7.25" || patched.Publisher != "Condé Nast" || patched.Title != "Wired UK" {
+			t.Errorf("Patch() = %+v", patched)
+		}
+
+		failing := MagazinePatch{Test: bson.D{{Key: "title", Value: "Wired"}}, Unset: []string{"publisher"}}
+		if _, err := db.Patch(created.ID.Hex(), failing); err != ErrPatchTestFailed {
+			t.Errorf("Patch() with a failing test error = %v, want ErrPatchTestFailed", err)
+		}
+		if _, err := db.Patch(created.ID.Hex(), MagazinePatch{Unset: []string{"publisher"}, Version: 2}); err != ErrVersionConflict {
+			t.Errorf("Patch() at a stale version error = %v, want ErrVersionConflict", err)
+		}
+	})
+}
+
+func TestMagazineDBTrash(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		created := mustCreate(t, db, Magazine{Title: "Wired", Price: decimal(t, "5.99")})
+		mustCreate(t, db, Magazine{Title: "Vogue", Price: decimal(t, "4.50")})
+
+		if _, err := db.Delete(created.ID.Hex(), 7); err != ErrVersionConflict {
+			t.Errorf("Delete() at a wrong version error = %v, want ErrVersionConflict", err)
+		}
+		deleted, err := db.Delete(created.ID.Hex(), 1)
+		if err != nil || deleted.DeletedAt == nil || deleted.Version != 2 {
+			t.Fatalf("Delete() = %+v, %v", deleted, err)
+		}
+		if _, err := db.FindById(created.ID.Hex()); err != mongo.ErrNoDocuments {
+			t.Errorf("FindById(deleted) error = %v, want ErrNoDocuments", err)
+		}
+		if _, err := db.Delete(created.ID.Hex(), 0); err != mongo.ErrNoDocuments {
+			t.Errorf("Delete(deleted) error = %v, want ErrNoDocuments", err)
+		}
+
+		trash, err := db.FindAll(ListOptions{Trashed: true})
+		if err != nil || len(trash.Magazines) != 1 || trash.Magazines[0].ID != created.ID {
+			t.Errorf("FindAll(trashed) = %+v, %v", trash, err)
+		}
+
+		restored, err := db.Restore(created.ID.Hex())
+		if err != nil || restored.DeletedAt != nil || restored.Version != 3 {
+			t.Errorf("Restore() = %+v, %v", restored, err)
+		}
+		if _, err := db.Restore(created.ID.Hex()); err != mongo.ErrNoDocuments {
+			t.Errorf("Restore(live) error = %v, want ErrNoDocuments", err)
+		}
+
+		if _, err := db.Delete(created.ID.Hex(), 0); err != nil {
+			t.Fatal(err)
+		}
+		purged, err := db.Purge(time.Now().Add(time.Second))
+		if err != nil || purged != 1 {
+			t.Errorf("Purge() = %d, %v, want 1", purged, err)
+		}
+		if page, _ := db.FindAll(ListOptions{}); len(page.Magazines) != 1 {
+			t.Errorf("%d live magazines after the purge, want 1", len(page.Magazines))
+		}
+	})
+}
+
+func TestMagazineDBIgnoresDeletedAt(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		var body Magazine
+		if err := json.Unmarshal([]byte(`{"title":"Wired","price":"5.99","deletedAt":"2023-01-02T03:04:05Z"}`), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		created := mustCreate(t, db, body)
+		if created.DeletedAt != nil {
+			t.Errorf("Create() = %+v, want a live magazine", created)
+		}
+
+		body.ID = created.ID
+		updated, err := db.UpdateById(body)
+		if err != nil || updated.DeletedAt != nil {
+			t.Errorf("UpdateById() = %+v, %v, want a live magazine", updated, err)
+		}
+		if _, err := db.FindById(created.ID.Hex()); err != nil {
+			t.Errorf("FindById() error = %v", err)
+		}
+		if trash, err := db.FindAll(ListOptions{Trashed: true}); err != nil || len(trash.Magazines) != 0 {
+			t.Errorf("FindAll(trashed) = %+v, %v, want no magazines", trash, err)
+		}
+	})
+}
+
+func TestMagazineDBFindAll(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		for _, magazine := range []Magazine{
+			{Title: "Wired", Price: decimal(t, "5.99"), Category: "Tech"},
+			{Title: "Vogue", Price: decimal(t, "4.50"), Category: "Fashion"},
+			{Title: "Elle", Price: decimal(t, "4.50"), Category: "Fashion"},
+			{Title: "The Economist", Price: decimal(t, "9"), Category: "News"},
+			{Title: "Time", Price: decimal(t, "3"), Category: "News"},
+		} {
+			mustCreate(t, db, magazine)
+		}
+
+		q, err := MagazineFields.Parse(url.Values{"price[gte]": {"4"}, "sort": {"-price,title"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles := []string{}
+		opts := ListOptions{Filter: q.Filter, Sort: q.Sort, Limit: 2}
+		for {
+			page, err := db.FindAll(opts)
+			if err != nil {
+				t.Fatalf("FindAll() error = %v", err)
+			}
+			for _, magazine := range page.Magazines {
+				titles = append(titles, magazine.Title)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		want := []string{"The Economist", "Wired", "Elle", "Vogue"}
+		if !reflect.DeepEqual(titles, want) {
+			t.Errorf("paged titles = %v, want %v", titles, want)
+		}
+
+		q, _ = MagazineFields.Parse(url.Values{"category[in]": {"News,Tech"}, "title[prefix]": {"T"}})
+		streamed := []string{}
+		err = db.Stream(context.Background(), ListOptions{Filter: q.Filter}, func(magazine *Magazine) error {
+			streamed = append(streamed, magazine.Title)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(streamed, []string{"The Economist", "Time"}) {
+			t.Errorf("Stream() = %v, %v", streamed, err)
+		}
+	})
+}
+
+// Optional fields are left out of documents that do not have them, yet
+// listings can be sorted on them.
+func TestMagazineDBFindAllMissingSortKey(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		for _, magazine := range []Magazine{
+			{Title: "Wired", Price: decimal(t, "5.99"), Category: "Tech"},
+			{Title: "Time", Price: decimal(t, "3")},
+			{Title: "Vogue", Price: decimal(t, "4.50"), Category: "Fashion"},
+			{Title: "Elle", Price: decimal(t, "4.50")},
+		} {
+			mustCreate(t, db, magazine)
+		}
+
+		for _, tt := range []struct {
+			sort string
+			want []string
+		}{
+			{"category,title", []string{"Elle", "Time", "Vogue", "Wired"}},
+			{"-category,title", []string{"Wired", "Vogue", "Elle", "Time"}},
+		} {
+			q, err := MagazineFields.Parse(url.Values{"sort": {tt.sort}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			titles := []string{}
+			opts := ListOptions{Sort: q.Sort, Limit: 1}
+			for len(titles) <= len(tt.want) {
+				page, err := db.FindAll(opts)
+				if err != nil {
+					t.Fatalf("FindAll(sort=%s) error = %v", tt.sort, err)
+				}
+				for _, magazine := range page.Magazines {
+					titles = append(titles, magazine.Title)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+			if !reflect.DeepEqual(titles, tt.want) {
+				t.Errorf("paged titles sorted by %s = %v, want %v", tt.sort, titles, tt.want)
+			}
+		}
+	})
+}
+
+func TestMagazineDBImportBatch(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		vogue := mustCreate(t, db, Magazine{Title: "Vogue", Price: decimal(t, "4.50")})
+		trashed := mustCreate(t, db, Magazine{Title: "Time", Price: decimal(t, "3")})
+		if _, err := db.Delete(trashed.ID.Hex(), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		rows := []ImportRow{
+			{Line: 2, Magazine: Magazine{Title: "Vogue", Price: decimal(t, "5")}},
+			{Line: 3, Magazine: Magazine{Title: "Elle", Price: decimal(t, "3.99"), Category: "Fashion"}},
+			{Line: 4, Magazine: Magazine{ID: trashed.ID, Title: "Time", Price: decimal(t, "4")}},
+		}
+
+		dryRun, err := db.importBatch(rows, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := []string{}
+		for _, result := range dryRun {
+			statuses = append(statuses, result.Status)
+		}
+		if want := []string{ImportUpdated, ImportCreated, ImportRejected}; !reflect.DeepEqual(statuses, want) {
+			t.Errorf("dry run statuses = %v, want %v", statuses, want)
+		}
+
+		results, err := db.importBatch(rows, false)
+		if err != nil {
+			t.Fatalf("importBatch() error = %v", err)
+		}
+		statuses = statuses[:0]
+		for _, result := range results {
+			statuses = append(statuses, result.Status)
+		}
+		if want := []string{ImportUpdated, ImportCreated, ImportRejected}; !reflect.DeepEqual(statuses, want) {
+			t.Errorf("statuses = %v, want %v", statuses, want)
+		}
+		if results[0].ID != vogue.ID.Hex() {
+			t.Errorf("updated id = %s, want %s", results[0].ID, vogue.ID.Hex())
+		}
+		// A dry run rejects trashed ids for the same reason an import does.
+		if !reflect.DeepEqual(dryRun[2], results[2]) {
+			t.Errorf("dry run of a trashed id = %+v, import = %+v", dryRun[2], results[2])
+		}
+
+		elle, err := db.FindBySlug("elle")
+		if err != nil || elle.ID.Hex() != results[1].ID || elle.Version != 1 || elle.Category != "Fashion" {
+			t.Errorf("imported magazine = %+v, %v", elle, err)
+		}
+		if updated, _ := db.FindById(vogue.ID.Hex()); updated.Price.String() != "5" || updated.Version != 2 {
+			t.Errorf("updated magazine = %+v", updated)
+		}
+	})
+}
+
+func TestMagazineDBAggregations(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		for _, magazine := range []Magazine{
+			{Title: "Wired", Price: decimal(t, "2"), Category: "Tech"},
+			{Title: "Vogue", Price: decimal(t, "4"), Category: "Fashion"},
+			{Title: "Elle", Price: decimal(t, "9"), Category: "Fashion"},
+		} {
+			mustCreate(t, db, magazine)
+		}
+
+		stats, err := db.PriceStats(AggregateOptions{})
+		if err != nil || len(stats) != 1 {
+			t.Fatalf("PriceStats() = %+v, %v", stats, err)
+		}
+		if s := stats[0]; s.Count != 3 || !sameNumber(t, s.Min, "2") || !sameNumber(t, s.Max, "9") ||
+			!sameNumber(t, s.Avg, "5") || !sameNumber(t, s.Median, "4") {
+			t.Errorf("PriceStats() = %+v", s)
+		}
+
+		stats, err = db.PriceStats(AggregateOptions{GroupBy: "category"})
+		if err != nil || len(stats) != 2 || stats[0].Group != "Fashion" || !sameNumber(t, stats[0].Median, "6.5") {
+			t.Errorf("PriceStats(category) = %+v, %v", stats, err)
+		}
+
+		histograms, err := db.PriceHistogram(HistogramOptions{Boundaries: []primitive.Decimal128{
+			decimal(t, "0"), decimal(t, "5"), decimal(t, "10"), decimal(t, "20"),
+		}})
+		if err != nil || len(histograms) != 1 {
+			t.Fatalf("PriceHistogram() = %+v, %v", histograms, err)
+		}
+		counts := []int64{}
+		for _, bucket := range histograms[0].Buckets {
+			counts = append(counts, bucket.Count)
+		}
+		if !reflect.DeepEqual(counts, []int64{2, 1, 0}) {
+			t.Errorf("bucket counts = %v, want [2 1 0]", counts)
+		}
+	})
+}
+
+func TestMagazineDBSearch(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		for _, magazine := range []Magazine{
+			{Title: "Wired", Price: decimal(t, "5.99"), Category: "Tech"},
+			{Title: "Wireless World", Price: decimal(t, "7"), Category: "Tech"},
+			{Title: "Vogue", Price: decimal(t, "4.50"), Category: "Fashion"},
+		} {
+			mustCreate(t, db, magazine)
+		}
+
+		result, err := db.Search(SearchOptions{Term: "vogue"})
+		if err != nil || result.Total != 1 || result.Hits[0].Title != "Vogue" || result.Hits[0].Highlights == nil {
+			t.Fatalf("Search(vogue) = %+v, %v", result, err)
+		}
+		if fashion := result.Facets["category"]; len(fashion) != 1 || fashion[0].Value != "Fashion" {
+			t.Errorf("category facet = %+v", fashion)
+		}
+
+		result, err = db.Search(SearchOptions{Term: "wire"})
+		if err != nil || result.Total != 2 || result.Hits[0].Title != "Wired" {
+			t.Errorf("Search(wire) = %+v, %v", result, err)
+		}
+
+		if _, err := db.Search(SearchOptions{Term: " "}); err == nil {
+			t.Error("Search() with an empty term succeeded")
+		}
+	})
+}
+
+func TestMagazineDBChanges(t *testing.T) {
+	forEachMagazineDB(t, func(t *testing.T, db MagazineDB) {
+		ctx := context.Background()
+		feed, err := db.Changes(ctx, ChangeOptions{Wait: time.Second})
+		if errors.Is(err, ErrChangesUnavailable) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatalf("Changes() error = %v", err)
+		}
+		defer feed.Close()
+
+		created := mustCreate(t, db, Magazine{Title: "Wired", Price: decimal(t, "5.99")})
+		if _, err := db.Patch(created.ID.Hex(), MagazinePatch{Set: bson.D{{Key: "price", Value: decimal(t, "6")}}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Delete(created.ID.Hex(), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		changes := []*MagazineChange{}
+		for len(changes) < 3 {
+			change, err := feed.Next(ctx)
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			if change == nil {
+				t.Fatalf("got %d changes, want 3", len(changes))
+			}
+			changes = append(changes, change)
+		}
+		if changes[0].Type != ChangeCreate || changes[1].Type != ChangeUpdate || changes[2].Type != ChangeDelete {
+			t.Errorf("change types = %s, %s, %s", changes[0].Type, changes[1].Type, changes[2].Type)
+		}
+		if !reflect.DeepEqual(changes[1].Fields, []string{"price"}) || changes[2].Magazine != nil {
+			t.Errorf("update fields = %v, delete magazine = %v", changes[1].Fields, changes[2].Magazine)
+		}
+
+		resumed, err := db.Changes(ctx, ChangeOptions{ResumeAfter: changes[0].ID, Wait: time.Second})
+		if err != nil {
+			t.Fatalf("Changes() resuming error = %v", err)
+		}
+		defer resumed.Close()
+		if change, err := resumed.Next(ctx); err != nil || change == nil || change.ID != changes[1].ID {
+			t.Errorf("resumed Next() = %+v, %v, want the update", change, err)
+		}
+	})
+}
+
+func TestUserDBByEmail(t *testing.T) {
+	for _, backend := range userBackends(t) {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			db := backend.open(t,
+				User{Name: "Ada", Email: "ada@example.com", Password: "hash"},
+				User{Name: "Grace", Email: "grace@example.com", Password: "hash"},
+			)
+
+			user, err := db.ByEmail("grace@example.com")
+			if err != nil || user.Name != "Grace" || user.ID.IsZero() {
+				t.Errorf("ByEmail() = %+v, %v", user, err)
+			}
+			if _, err := db.ByEmail("alan@example.com"); err != mongo.ErrNoDocuments {
+				t.Errorf("ByEmail(unknown) error = %v, want ErrNoDocuments", err)
+			}
+		})
+	}
+}
+
+func TestNewMemoryUserDBDuplicateID(t *testing.T) {
+	id := primitive.NewObjectID()
+	_, err := NewMemoryUserDB(User{ID: id, Email: "ada@example.com"}, User{ID: id, Email: "grace@example.com"})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("NewMemoryUserDB() error = %v, want a duplicate key error", err)
+	}
+}
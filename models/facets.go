@@ -0,0 +1,212 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxFacetValues caps the number of buckets of a value facet.
+	maxFacetValues = 20
+	// yearFacetFrom is the first publication year Atlas Search counts.
+	// Atlas can only count numbers in ranges, so every year from this one
+	// to next year gets its own range.
+	yearFacetFrom = 1900
+)
+
+// searchFacet is one facet returned alongside search hits. A value facet
+// counts the hits per distinct value, most frequent first. A range facet
+// counts the hits per range between two consecutive boundaries.
+type searchFacet struct {
+	name string
+	path string
+	// boundaries of a range facet, as decimal strings. The last one is
+	// exclusive.
+	boundaries []string
+	// numeric value facets are counted per whole number on Atlas.
+	numeric bool
+}
+
+var searchFacets = []searchFacet{
+	{name: "category", path: "category"},
+	{name: "publisher", path: "publisher"},
+	{name: "price", path: "price", boundaries: []string{"0", "5", "10", "20", "50", "100", "1000000"}},
+	{name: "publicationYear", path: "publicationYear", numeric: true},
+}
+
+// FacetBucket counts the search hits that have one value of a facet field,
+// or, for range facets, a value from Value up to but excluding Max. Clients
+// narrow a search by passing the bucket back as a filter, such as
+// category=News or price[gte]=10&price[lt]=20.
+type FacetBucket struct {
+	Value interface{} `json:"value"`
+	Max   interface{} `json:"max,omitempty"`
+	Count int64       `json:"count"`
+}
+
+// rawFacetBucket is a bucket as counted by Mongo: _id is the value or the
+// lower boundary of the bucket.
+type rawFacetBucket struct {
+	ID    bson.RawValue `bson:"_id"`
+	Count int64         `bson:"count"`
+}
+
+// facetStage counts the facets of the documents entering it with $facet.
+func facetStage() bson.D {
+	facets := bson.D{}
+	for _, f := range searchFacets {
+		var pipeline mongo.Pipeline
+		if f.boundaries == nil {
+			present := bson.D{{Key: f.path, Value: bson.D{{Key: "$nin", Value: bson.A{nil, ""}}}}}
+			pipeline = mongo.Pipeline{
+				{{Key: "$match", Value: present}},
+				{{Key: "$sortByCount", Value: "$" + f.path}},
+				{{Key: "$limit", Value: maxFacetValues}},
+			}
+		} else {
+			boundaries := bson.A{}
+			for _, b := range f.boundaries {
+				d, _ := primitive.ParseDecimal128(b)
+				boundaries = append(boundaries, d)
+			}
+			pipeline = mongo.Pipeline{{{Key: "$bucket", Value: bson.D{
+				{Key: "groupBy", Value: "$" + f.path},
+				{Key: "boundaries", Value: boundaries},
+				{Key: "default", Value: "other"},
+				{Key: "output", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}},
+			}}}}
+		}
+		facets = append(facets, bson.E{Key: f.name, Value: pipeline})
+	}
+	return bson.D{{Key: "$facet", Value: facets}}
+}
+
+// atlasFacets defines the facets for the facet collector of $searchMeta.
+func atlasFacets(now time.Time) bson.D {
+	facets := bson.D{}
+	for _, f := range searchFacets {
+		var definition bson.D
+		switch {
+		case f.boundaries != nil:
+			boundaries := bson.A{}
+			for _, b := range f.boundaries {
+				value, _ := strconv.ParseFloat(b, 64)
+				boundaries = append(boundaries, value)
+			}
+			definition = bson.D{
+				{Key: "type", Value: "number"},
+				{Key: "path", Value: f.path},
+				{Key: "boundaries", Value: boundaries},
+				{Key: "default", Value: "other"},
+			}
+		case f.numeric:
+			boundaries := bson.A{}
+			for year := yearFacetFrom; year <= now.Year()+2; year++ {
+				boundaries = append(boundaries, year)
+			}
+			definition = bson.D{
+				{Key: "type", Value: "number"},
+				{Key: "path", Value: f.path},
+				{Key: "boundaries", Value: boundaries},
+				{Key: "default", Value: "other"},
+			}
+		default:
+			definition = bson.D{
+				{Key: "type", Value: "string"},
+				{Key: "path", Value: f.path},
+				{Key: "numBuckets", Value: maxFacetValues},
+			}
+		}
+		facets = append(facets, bson.E{Key: f.name, Value: definition})
+	}
+	return facets
+}
+
+// facetResults turns the raw buckets counted by either backend into the
+// facets of a SearchResult. Empty buckets and values outside every range
+// are left out.
+func facetResults(raw map[string][]rawFacetBucket) (map[string][]FacetBucket, error) {
+	results := map[string][]FacetBucket{}
+	for _, f := range searchFacets {
+		buckets := []FacetBucket{}
+
+		if f.boundaries != nil {
+			counts := map[string]int64{}
+			for _, r := range raw[f.name] {
+				if key, ok := numberKey(r.ID); ok {
+					counts[key] += r.Count
+				}
+			}
+			for i := 0; i < len(f.boundaries)-1; i++ {
+				count := counts[numberKeyOf(f.boundaries[i])]
+				if count == 0 {
+					continue
+				}
+				lower, _ := primitive.ParseDecimal128(f.boundaries[i])
+				upper, _ := primitive.ParseDecimal128(f.boundaries[i+1])
+				buckets = append(buckets, FacetBucket{Value: lower, Max: upper, Count: count})
+			}
+			results[f.name] = buckets
+			continue
+		}
+
+		for _, r := range raw[f.name] {
+			if r.Count == 0 {
+				continue
+			}
+			// Atlas counts years outside its ranges in a default bucket.
+			if f.numeric && r.ID.Type == bsontype.String {
+				continue
+			}
+			var value interface{}
+			if err := r.ID.Unmarshal(&value); err != nil {
+				return nil, fmt.Errorf("facet %s: %w", f.name, err)
+			}
+			buckets = append(buckets, FacetBucket{Value: value, Count: r.Count})
+		}
+		sort.SliceStable(buckets, func(i, j int) bool {
+			if buckets[i].Count != buckets[j].Count {
+				return buckets[i].Count > buckets[j].Count
+			}
+			return fmt.Sprint(buckets[i].Value) < fmt.Sprint(buckets[j].Value)
+		})
+		if len(buckets) > maxFacetValues {
+			buckets = buckets[:maxFacetValues]
+		}
+		results[f.name] = buckets
+	}
+	return results, nil
+}
+
+// numberKey returns a canonical decimal string for a numeric bucket id, so
+// that ids counted as Decimal128 by $bucket and as doubles by Atlas can be
+// matched against the same boundaries.
+func numberKey(raw bson.RawValue) (string, bool) {
+	switch raw.Type {
+	case bsontype.Decimal128:
+		return numberKeyOf(raw.Decimal128().String()), true
+	case bsontype.Double:
+		return numberKeyOf(strconv.FormatFloat(raw.Double(), 'g', -1, 64)), true
+	case bsontype.Int32:
+		return numberKeyOf(strconv.FormatInt(int64(raw.Int32()), 10)), true
+	case bsontype.Int64:
+		return numberKeyOf(strconv.FormatInt(raw.Int64(), 10)), true
+	}
+	return "", false
+}
+
+func numberKeyOf(s string) string {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return s
+	}
+	return r.RatString()
+}
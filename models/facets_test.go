@@ -0,0 +1,88 @@
+package models
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func rawValue(t *testing.T, v interface{}) bson.RawValue {
+	t.Helper()
+	typ, data, err := bson.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.RawValue{Type: typ, Value: data}
+}
+
+func TestFacetResults(t *testing.T) {
+	ten, _ := primitive.ParseDecimal128("10")
+
+	// The text backend counts price ranges with $bucket, keyed by
+	// Decimal128; Atlas keys them by double. Both land in the same bucket.
+	for _, lower := range []interface{}{ten, 10.0} {
+		raw := map[string][]rawFacetBucket{
+			"category": {
+				{ID: rawValue(t, "Tech"), Count: 2},
+				{ID: rawValue(t, "Art"), Count: 5},
+			},
+			"price": {
+				{ID: rawValue(t, lower), Count: 3},
+				{ID: rawValue(t, "other"), Count: 1},
+			},
+			"publicationYear": {
+				{ID: rawValue(t, 2020), Count: 4},
+				{ID: rawValue(t, 2021), Count: 0},
+				{ID: rawValue(t, "other"), Count: 7},
+			},
+		}
+
+		facets, err := facetResults(raw)
+		if err != nil {
+			t.Fatalf("facetResults() error = %v", err)
+		}
+
+		categories := facets["category"]
+		if len(categories) != 2 || categories[0].Value != "Art" || categories[0].Count != 5 {
+			t.Errorf("category = %+v, want Art first", categories)
+		}
+		prices := facets["price"]
+		if len(prices) != 1 || prices[0].Count != 3 || prices[0].Value.(primitive.Decimal128).String() != "10" || prices[0].Max.(primitive.Decimal128).String() != "20" {
+			t.Errorf("price with %T bucket ids = %+v, want one bucket [10, 20)", lower, prices)
+		}
+		years := facets["publicationYear"]
+		if len(years) != 1 || years[0].Count != 4 {
+			t.Errorf("publicationYear = %+v, want only 2020", years)
+		}
+		if len(facets["publisher"]) != 0 {
+			t.Errorf("publisher = %+v, want no buckets", facets["publisher"])
+		}
+	}
+}
+
+func TestAtlasFilter(t *testing.T) {
+	five, _ := primitive.ParseDecimal128("5")
+	filter := bson.D{
+		{Key: "category", Value: bson.D{{Key: "$eq", Value: "News"}}},
+		{Key: "price", Value: bson.D{{Key: "$gte", Value: five}}},
+		{Key: "publisher", Value: bson.D{{Key: "$ne", Value: "Condé"}}},
+	}
+
+	must, mustNot, err := atlasFilter(filter)
+	if err != nil {
+		t.Fatalf("atlasFilter() error = %v", err)
+	}
+	if len(must) != 2 || len(mustNot) != 1 {
+		t.Fatalf("must = %v, mustNot = %v", must, mustNot)
+	}
+	rangeClause := must[1].(bson.D)[0].Value.(bson.D)
+	if gte := rangeClause[1]; gte.Key != "gte" || gte.Value != 5.0 {
+		t.Errorf("range = %v, want gte 5 as a double", rangeClause)
+	}
+
+	prefix := bson.D{{Key: "title", Value: bson.D{{Key: "$regex", Value: primitive.Regex{Pattern: "^W"}}}}}
+	if _, _, err := atlasFilter(prefix); err == nil {
+		t.Error("atlasFilter() accepted a prefix filter")
+	}
+}
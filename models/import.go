@@ -0,0 +1,664 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ImportBatchSize is the number of rows written per BulkWrite.
+const ImportBatchSize = 500
+
+// Outcomes of importing a row.
+const (
+	ImportCreated  = "created"
+	ImportUpdated  = "updated"
+	ImportRejected = "rejected"
+)
+
+// ImportRow is one parsed row of an import file. Err is set when the row
+// could not be parsed; such rows are reported as rejected.
+type ImportRow struct {
+	Line     int
+	Magazine Magazine
+	Err      error
+}
+
+// ImportResult reports what happened to one row of an import.
+type ImportResult struct {
+	Line   int          `json:"line"`
+	Status string       `json:"status"`
+	ID     string       `json:"id,omitempty"`
+	Reason string       `json:"reason,omitempty"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// ImportReport is the outcome of a whole import.
+type ImportReport struct {
+	DryRun   bool           `json:"dryRun"`
+	Created  int            `json:"created"`
+	Updated  int            `json:"updated"`
+	Rejected int            `json:"rejected"`
+	Results  []ImportResult `json:"results"`
+}
+
+// RowReader reads the rows of an import file one at a time. Next returns
+// io.EOF after the last row.
+type RowReader interface {
+	Next() (ImportRow, error)
+}
+
+// ImportMagazines reads every row from rows, validates it and upserts the
+// valid ones in batches. A row with an id updates the magazine with that id,
+// any other row updates the live magazine with the same title or creates a
+// new one. With dryRun set, nothing is written and the report shows what
+// would have happened.
+func (ms *magazineService) ImportMagazines(rows RowReader, dryRun bool) (*ImportReport, error) {
+	report := &ImportReport{DryRun: dryRun, Results: []ImportResult{}}
+	batch := make([]ImportRow, 0, ImportBatchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results, err := ms.importBatch(batch, dryRun)
+		if err != nil {
+			return err
+		}
+		report.add(results...)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if row.Err == nil {
+			row.Err = Validate(row.Magazine)
+		}
+		if row.Err != nil {
+			result := ImportResult{Line: row.Line, Status: ImportRejected, Reason: row.Err.Error()}
+			var invalid *ValidationError
+			if errors.As(row.Err, &invalid) {
+				result.Fields = invalid.Fields
+			}
+			report.add(result)
+			continue
+		}
+
+		batch = append(batch, row)
+		if len(batch) == ImportBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if !dryRun && report.Created+report.Updated > 0 {
+		// Imported rows may rename any number of magazines, so recount the
+		// title terms instead of tracking each one.
+		ms.terms.reset()
+	}
+	return report, nil
+}
+
+func (r *ImportReport) add(results ...ImportResult) {
+	for _, result := range results {
+		switch result.Status {
+		case ImportCreated:
+			r.Created++
+		case ImportUpdated:
+			r.Updated++
+		case ImportRejected:
+			r.Rejected++
+		}
+		r.Results = append(r.Results, result)
+	}
+}
+
+// importBatch upserts one batch of valid rows with a single unordered
+// BulkWrite and reports the outcome of each row.
+func (mM *mongoMagazine) importBatch(rows []ImportRow, dryRun bool) ([]ImportResult, error) {
+	targets, err := mM.importTargets(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return dryRunImport(rows, targets), nil
+	}
+
+	if err := mM.ensureIndexes(); err != nil {
+		return nil, err
+	}
+
+	batchSlugs := map[string]bool{}
+	rejected := trashedRows(rows, targets)
+
+	writes := make([]mongo.WriteModel, 0, len(rows))
+	for i, row := range rows {
+		if _, ok := rejected[i]; ok {
+			// Never tried, but keeps the writes lined up with the rows.
+			writes = append(writes, nil)
+			continue
+		}
+		update, err := importUpdate(row, mM.now(), targets, batchSlugs, mM.uniqueSlug)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(importFilter(row.Magazine)).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+
+	upserted, err := mM.writeImport(rows, targets, writes, rejected)
+	if err != nil {
+		return nil, err
+	}
+
+	return importResults(rows, targets, upserted, rejected), nil
+}
+
+// importUpdate builds the upsert of one import row, written at updatedAt.
+// New magazines get a slug picked with uniqueSlug that no earlier new row of
+// the batch, listed in batchSlugs, has taken.
+func importUpdate(row ImportRow, updatedAt time.Time, targets map[string]Magazine, batchSlugs map[string]bool, uniqueSlug func(title string, id primitive.ObjectID) (string, error)) (bson.D, error) {
+	set := bson.D{
+		{Key: "title", Value: row.Magazine.Title},
+		{Key: "price", Value: row.Magazine.Price},
+		{Key: "updatedAt", Value: updatedAt},
+	}
+	set = append(set, optionalFields(row.Magazine)...)
+	update := bson.D{}
+
+	current, exists := targets[importKey(row.Magazine)]
+	switch {
+	case !exists:
+		slug, err := uniqueSlug(row.Magazine.Title, row.Magazine.ID)
+		if err != nil {
+			return nil, err
+		}
+		// Two new rows in one batch may slugify the same way.
+		base := slug
+		for n := 2; batchSlugs[slug]; n++ {
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		batchSlugs[slug] = true
+		update = append(update, bson.E{Key: "$setOnInsert", Value: bson.D{{Key: "slug", Value: slug}}})
+	case current.Title != row.Magazine.Title:
+		renamed := Magazine{ID: current.ID, Title: row.Magazine.Title}
+		if err := renameSlug(&renamed, &current, uniqueSlug); err != nil {
+			return nil, err
+		}
+		set = append(set,
+			bson.E{Key: "slug", Value: renamed.Slug},
+			bson.E{Key: "previousSlugs", Value: renamed.PreviousSlugs})
+	}
+
+	return append(update,
+		bson.E{Key: "$set", Value: set},
+		bson.E{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}}), nil
+}
+
+// importResults reports the outcome of each row of a batch that was
+// written. rejected maps the index of every row that failed to the reason,
+// and upserted maps the index of every created row to its id.
+func importResults(rows []ImportRow, targets map[string]Magazine, upserted map[int]primitive.ObjectID, rejected map[int]string) []ImportResult {
+	results := make([]ImportResult, 0, len(rows))
+	for i, row := range rows {
+		result := ImportResult{Line: row.Line, Status: ImportUpdated}
+		if current, ok := targets[importKey(row.Magazine)]; ok {
+			result.ID = current.ID.Hex()
+		}
+
+		if reason, ok := rejected[i]; ok {
+			result.Status = ImportRejected
+			result.Reason = reason
+		} else if id, ok := upserted[i]; ok {
+			result.Status = ImportCreated
+			result.ID = id.Hex()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// writeImport runs the writes of an import batch with one unordered
+// BulkWrite, in a transaction together with the events of the magazines
+// they write. Rows already in rejected are left out. A row Mongo rejects
+// aborts the transaction, so the batch is then tried again without it, and
+// the reason is added to rejected. upserted maps the index of every created
+// row to its id.
+func (mM *mongoMagazine) writeImport(rows []ImportRow, targets map[string]Magazine, writes []mongo.WriteModel, rejected map[int]string) (map[int]primitive.ObjectID, error) {
+	db := mM.collection("magazines")
+	opts := options.BulkWrite().SetOrdered(false)
+
+	for {
+		// indexes maps the writes that are tried to the rows of the batch.
+		indexes := []int{}
+		tried := []mongo.WriteModel{}
+		for i, write := range writes {
+			if _, ok := rejected[i]; !ok {
+				indexes = append(indexes, i)
+				tried = append(tried, write)
+			}
+		}
+		if len(tried) == 0 {
+			return map[int]primitive.ObjectID{}, nil
+		}
+
+		var upserted map[int]primitive.ObjectID
+		var failed map[int]string
+		var aborted bool
+		err := mM.transact(func(ctx context.Context) error {
+			upserted, failed, aborted = map[int]primitive.ObjectID{}, map[int]string{}, false
+
+			res, err := db.BulkWrite(ctx, tried, opts)
+			var bulkErr mongo.BulkWriteException
+			if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+				for _, writeErr := range bulkErr.WriteErrors {
+					failed[indexes[writeErr.Index]] = writeErr.Message
+				}
+				if mongo.SessionFromContext(ctx) != nil {
+					aborted = true
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+
+			for i, id := range res.UpsertedIDs {
+				if oid, ok := id.(primitive.ObjectID); ok {
+					upserted[indexes[i]] = oid
+				}
+			}
+			return mM.recordImportEvents(ctx, rows, targets, indexes, upserted, failed)
+		})
+		for i, reason := range failed {
+			rejected[i] = reason
+		}
+		if aborted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return upserted, nil
+	}
+}
+
+// recordImportEvents records the events of the rows of an import batch that
+// were written, in the order of the rows.
+func (mM *mongoMagazine) recordImportEvents(ctx context.Context, rows []ImportRow, targets map[string]Magazine, indexes []int, upserted map[int]primitive.ObjectID, failed map[int]string) error {
+	ids := bson.A{}
+	written := []primitive.ObjectID{}
+	for _, i := range indexes {
+		if _, ok := failed[i]; ok {
+			continue
+		}
+		id, ok := upserted[i]
+		if !ok {
+			id = targets[importKey(rows[i].Magazine)].ID
+		}
+		ids = append(ids, id)
+		written = append(written, id)
+	}
+	if len(written) == 0 {
+		return nil
+	}
+
+	db := mM.collection("magazines")
+	cursor, err := db.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return err
+	}
+	magazines := []Magazine{}
+	if err := cursor.All(ctx, &magazines); err != nil {
+		return err
+	}
+	byID := map[primitive.ObjectID]*Magazine{}
+	for i := range magazines {
+		byID[magazines[i].ID] = &magazines[i]
+	}
+
+	created := map[primitive.ObjectID]bool{}
+	for _, id := range upserted {
+		created[id] = true
+	}
+	for _, id := range written {
+		magazine, ok := byID[id]
+		if !ok {
+			continue
+		}
+		eventType := EventMagazineUpdated
+		if created[id] {
+			eventType = EventMagazineCreated
+		}
+		if err := mM.recordEvent(ctx, eventType, magazine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importTargets looks up the magazines the rows of a batch would update,
+// keyed by importKey. Magazines in the trash are only looked up by id, so
+// that rows with their id can be rejected.
+func (mM *mongoMagazine) importTargets(rows []ImportRow) (map[string]Magazine, error) {
+	db := mM.collection("magazines")
+
+	cursor, err := db.Find(context.Background(), importTargetsFilter(rows))
+	if err != nil {
+		return nil, err
+	}
+	existing := []Magazine{}
+	if err := cursor.All(context.Background(), &existing); err != nil {
+		return nil, err
+	}
+
+	return importTargetsByKey(existing), nil
+}
+
+// importTargetsFilter matches the magazines the rows of a batch refer to by
+// id, and the live magazines they refer to by title.
+func importTargetsFilter(rows []ImportRow) bson.D {
+	ids := bson.A{}
+	titles := bson.A{}
+	for _, row := range rows {
+		if row.Magazine.ID.IsZero() {
+			titles = append(titles, row.Magazine.Title)
+		} else {
+			ids = append(ids, row.Magazine.ID)
+		}
+	}
+
+	return bson.D{
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+			bson.D{
+				{Key: "title", Value: bson.D{{Key: "$in", Value: titles}}},
+				{Key: "deletedAt", Value: nil},
+			},
+		}},
+	}
+}
+
+// importTargetsByKey keys the existing magazines by importKey. Of several
+// live magazines with the same title, the first one is updated.
+func importTargetsByKey(existing []Magazine) map[string]Magazine {
+	targets := map[string]Magazine{}
+	for _, magazine := range existing {
+		targets["id:"+magazine.ID.Hex()] = magazine
+		if _, ok := targets["title:"+magazine.Title]; !ok && magazine.DeletedAt == nil {
+			targets["title:"+magazine.Title] = magazine
+		}
+	}
+	return targets
+}
+
+// trashedReason is why a row with the id of a magazine in the trash is
+// rejected. It has to be restored before it can be imported again.
+const trashedReason = "the magazine with this id is in the trash"
+
+// trashedRows maps the index of every row whose id belongs to a magazine in
+// the trash to trashedReason.
+func trashedRows(rows []ImportRow, targets map[string]Magazine) map[int]string {
+	rejected := map[int]string{}
+	for i, row := range rows {
+		if current, ok := targets[importKey(row.Magazine)]; ok && current.DeletedAt != nil {
+			rejected[i] = trashedReason
+		}
+	}
+	return rejected
+}
+
+// importKey identifies the magazine an import row refers to: by id when it
+// has one, by title otherwise.
+func importKey(magazine Magazine) string {
+	if !magazine.ID.IsZero() {
+		return "id:" + magazine.ID.Hex()
+	}
+	return "title:" + magazine.Title
+}
+
+// dryRunImport works out whether each row would create or update a
+// magazine without writing anything.
+func dryRunImport(rows []ImportRow, targets map[string]Magazine) []ImportResult {
+	seen := map[string]bool{}
+	for key, current := range targets {
+		seen[key] = current.DeletedAt == nil
+	}
+	rejected := trashedRows(rows, targets)
+
+	results := make([]ImportResult, 0, len(rows))
+	for i, row := range rows {
+		key := importKey(row.Magazine)
+		result := ImportResult{Line: row.Line, Status: ImportCreated}
+		if current, ok := targets[key]; ok {
+			result.ID = current.ID.Hex()
+		} else if !row.Magazine.ID.IsZero() {
+			result.ID = row.Magazine.ID.Hex()
+		}
+		if reason, ok := rejected[i]; ok {
+			result.Status = ImportRejected
+			result.Reason = reason
+			results = append(results, result)
+			continue
+		}
+		if seen[key] {
+			result.Status = ImportUpdated
+		}
+		// A later row with the same key updates what this row creates.
+		seen[key] = true
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// optionalFields returns the optional fields an import row fills in. Empty
+// columns leave the stored values alone.
+func optionalFields(magazine Magazine) bson.D {
+	fields := bson.D{}
+	if magazine.Category != "" {
+		fields = append(fields, bson.E{Key: "category", Value: magazine.Category})
+	}
+	if magazine.Publisher != "" {
+		fields = append(fields, bson.E{Key: "publisher", Value: magazine.Publisher})
+	}
+	if magazine.PublicationYear != 0 {
+		fields = append(fields, bson.E{Key: "publicationYear", Value: magazine.PublicationYear})
+	}
+	return fields
+}
+
+// importFilter matches the live magazine an import row should update.
+func importFilter(magazine Magazine) bson.D {
+	if !magazine.ID.IsZero() {
+		return bson.D{{Key: "_id", Value: magazine.ID}, {Key: "deletedAt", Value: nil}}
+	}
+	return bson.D{{Key: "title", Value: magazine.Title}, {Key: "deletedAt", Value: nil}}
+}
+
+// importRecord is the shape of one NDJSON import line.
+type importRecord struct {
+	ID              primitive.ObjectID   `json:"id"`
+	Title           string               `json:"title"`
+	Price           primitive.Decimal128 `json:"price"`
+	Category        string               `json:"category"`
+	Publisher       string               `json:"publisher"`
+	PublicationYear int                  `json:"publicationYear"`
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewNDJSONReader reads import rows from newline-delimited JSON, one
+// magazine object per line. Blank lines are skipped.
+func NewNDJSONReader(r io.Reader) RowReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (n *ndjsonReader) Next() (ImportRow, error) {
+	for n.scanner.Scan() {
+		n.line++
+		line := bytes.TrimSpace(n.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var record importRecord
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&record); err != nil {
+			return ImportRow{Line: n.line, Err: err}, nil
+		}
+
+		magazine := Magazine{
+			ID:              record.ID,
+			Title:           record.Title,
+			Price:           record.Price,
+			Category:        record.Category,
+			Publisher:       record.Publisher,
+			PublicationYear: record.PublicationYear,
+		}
+		return ImportRow{Line: n.line, Magazine: magazine}, nil
+	}
+
+	if err := n.scanner.Err(); err != nil {
+		return ImportRow{}, err
+	}
+	return ImportRow{}, io.EOF
+}
+
+// csvColumns maps the lower-case names of the CSV columns, which are
+// matched regardless of case, to their canonical names.
+var csvColumns = map[string]string{
+	"id":              "id",
+	"title":           "title",
+	"price":           "price",
+	"category":        "category",
+	"publisher":       "publisher",
+	"publicationyear": "publicationYear",
+}
+
+type csvReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	fields  int
+}
+
+// NewCSVReader reads import rows from CSV. The first record is a header
+// naming the columns; title and price are required, while id, category,
+// publisher and publicationYear are optional.
+func NewCSVReader(r io.Reader) (RowReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		column, ok := csvColumns[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		if _, ok := columns[column]; ok {
+			return nil, fmt.Errorf("CSV column %q is listed more than once", column)
+		}
+		columns[column] = i
+	}
+	for _, required := range []string{"title", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header is missing the %q column", required)
+		}
+	}
+
+	return &csvReader{reader: reader, columns: columns, fields: len(header)}, nil
+}
+
+func (c *csvReader) Next() (ImportRow, error) {
+	record, err := c.reader.Read()
+	if err == io.EOF {
+		return ImportRow{}, io.EOF
+	}
+
+	// A record that fails to parse is a rejected row rather than the end of
+	// the import. Its position is only known from the error, as FieldPos
+	// only describes records that were read.
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return ImportRow{Line: parseErr.StartLine, Err: parseErr.Err}, nil
+	}
+	if err != nil {
+		return ImportRow{}, err
+	}
+	line, _ := c.reader.FieldPos(0)
+	if len(record) != c.fields {
+		return ImportRow{Line: line, Err: fmt.Errorf("expected %d fields, got %d", c.fields, len(record))}, nil
+	}
+
+	row := ImportRow{Line: line}
+	row.Magazine.Title = record[c.columns["title"]]
+
+	row.Magazine.Price, err = primitive.ParseDecimal128(strings.TrimSpace(record[c.columns["price"]]))
+	if err != nil {
+		row.Err = fmt.Errorf("price %q is not a decimal number", record[c.columns["price"]])
+		return row, nil
+	}
+
+	if i, ok := c.columns["category"]; ok {
+		row.Magazine.Category = record[i]
+	}
+	if i, ok := c.columns["publisher"]; ok {
+		row.Magazine.Publisher = record[i]
+	}
+	if i, ok := c.columns["publicationYear"]; ok && strings.TrimSpace(record[i]) != "" {
+		row.Magazine.PublicationYear, err = strconv.Atoi(strings.TrimSpace(record[i]))
+		if err != nil {
+			row.Err = fmt.Errorf("publicationYear %q is not a whole number", record[i])
+			return row, nil
+		}
+	}
+
+	if i, ok := c.columns["id"]; ok && record[i] != "" {
+		row.Magazine.ID, err = primitive.ObjectIDFromHex(record[i])
+		if err != nil {
+			row.Err = fmt.Errorf("id %q is not a valid id", record[i])
+		}
+	}
+
+	return row, nil
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func readAll(t *testing.T, rows RowReader) []ImportRow {
+	t.Helper()
+
+	var all []ImportRow
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			return all
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		all = append(all, row)
+	}
+}
+
+func TestNDJSONReader(t *testing.T) {
+	input := `{"title": "Wired", "price": "5.99"}
+
+{"title": "Vogue", "price": "cheap"}
+{"title": "Time", "price": "4.50", "editor": "Time USA"}
+{"id": "5f0c7d1e2a4b3c0012345678", "title": "Der Spiegel", "price": "6"}
+`
+	rows := readAll(t, NewNDJSONReader(strings.NewReader(input)))
+
+	if len(rows) != 4 {
+		t.Fatalf("got %d rows, want 4", len(rows))
+	}
+	wantLines := []int{1, 3, 4, 5}
+	wantErr := []bool{false, true, true, false}
+	for i, row := range rows {
+		if row.Line != wantLines[i] {
+			t.Errorf("row %d: Line = %d, want %d", i, row.Line, wantLines[i])
+		}
+		if (row.Err != nil) != wantErr[i] {
+			t.Errorf("row %d: Err = %v, wantErr %v", i, row.Err, wantErr[i])
+		}
+	}
+	if rows[3].Magazine.ID.Hex() != "5f0c7d1e2a4b3c0012345678" {
+		t.Errorf("ID = %s, want 5f0c7d1e2a4b3c0012345678", rows[3].Magazine.ID.Hex())
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	input := "title,price\n\"Wired, UK\",5.99\nVogue,cheap\nTime\n"
+	reader, err := NewCSVReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("NewCSVReader() error = %v", err)
+	}
+	rows := readAll(t, reader)
+
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, want 3", len(rows))
+	}
+	if rows[0].Err != nil || rows[0].Magazine.Title != "Wired, UK" || rows[0].Magazine.Price.String() != "5.99" {
+		t.Errorf("row 0 = %+v, want Wired, UK at 5.99", rows[0])
+	}
+	if rows[1].Err == nil || rows[1].Line != 3 {
+		t.Errorf("row 1 = %+v, want a price error on line 3", rows[1])
+	}
+	if rows[2].Err == nil || rows[2].Line != 4 {
+		t.Errorf("row 2 = %+v, want a field count error on line 4", rows[2])
+	}
+}
+
+func TestCSVReaderOptionalColumns(t *testing.T) {
+	input := "Title,Price,Category,publicationYear\nWired,5.99,Tech,1993\nVogue,4.50,Fashion,\n"
+	reader, err := NewCSVReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("NewCSVReader() error = %v", err)
+	}
+	rows := readAll(t, reader)
+
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if rows[0].Err != nil || rows[0].Magazine.Category != "Tech" || rows[0].Magazine.PublicationYear != 1993 {
+		t.Errorf("row 0 = %+v, want Tech from 1993", rows[0])
+	}
+	if rows[1].Err != nil || rows[1].Magazine.PublicationYear != 0 {
+		t.Errorf("row 1 = %+v, want no publication year", rows[1])
+	}
+}
+
+func TestCSVReaderMalformedRow(t *testing.T) {
+	input := "title,price\n\"bad\"x,5\nVogue,4.50\n"
+	reader, err := NewCSVReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("NewCSVReader() error = %v", err)
+	}
+	rows := readAll(t, reader)
+
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if rows[0].Err == nil || rows[0].Line != 2 {
+		t.Errorf("row 0 = %+v, want a parse error on line 2", rows[0])
+	}
+	if rows[1].Err != nil || rows[1].Line != 3 || rows[1].Magazine.Title != "Vogue" {
+		t.Errorf("row 1 = %+v, want Vogue on line 3", rows[1])
+	}
+}
+
+func TestCSVReaderRejectsHeader(t *testing.T) {
+	for _, header := range []string{"title\n", "title,price,editor\n", "title,price,title\n", ""} {
+		if _, err := NewCSVReader(strings.NewReader(header)); err == nil {
+			t.Errorf("NewCSVReader(%q) succeeded, want error", header)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MagazineCache is a MagazineDB that answers FindById, FindBySlug and
+// FindAll from a Cache. Writes made through it invalidate the entries they
+// affect; WatchChanges does the same for writes made by other instances.
+type MagazineCache interface {
+	MagazineDB
+	Stats() CacheStats
+	// WatchChanges invalidates the entries of every magazine changed in the
+	// database until ctx is done. A feed that fails is reopened after
+	// retry. It returns when the database cannot stream changes, after
+	// which other instances' writes are only picked up once entries expire.
+	WatchChanges(ctx context.Context, retry time.Duration)
+}
+
+// NewMagazineCache puts cache in front of the reads of db.
+func NewMagazineCache(db MagazineDB, cache Cache) MagazineCache {
+	return &cachedMagazine{MagazineDB: db, cache: cache}
+}
+
+var _ MagazineCache = &cachedMagazine{}
+
+// cachedMagazine keeps magazines by id, the ids of slugs and whole listing
+// pages. Pages cannot be told apart by the magazines on them, so every write
+// starts a new generation of page keys instead; the pages of older
+// generations are never read again and age out of the cache.
+type cachedMagazine struct {
+	environment
+	MagazineDB
+	cache Cache
+	// generation goes up on every invalidation. Reads only store what they
+	// read if it has not moved in the meantime, so a read that raced a write
+	// cannot put the magazine as it was before the write back in the cache.
+	generation atomic.Uint64
+}
+
+func (c *cachedMagazine) FindById(id string) (*Magazine, error) {
+	key := "magazine:" + id
+	magazine := Magazine{}
+	if c.lookup(key, &magazine) {
+		return &magazine, nil
+	}
+
+	generation := c.generation.Load()
+	found, err := c.MagazineDB.FindById(id)
+	if err != nil {
+		return nil, err
+	}
+	c.store(generation, key, found)
+	return found, nil
+}
+
+// FindBySlug caches the id a slug belongs to and reads the magazine through
+// FindById. Slugs stay with their magazine when it is renamed, so the id
+// only goes stale once the magazine is purged, and then FindById fails and
+// the slug is looked up again.
+func (c *cachedMagazine) FindBySlug(slug string) (*Magazine, error) {
+	key := "slug:" + slug
+	if id, ok := c.cache.Get(key); ok {
+		if magazine, err := c.FindById(string(id)); err == nil {
+			return magazine, nil
+		}
+		c.cache.Delete(key)
+	}
+
+	generation := c.generation.Load()
+	magazine, err := c.MagazineDB.FindBySlug(slug)
+	if err != nil {
+		return nil, err
+	}
+	c.set(generation, key, []byte(magazine.ID.Hex()))
+	return magazine, nil
+}
+
+func (c *cachedMagazine) FindAll(opts ListOptions) (*MagazinePage, error) {
+	generation := c.generation.Load()
+	selection, err := bson.MarshalExtJSON(bson.D{
+		{Key: "filter", Value: opts.Filter},
+		{Key: "sort", Value: opts.Sort},
+		{Key: "limit", Value: opts.Limit},
+		{Key: "cursor", Value: opts.Cursor},
+		{Key: "trashed", Value: opts.Trashed},
+	}, true, false)
+	if err != nil {
+		return c.MagazineDB.FindAll(opts)
+	}
+	key := fmt.Sprintf("magazines:%d:%s", generation, selection)
+
+	page := MagazinePage{}
+	if c.lookup(key, &page) {
+		return &page, nil
+	}
+
+	found, err := c.MagazineDB.FindAll(opts)
+	if err != nil {
+		return nil, err
+	}
+	c.store(generation, key, found)
+	return found, nil
+}
+
+func (c *cachedMagazine) Create(magazine Magazine) (*Magazine, error) {
+	created, err := c.MagazineDB.Create(magazine)
+	// A new magazine is not cached by id yet, but it may belong on cached
+	// pages.
+	c.generation.Add(1)
+	return created, err
+}
+
+func (c *cachedMagazine) UpdateById(magazine Magazine) (*Magazine, error) {
+	_, updated, err := c.replace(magazine)
+	return updated, err
+}
+
+func (c *cachedMagazine) Patch(id string, patch MagazinePatch) (*Magazine, error) {
+	_, patched, err := c.patch(id, patch)
+	return patched, err
+}
+
+var _ magazineStore = &cachedMagazine{}
+
+// replace and patch go to the database without the cache, so the previous
+// title they report is never stale.
+func (c *cachedMagazine) replace(magazine Magazine) (string, *Magazine, error) {
+	previousTitle, updated, err := replaceMagazine(c.MagazineDB, magazine)
+	c.invalidate(magazine.ID.Hex())
+	return previousTitle, updated, err
+}
+
+func (c *cachedMagazine) patch(id string, patch MagazinePatch) (string, *Magazine, error) {
+	previousTitle, patched, err := patchMagazine(c.MagazineDB, id, patch)
+	c.invalidate(id)
+	return previousTitle, patched, err
+}
+
+func (c *cachedMagazine) Delete(id string, version int64) (*Magazine, error) {
+	deleted, err := c.MagazineDB.Delete(id, version)
+	c.invalidate(id)
+	return deleted, err
+}
+
+func (c *cachedMagazine) Restore(id string) (*Magazine, error) {
+	restored, err := c.MagazineDB.Restore(id)
+	c.invalidate(id)
+	return restored, err
+}
+
+// Purge only removes magazines from the trash, which are never cached by
+// id, but they may be on a cached trash listing.
+func (c *cachedMagazine) Purge(deletedBefore time.Time) (int64, error) {
+	purged, err := c.MagazineDB.Purge(deletedBefore)
+	if purged > 0 {
+		c.generation.Add(1)
+	}
+	return purged, err
+}
+
+func (c *cachedMagazine) importBatch(rows []ImportRow, dryRun bool) ([]ImportResult, error) {
+	results, err := c.MagazineDB.importBatch(rows, dryRun)
+	if dryRun {
+		return results, err
+	}
+	for _, result := range results {
+		if result.Status != ImportRejected {
+			c.cache.Delete("magazine:" + result.ID)
+		}
+	}
+	c.generation.Add(1)
+	return results, err
+}
+
+func (c *cachedMagazine) Stats() CacheStats {
+	return c.cache.Stats()
+}
+
+func (c *cachedMagazine) WatchChanges(ctx context.Context, retry time.Duration) {
+	resumeAfter := ""
+	for {
+		err := c.followChanges(ctx, &resumeAfter)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrChangesUnavailable) {
+			c.logf("magazine cache is not invalidated by other instances: %v", err)
+			return
+		}
+		c.logf("following magazine changes for the cache failed: %v", err)
+		if errors.Is(err, ErrChangeHistoryLost) {
+			resumeAfter = ""
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// followChanges invalidates the magazines of a change feed until the feed
+// fails, keeping its position in resumeAfter. A feed that cannot resume may
+// have missed changes, so the whole cache is cleared once it is open.
+func (c *cachedMagazine) followChanges(ctx context.Context, resumeAfter *string) error {
+	feed, err := c.MagazineDB.Changes(ctx, ChangeOptions{ResumeAfter: *resumeAfter, Wait: changeWait})
+	if err != nil {
+		return err
+	}
+	defer feed.Close()
+
+	if *resumeAfter == "" {
+		c.cache.Clear()
+		c.generation.Add(1)
+	}
+	for {
+		change, err := feed.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if change != nil {
+			c.invalidate(change.MagazineID.Hex())
+		}
+		*resumeAfter = feed.ResumeToken()
+	}
+}
+
+// changeWait is how long followChanges waits for a change before it records
+// the position of its feed.
+const changeWait = 10 * time.Second
+
+// invalidate drops the cached magazine with the given id and every cached
+// page. Slugs are left alone, as they keep pointing at the same magazine.
+func (c *cachedMagazine) invalidate(id string) {
+	c.generation.Add(1)
+	c.cache.Delete("magazine:" + id)
+}
+
+// lookup decodes the value cached under key into v. Values are cached
+// encoded, so callers are free to modify what they get.
+func (c *cachedMagazine) lookup(key string, v any) bool {
+	data, ok := c.cache.Get(key)
+	return ok && bson.Unmarshal(data, v) == nil
+}
+
+// store caches v under key unless the cache has been invalidated since
+// generation.
+func (c *cachedMagazine) store(generation uint64, key string, v any) {
+	if data, err := bson.Marshal(v); err == nil {
+		c.set(generation, key, data)
+	}
+}
+
+// set caches data under key unless the cache has been invalidated since
+// generation. An invalidation may land between the check and the Set, so
+// the generation is checked again afterwards and the entry evicted if it
+// moved. Invalidations move the generation before they delete, so one that
+// comes later still deletes the entry itself.
+func (c *cachedMagazine) set(generation uint64, key string, data []byte) {
+	if c.generation.Load() != generation {
+		return
+	}
+	c.cache.Set(key, data)
+	if c.generation.Load() != generation {
+		c.cache.Delete(key)
+	}
+}
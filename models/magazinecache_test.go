@@ -0,0 +1,129 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// countingMagazineDB serves one magazine and counts the reads that reach
+// it.
+type countingMagazineDB struct {
+	MagazineDB
+	magazine Magazine
+	reads    int
+}
+
+func (db *countingMagazineDB) FindById(id string) (*Magazine, error) {
+	db.reads++
+	magazine := db.magazine
+	return &magazine, nil
+}
+
+func (db *countingMagazineDB) FindAll(opts ListOptions) (*MagazinePage, error) {
+	db.reads++
+	return &MagazinePage{Magazines: []Magazine{db.magazine}}, nil
+}
+
+func (db *countingMagazineDB) UpdateById(magazine Magazine) (*Magazine, error) {
+	db.magazine = magazine
+	return &magazine, nil
+}
+
+func TestMagazineCache(t *testing.T) {
+	id := primitive.NewObjectID()
+	db := &countingMagazineDB{magazine: Magazine{ID: id, Title: "Wired", Slug: "wired", Version: 1}}
+	mc := NewMagazineCache(db, NewLRUCache(10, time.Minute))
+
+	first, _ := mc.FindById(id.Hex())
+	first.Title = "changed by the caller"
+	second, _ := mc.FindById(id.Hex())
+	if db.reads != 1 || second.Title != "Wired" {
+		t.Errorf("second read: %d reads, title %q", db.reads, second.Title)
+	}
+	mc.FindAll(ListOptions{Limit: 10})
+	mc.FindAll(ListOptions{Limit: 10})
+	if db.reads != 2 {
+		t.Errorf("%d reads after listing twice, want 2", db.reads)
+	}
+
+	mc.UpdateById(Magazine{ID: id, Title: "Wired UK", Slug: "wired-uk"})
+	magazine, _ := mc.FindById(id.Hex())
+	page, _ := mc.FindAll(ListOptions{Limit: 10})
+	if magazine.Title != "Wired UK" || page.Magazines[0].Title != "Wired UK" {
+		t.Errorf("read %q and %q after the update", magazine.Title, page.Magazines[0].Title)
+	}
+
+	want := CacheStats{Hits: 2, Misses: 4, Entries: 3}
+	if got := mc.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+// findCountingStore counts the magazines read by id from a magazineStore.
+type findCountingStore struct {
+	magazineStore
+	finds int
+}
+
+func (s *findCountingStore) FindById(id string) (*Magazine, error) {
+	s.finds++
+	return s.magazineStore.FindById(id)
+}
+
+func TestMagazineServiceUpdateThroughCache(t *testing.T) {
+	db := &findCountingStore{magazineStore: NewMemoryMagazineDB().(magazineStore)}
+	ms := &magazineService{MagazineDB: NewMagazineCache(db, NewLRUCache(10, time.Minute))}
+
+	price, _ := primitive.ParseDecimal128("5.99")
+	created, err := ms.Create(Magazine{Title: "Wired", Price: price})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.FindById(created.ID.Hex())
+	db.finds = 0
+
+	updated, err := ms.UpdateById(Magazine{ID: created.ID, Title: "Wired UK", Price: price, Version: 1})
+	if err != nil {
+		t.Fatalf("UpdateById() error = %v", err)
+	}
+	if db.finds != 0 {
+		t.Errorf("UpdateById() read the magazine %d times before updating it", db.finds)
+	}
+	if updated.Slug != "wired-uk" || !reflect.DeepEqual(updated.PreviousSlugs, []string{"wired"}) {
+		t.Errorf("UpdateById() = slug %q, previous slugs %v", updated.Slug, updated.PreviousSlugs)
+	}
+}
+
+// racingCache runs beforeSet ahead of the first Set, as if it had been
+// scheduled between the generation check and the Set of a read.
+type racingCache struct {
+	Cache
+	beforeSet func()
+}
+
+func (c *racingCache) Set(key string, value []byte) {
+	if before := c.beforeSet; before != nil {
+		c.beforeSet = nil
+		before()
+	}
+	c.Cache.Set(key, value)
+}
+
+func TestMagazineCacheInvalidatedDuringStore(t *testing.T) {
+	id := primitive.NewObjectID()
+	db := &countingMagazineDB{magazine: Magazine{ID: id, Title: "Wired", Slug: "wired", Version: 1}}
+	cache := &racingCache{Cache: NewLRUCache(10, time.Minute)}
+	mc := NewMagazineCache(db, cache)
+	cache.beforeSet = func() {
+		db.magazine.Title = "Wired UK"
+		mc.(*cachedMagazine).invalidate(id.Hex())
+	}
+
+	mc.FindById(id.Hex())
+	if magazine, _ := mc.FindById(id.Hex()); magazine.Title != "Wired UK" {
+		t.Errorf("read %q after an invalidation raced the first read", magazine.Title)
+	}
+}
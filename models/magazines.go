@@ -2,55 +2,304 @@ package models
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"time"
 
+	"github.com/jgsheppa/mongo-go/query"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// ErrVersionConflict is returned by writes whose expected version no
+// longer matches the stored magazine.
+var ErrVersionConflict = errors.New("magazine has been modified since it was read")
+
 type Magazine struct {
 	ID    primitive.ObjectID   `bson:"_id" json:"id,omitempty"`
-	Title string               `bson:"title" json:"title"`
-	Price primitive.Decimal128 `bson:"price" json:"price"`
+	Title string               `bson:"title" json:"title" validate:"required,maxlen=200"`
+	Price primitive.Decimal128 `bson:"price" json:"price" validate:"required,min=0,max=100000"`
+	// Category, Publisher and PublicationYear are optional. Searches offer
+	// them as facets.
+	Category        string `bson:"category,omitempty" json:"category,omitempty" validate:"maxlen=100"`
+	Publisher       string `bson:"publisher,omitempty" json:"publisher,omitempty" validate:"maxlen=100"`
+	PublicationYear int    `bson:"publicationYear,omitempty" json:"publicationYear,omitempty" validate:"omitempty,min=1450,max=9999"`
+	// Slug is derived from the title by the database layer and is unique
+	// across magazines. PreviousSlugs keeps the slugs of earlier titles so
+	// that old links can be redirected.
+	Slug          string   `bson:"slug" json:"slug"`
+	PreviousSlugs []string `bson:"previousSlugs,omitempty" json:"previousSlugs,omitempty"`
+	// Version goes up by one on every write. On writes it holds the version
+	// the caller expects to replace; zero skips the check.
+	Version int64 `bson:"version,omitempty" json:"version"`
+	// UpdatedAt is set by the database layer on every write.
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	// DeletedAt is set while the magazine is in the trash. Trashed magazines
+	// are hidden from every read except the trash listing. Only Delete sets
+	// it; Create and UpdateById ignore the value they are given.
+	DeletedAt *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+}
+
+// MagazineFields lists the fields clients may filter and sort magazine
+// listings by.
+var MagazineFields = query.Schema{
+	"title": {
+		Type:      query.String,
+		Operators: []string{query.Eq, query.Ne, query.In, query.Prefix},
+		Sortable:  true,
+		Groupable: true,
+	},
+	"price": {
+		Type:      query.Decimal,
+		Operators: []string{query.Eq, query.Ne, query.Gt, query.Gte, query.Lt, query.Lte, query.In},
+		Sortable:  true,
+	},
+	"category": {
+		Type:      query.String,
+		Operators: []string{query.Eq, query.Ne, query.In},
+		Sortable:  true,
+		Groupable: true,
+	},
+	"publisher": {
+		Type:      query.String,
+		Operators: []string{query.Eq, query.Ne, query.In},
+		Sortable:  true,
+		Groupable: true,
+	},
+	"publicationYear": {
+		Type:      query.Int,
+		Operators: []string{query.Eq, query.Ne, query.Gt, query.Gte, query.Lt, query.Lte, query.In},
+		Sortable:  true,
+		Groupable: true,
+	},
+}
+
+// ListOptions selects one page of a magazine listing. Filter and Sort are
+// usually built by MagazineFields.Parse; an empty Sort orders by id. An empty
+// Cursor starts from the first page. Trashed lists the magazines in the
+// trash instead of the live ones.
+type ListOptions struct {
+	Filter  bson.D
+	Sort    bson.D
+	Limit   int64
+	Cursor  string
+	Trashed bool
+}
+
+// MagazinePage is one page of a magazine listing. NextCursor is empty on the
+// last page.
+type MagazinePage struct {
+	Magazines  []Magazine `json:"magazines"`
+	NextCursor string     `json:"nextCursor,omitempty"`
 }
 
 type MagazineDB interface {
-	AggregateByPrice(price string) (*[]Magazine, error)
+	// Aggregations
+	PriceStats(opts AggregateOptions) ([]PriceStats, error)
+	PriceHistogram(opts HistogramOptions) ([]PriceHistogram, error)
 	// CRUD operations
-	Create(magazine Magazine) (*mongo.InsertOneResult, error)
+	Create(magazine Magazine) (*Magazine, error)
 	FindById(id string) (*Magazine, error)
 	FindBySlug(slug string) (*Magazine, error)
-	FindAll() (*[]Magazine, error)
-	UpdateById(magazine Magazine) (*mongo.UpdateResult, error)
-	Delete(id string) (*mongo.DeleteResult, error)
+	FindAll(opts ListOptions) (*MagazinePage, error)
+	Stream(ctx context.Context, opts ListOptions, fn func(*Magazine) error) error
+	UpdateById(magazine Magazine) (*Magazine, error)
+	Patch(id string, patch MagazinePatch) (*Magazine, error)
+	Delete(id string, version int64) (*Magazine, error)
+	// importBatch upserts a batch of import rows without validating them,
+	// which MagazineService.ImportMagazines does first.
+	importBatch(rows []ImportRow, dryRun bool) ([]ImportResult, error)
+	// Trash
+	Restore(id string) (*Magazine, error)
+	Purge(deletedBefore time.Time) (int64, error)
 	// Search
-	Search(field, term string) (*[]Magazine, error)
+	Search(opts SearchOptions) (*SearchResult, error)
+	// Change feed
+	Changes(ctx context.Context, opts ChangeOptions) (ChangeFeed, error)
 }
 
 type MagazineService interface {
+	// ImportMagazines validates and upserts every row of an import file.
+	ImportMagazines(rows RowReader, dryRun bool) (*ImportReport, error)
 	MagazineDB
 }
 
-func NewMagazineService(db *mongo.Client) MagazineService {
-	mDb := &mongoMagazine{db}
+func NewMagazineService(db *mongo.Client, search Searcher) MagazineService {
+	return newMagazineService(db, "", &mongoMagazine{db: db, search: search}, environment{})
+}
 
+// newMagazineService builds the service on top of mDb, which is the Mongo
+// database layer or a decorator of it, keeping its terms in the named
+// database.
+func newMagazineService(db *mongo.Client, database string, mDb MagazineDB, env environment) MagazineService {
 	return &magazineService{
-		MagazineDB: mDb,
+		environment: env,
+		MagazineDB:  mDb,
+		terms:       &termDictionary{environment: env, db: db, database: database},
 	}
 }
 
 var _ MagazineDB = &magazineService{}
 
+// magazineStore is a MagazineDB whose updates also report the title the
+// magazine had before, which the term dictionary has to be moved away from.
+// The databases read the magazine for its slug anyway, so they can tell
+// without another read.
+type magazineStore interface {
+	MagazineDB
+	// replace is UpdateById.
+	replace(magazine Magazine) (previousTitle string, updated *Magazine, err error)
+	// patch is Patch. The previous title is the current one if the patch
+	// leaves the title alone.
+	patch(id string, patch MagazinePatch) (previousTitle string, patched *Magazine, err error)
+}
+
+// replaceMagazine updates a magazine through db and returns the title it
+// had before. A db that is not a magazineStore is read first.
+func replaceMagazine(db MagazineDB, magazine Magazine) (string, *Magazine, error) {
+	if store, ok := db.(magazineStore); ok {
+		return store.replace(magazine)
+	}
+	current, err := db.FindById(magazine.ID.Hex())
+	if err != nil {
+		return "", nil, err
+	}
+	updated, err := db.UpdateById(magazine)
+	if err != nil {
+		return "", nil, err
+	}
+	return current.Title, updated, nil
+}
+
+// patchMagazine patches a magazine through db and returns the title it had
+// before, like replaceMagazine.
+func patchMagazine(db MagazineDB, id string, patch MagazinePatch) (string, *Magazine, error) {
+	if store, ok := db.(magazineStore); ok {
+		return store.patch(id, patch)
+	}
+	current, err := db.FindById(id)
+	if err != nil {
+		return "", nil, err
+	}
+	patched, err := db.Patch(id, patch)
+	if err != nil {
+		return "", nil, err
+	}
+	return current.Title, patched, nil
+}
+
+// magazineService validates magazines before they are handed to the
+// database layer, and keeps the dictionary of title terms search
+// suggestions are drawn from in step with the live magazines.
 type magazineService struct {
+	environment
 	MagazineDB
+	terms *termDictionary
+}
+
+func (ms *magazineService) Create(magazine Magazine) (*Magazine, error) {
+	if err := Validate(magazine); err != nil {
+		return nil, err
+	}
+	created, err := ms.MagazineDB.Create(magazine)
+	if err != nil {
+		return nil, err
+	}
+	ms.terms.update(nil, []string{created.Title})
+	return created, nil
+}
+
+func (ms *magazineService) UpdateById(magazine Magazine) (*Magazine, error) {
+	if err := Validate(magazine); err != nil {
+		return nil, err
+	}
+	previousTitle, updated, err := replaceMagazine(ms.MagazineDB, magazine)
+	if err != nil {
+		return nil, err
+	}
+	ms.terms.update([]string{previousTitle}, []string{updated.Title})
+	return updated, nil
+}
+
+func (ms *magazineService) Patch(id string, patch MagazinePatch) (*Magazine, error) {
+	if err := validatePatch(patch); err != nil {
+		return nil, err
+	}
+	previousTitle, patched, err := patchMagazine(ms.MagazineDB, id, patch)
+	if err != nil {
+		return nil, err
+	}
+	ms.terms.update([]string{previousTitle}, []string{patched.Title})
+	return patched, nil
+}
+
+func (ms *magazineService) Delete(id string, version int64) (*Magazine, error) {
+	deleted, err := ms.MagazineDB.Delete(id, version)
+	if err != nil {
+		return nil, err
+	}
+	ms.terms.update([]string{deleted.Title}, nil)
+	return deleted, nil
+}
+
+func (ms *magazineService) Restore(id string) (*Magazine, error) {
+	restored, err := ms.MagazineDB.Restore(id)
+	if err != nil {
+		return nil, err
+	}
+	ms.terms.update(nil, []string{restored.Title})
+	return restored, nil
+}
+
+// Search adds suggested queries to searches with fewer than
+// suggestBelowHits hits. A failure to suggest does not fail the search.
+func (ms *magazineService) Search(opts SearchOptions) (*SearchResult, error) {
+	result, err := ms.MagazineDB.Search(opts)
+	if err != nil || result.Total >= suggestBelowHits {
+		return result, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), termTimeout)
+	defer cancel()
+
+	suggestions, err := ms.terms.suggest(ctx, opts.Term)
+	if err != nil {
+		ms.logf("suggesting search terms failed: %v", err)
+		return result, nil
+	}
+	result.Suggestions = suggestions
+	return result, nil
 }
 
 var _ MagazineDB = &mongoMagazine{}
 
 type mongoMagazine struct {
+	environment
 	db *mongo.Client
+	// database is the name of the database the magazine collections are
+	// in, see libraryDatabase.
+	database string
+	indexes  magazineIndexes
+	search   Searcher
+	// noTransactions is set once the server turns out not to support
+	// transactions.
+	noTransactions atomic.Bool
+}
+
+// libraryDatabase returns the database called name, or the library
+// database the magazine collections are normally kept in if name is empty.
+// Tests give their own name to stay clear of real data.
+func libraryDatabase(client *mongo.Client, name string) *mongo.Database {
+	if name == "" {
+		name = "library"
+	}
+	return client.Database(name)
+}
+
+func (mM *mongoMagazine) collection(name string) *mongo.Collection {
+	return libraryDatabase(mM.db, mM.database).Collection(name)
 }
 
 func (mM *mongoMagazine) FindById(id string) (*Magazine, error) {
@@ -60,9 +309,9 @@ func (mM *mongoMagazine) FindById(id string) (*Magazine, error) {
 	}
 
 	magazine := Magazine{}
-	db := mM.db.Database("library").Collection("magazines")
+	db := mM.collection("magazines")
 
-	collection := db.FindOne(context.TODO(), bson.M{"_id": objectId})
+	collection := db.FindOne(context.TODO(), bson.M{"_id": objectId, "deletedAt": nil})
 	err = collection.Decode(&magazine)
 	if err != nil {
 		return nil, err
@@ -71,12 +320,25 @@ func (mM *mongoMagazine) FindById(id string) (*Magazine, error) {
 	return &magazine, nil
 }
 
+// FindBySlug returns the magazine with the given slug. If no magazine has
+// the slug now, the magazine that used to have it is returned instead; its
+// Slug then differs from the one asked for.
 func (mM *mongoMagazine) FindBySlug(slug string) (*Magazine, error) {
+	// Magazines stored before slugs were introduced cannot be found by slug
+	// until they are backfilled.
+	if err := mM.ensureIndexes(); err != nil {
+		return nil, err
+	}
+
 	magazine := Magazine{}
-	db := mM.db.Database("library").Collection("magazines")
+	db := mM.collection("magazines")
 
-	collection := db.FindOne(context.TODO(), bson.M{"title": slug})
+	collection := db.FindOne(context.TODO(), bson.M{"slug": slug, "deletedAt": nil})
 	err := collection.Decode(&magazine)
+	if err == mongo.ErrNoDocuments {
+		collection = db.FindOne(context.TODO(), bson.M{"previousSlugs": slug, "deletedAt": nil})
+		err = collection.Decode(&magazine)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -86,9 +348,9 @@ func (mM *mongoMagazine) FindBySlug(slug string) (*Magazine, error) {
 
 func (mM *mongoMagazine) FindByTitle(title string) (*Magazine, error) {
 	magazine := Magazine{}
-	db := mM.db.Database("library").Collection("magazines")
+	db := mM.collection("magazines")
 
-	collection := db.FindOne(context.TODO(), bson.M{"title": title})
+	collection := db.FindOne(context.TODO(), bson.M{"title": title, "deletedAt": nil})
 	err := collection.Decode(&magazine)
 	if err != nil {
 		return nil, err
@@ -97,108 +359,402 @@ func (mM *mongoMagazine) FindByTitle(title string) (*Magazine, error) {
 	return &magazine, nil
 }
 
-func (mM *mongoMagazine) FindAll() (*[]Magazine, error) {
-	magazines := make([]Magazine, 2)
-	db := mM.db.Database("library").Collection("magazines")
+// FindAll returns the page of magazines selected by opts.
+func (mM *mongoMagazine) FindAll(opts ListOptions) (*MagazinePage, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = query.DefaultLimit
+	}
 
-	collection, err := db.Find(context.TODO(), bson.M{})
+	sort := opts.Sort
+	if len(sort) == 0 {
+		sort = query.DefaultSort
+	}
+
+	filter := query.And(opts.Filter, live)
+	if opts.Trashed {
+		filter = query.And(opts.Filter, trashed)
+	}
+	if opts.Cursor != "" {
+		after, err := query.After(sort, opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter = query.And(filter, after)
+	}
+
+	// Fetch one extra document to find out whether there is a next page.
+	findOpts := options.Find().SetSort(sort).SetLimit(opts.Limit + 1)
+	db := mM.collection("magazines")
+
+	collection, err := db.Find(context.TODO(), filter, findOpts)
 	if err != nil {
 		return nil, err
 	}
 
+	magazines := []Magazine{}
 	err = collection.All(context.TODO(), &magazines)
 	if err != nil {
 		return nil, err
 	}
 
-	return &magazines, nil
+	page := MagazinePage{Magazines: magazines}
+	if int64(len(magazines)) > opts.Limit {
+		page.Magazines = magazines[:opts.Limit]
+		page.NextCursor, err = query.EncodeCursor(sort, page.Magazines[opts.Limit-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &page, nil
 }
 
-func (mM *mongoMagazine) Delete(id string) (*mongo.DeleteResult, error) {
+// Stream calls fn for every magazine matching the filter and sort of opts,
+// reading them from a Mongo cursor one at a time. Limit and Cursor are
+// ignored. It stops at the first error returned by fn or when ctx is done.
+func (mM *mongoMagazine) Stream(ctx context.Context, opts ListOptions, fn func(*Magazine) error) error {
+	sort := opts.Sort
+	if len(sort) == 0 {
+		sort = query.DefaultSort
+	}
+
+	filter := query.And(opts.Filter, live)
+	if opts.Trashed {
+		filter = query.And(opts.Filter, trashed)
+	}
+
+	db := mM.collection("magazines")
+	cursor, err := db.Find(ctx, filter, options.Find().SetSort(sort))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		magazine := Magazine{}
+		if err := cursor.Decode(&magazine); err != nil {
+			return err
+		}
+		if err := fn(&magazine); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// Delete moves the magazine with the given id to the trash and returns it.
+// A non-zero version must match the stored version, otherwise
+// ErrVersionConflict is returned.
+func (mM *mongoMagazine) Delete(id string, version int64) (*Magazine, error) {
 	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return nil, err
 	}
 
-	db := mM.db.Database("library").Collection("magazines")
+	db := mM.collection("magazines")
+	deletedAt := mM.now()
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "deletedAt", Value: deletedAt}, {Key: "updatedAt", Value: deletedAt}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 
-	res, err := db.DeleteOne(context.Background(), bson.M{"_id": objectId})
+	magazine := Magazine{}
+	err = mM.transact(func(ctx context.Context) error {
+		if err := db.FindOneAndUpdate(ctx, versionFilter(objectId, version), update, opts).Decode(&magazine); err != nil {
+			return err
+		}
+		return mM.recordEvent(ctx, EventMagazineDeleted, &magazine)
+	})
+	if err == mongo.ErrNoDocuments && version != 0 {
+		err = mM.checkVersion(objectId)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return res, nil
+	return &magazine, nil
 }
 
-func (mM *mongoMagazine) Create(magazine Magazine) (*mongo.InsertOneResult, error) {
-	db := mM.db.Database("library").Collection("magazines")
+// Restore takes the magazine with the given id out of the trash and returns
+// it.
+func (mM *mongoMagazine) Restore(id string) (*Magazine, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	db := mM.collection("magazines")
+	filter := query.And(bson.D{{Key: "_id", Value: objectId}}, trashed)
+	update := bson.D{
+		{Key: "$unset", Value: bson.D{{Key: "deletedAt", Value: ""}}},
+		{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: mM.now()}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 
-	res, err := db.InsertOne(context.Background(), magazine)
+	magazine := Magazine{}
+	err = mM.transact(func(ctx context.Context) error {
+		if err := db.FindOneAndUpdate(ctx, filter, update, opts).Decode(&magazine); err != nil {
+			return err
+		}
+		return mM.recordEvent(ctx, EventMagazineRestored, &magazine)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return res, nil
+	return &magazine, nil
 }
 
-func (mM *mongoMagazine) UpdateById(magazine Magazine) (*mongo.UpdateResult, error) {
-	db := mM.db.Database("library").Collection("magazines")
-	payload := bson.D{{Key: "$set", Value: magazine}}
+// Purge permanently removes the magazines that were moved to the trash
+// before deletedBefore and returns how many were removed.
+func (mM *mongoMagazine) Purge(deletedBefore time.Time) (int64, error) {
+	db := mM.collection("magazines")
 
-	res, err := db.UpdateByID(context.Background(), magazine.ID, payload)
+	res, err := db.DeleteMany(context.Background(), bson.M{"deletedAt": bson.M{"$lt": deletedBefore}})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return res, nil
+	return res.DeletedCount, nil
 }
 
-func (mM *mongoMagazine) AggregateByPrice(price string) (*[]Magazine, error) {
-	db := mM.db.Database("library").Collection("magazines")
-	groupStage := bson.D{{Key: "$match", Value: bson.D{{Key: "price", Value: price}}}}
+func (mM *mongoMagazine) Create(magazine Magazine) (*Magazine, error) {
+	if err := mM.ensureIndexes(); err != nil {
+		return nil, err
+	}
 
-	res, err := db.Aggregate(context.Background(), mongo.Pipeline{groupStage})
+	if magazine.ID.IsZero() {
+		magazine.ID = primitive.NewObjectID()
+	}
+	magazine.Version = 1
+	magazine.UpdatedAt = mM.now()
+	magazine.DeletedAt = nil
+
+	db := mM.collection("magazines")
+
+	var err error
+	for attempt := 0; attempt < maxSlugAttempts; attempt++ {
+		if err = renameSlug(&magazine, nil, mM.uniqueSlug); err != nil {
+			return nil, err
+		}
+		err = mM.transact(func(ctx context.Context) error {
+			if _, err := db.InsertOne(ctx, magazine); err != nil {
+				return err
+			}
+			return mM.recordEvent(ctx, EventMagazineCreated, &magazine)
+		})
+		if !isSlugConflict(err) {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	magazines := make([]Magazine, 2)
+	return &magazine, nil
+}
 
-	err = res.All(context.Background(), &magazines)
+// UpdateById replaces the fields of the magazine with the matching ID and
+// returns the document as it is stored after the update. A non-zero
+// magazine.Version must match the stored version, otherwise
+// ErrVersionConflict is returned.
+func (mM *mongoMagazine) UpdateById(magazine Magazine) (*Magazine, error) {
+	_, updated, err := mM.replace(magazine)
+	return updated, err
+}
+
+var _ magazineStore = &mongoMagazine{}
+
+func (mM *mongoMagazine) replace(magazine Magazine) (string, *Magazine, error) {
+	if err := mM.ensureIndexes(); err != nil {
+		return "", nil, err
+	}
+
+	db := mM.collection("magazines")
+
+	expected := magazine.Version
+	// The version is only ever written by $inc, so drop it from $set.
+	magazine.Version = 0
+	magazine.UpdatedAt = mM.now()
+	magazine.DeletedAt = nil
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var current *Magazine
+	var err error
+	updated := Magazine{}
+	for attempt := 0; attempt < maxSlugAttempts; attempt++ {
+		current, err = mM.FindById(magazine.ID.Hex())
+		if err != nil {
+			return "", nil, err
+		}
+		if expected != 0 && current.Version != expected {
+			return "", nil, ErrVersionConflict
+		}
+		// The slug follows from the title read above, so the update only
+		// applies to the version that title was read at.
+		filter := versionFilter(magazine.ID, current.Version)
+
+		if err = renameSlug(&magazine, current, mM.uniqueSlug); err != nil {
+			return "", nil, err
+		}
+		payload := bson.D{
+			{Key: "$set", Value: magazine},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+		}
+		if cleared := clearedFields(magazine); len(cleared) > 0 {
+			payload = append(payload, bson.E{Key: "$unset", Value: cleared})
+		}
+		err = mM.transact(func(ctx context.Context) error {
+			if err := db.FindOneAndUpdate(ctx, filter, payload, opts).Decode(&updated); err != nil {
+				return err
+			}
+			return mM.recordEvent(ctx, EventMagazineUpdated, &updated)
+		})
+		// Another write got in between; an update of any version reads the
+		// magazine again.
+		raced := err == mongo.ErrNoDocuments && expected == 0
+		if !isSlugConflict(err) && !raced {
+			break
+		}
+	}
+	if err == mongo.ErrNoDocuments && expected != 0 {
+		err = mM.checkVersion(magazine.ID)
+	}
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	return &magazines, nil
+	return current.Title, &updated, nil
 }
 
-func (mM *mongoMagazine) Search(field, term string) (*[]Magazine, error) {
-	searchQuery := bson.D{{Key: "index", Value: "magazine_title"},
-		{Key: "autocomplete", Value: bson.D{
-			{Key: "path", Value: field},
-			{Key: "query", Value: term},
-		}}}
-	searchStage := bson.D{{Key: "$search", Value: searchQuery}}
-	limitStage := bson.D{{Key: "$limit", Value: 5}}
-	projectStage := bson.D{
-		{Key: "$project", Value: bson.D{{Key: "score", Value: bson.D{{Key: "$meta", Value: "searchScore"}}},
-			{Key: field, Value: 1}, {Key: "_id", Value: 1}, {Key: "price", Value: 1},
-			{Key: "highlight", Value: bson.D{{Key: "$meta", Value: "searchHighlights"}}}}}}
+// Patch applies a partial update to the magazine with the given id and
+// returns the document as it is stored after the update. Fields the patch
+// does not mention are left untouched.
+func (mM *mongoMagazine) Patch(id string, patch MagazinePatch) (*Magazine, error) {
+	_, patched, err := mM.patch(id, patch)
+	return patched, err
+}
 
-	opts := options.Aggregate().SetMaxTime(5 * time.Second)
-	// run pipeline
-	db := mM.db.Database("library").Collection("magazines")
-	res, err := db.Aggregate(context.Background(), mongo.Pipeline{searchStage, limitStage, projectStage}, opts)
+func (mM *mongoMagazine) patch(id string, patch MagazinePatch) (string, *Magazine, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+
+	if err := mM.ensureIndexes(); err != nil {
+		return "", nil, err
 	}
 
-	magazines := make([]Magazine, 2)
+	db := mM.collection("magazines")
+	filter := append(versionFilter(objectId, patch.Version), patch.Test...)
+
+	set := append(bson.D{}, patch.Set...)
+	set = append(set, bson.E{Key: "updatedAt", Value: mM.now()})
+	previousTitle := ""
+	title, renaming := patchedTitle(patch)
+	if renaming {
+		current, err := mM.FindById(id)
+		if err != nil {
+			return "", nil, err
+		}
+		previousTitle = current.Title
+		renamed := Magazine{ID: objectId, Title: title}
+		if err := renameSlug(&renamed, current, mM.uniqueSlug); err != nil {
+			return "", nil, err
+		}
+		set = append(set,
+			bson.E{Key: "slug", Value: renamed.Slug},
+			bson.E{Key: "previousSlugs", Value: renamed.PreviousSlugs})
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(patch.Unset) > 0 {
+		fields := bson.D{}
+		for _, field := range patch.Unset {
+			fields = append(fields, bson.E{Key: field, Value: ""})
+		}
+		update = append(update, bson.E{Key: "$unset", Value: fields})
+	}
+	update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}})
 
-	err = res.All(context.Background(), &magazines)
+	magazine := Magazine{}
+	if patch.IsEmpty() {
+		err = db.FindOne(context.Background(), filter).Decode(&magazine)
+	} else {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err = mM.transact(func(ctx context.Context) error {
+			if err := db.FindOneAndUpdate(ctx, filter, update, opts).Decode(&magazine); err != nil {
+				return err
+			}
+			return mM.recordEvent(ctx, EventMagazineUpdated, &magazine)
+		})
+	}
+	if err == mongo.ErrNoDocuments && patch.Version != 0 {
+		err = mM.checkVersion(objectId)
+	}
+	if err == mongo.ErrNoDocuments && len(patch.Test) > 0 {
+		// Tell a failed test apart from a magazine that does not exist.
+		if _, findErr := mM.FindById(id); findErr == nil {
+			return "", nil, ErrPatchTestFailed
+		}
+	}
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+
+	if !renaming {
+		previousTitle = magazine.Title
+	}
+	return previousTitle, &magazine, nil
+}
+
+var (
+	// live matches magazines that are not in the trash.
+	live = bson.D{{Key: "deletedAt", Value: nil}}
+	// trashed matches magazines that are in the trash.
+	trashed = bson.D{{Key: "deletedAt", Value: bson.D{{Key: "$ne", Value: nil}}}}
+)
+
+// clearedFields lists the optional fields a replacement leaves empty. They
+// are omitted from $set, so they have to be removed explicitly.
+func clearedFields(magazine Magazine) bson.D {
+	cleared := bson.D{}
+	if magazine.Category == "" {
+		cleared = append(cleared, bson.E{Key: "category", Value: ""})
+	}
+	if magazine.Publisher == "" {
+		cleared = append(cleared, bson.E{Key: "publisher", Value: ""})
 	}
+	if magazine.PublicationYear == 0 {
+		cleared = append(cleared, bson.E{Key: "publicationYear", Value: ""})
+	}
+	return cleared
+}
+
+// versionFilter matches the live magazine with the given id and, when
+// version is not zero, only while it is still at that version.
+func versionFilter(id primitive.ObjectID, version int64) bson.D {
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "deletedAt", Value: nil}}
+	if version != 0 {
+		filter = append(filter, bson.E{Key: "version", Value: version})
+	}
+	return filter
+}
 
-	return &magazines, nil
+// checkVersion is called after a versioned write matched nothing. It returns
+// ErrVersionConflict if the magazine exists, so it must have moved on to
+// another version, and mongo.ErrNoDocuments otherwise.
+func (mM *mongoMagazine) checkVersion(id primitive.ObjectID) error {
+	db := mM.collection("magazines")
+
+	count, err := db.CountDocuments(context.Background(), bson.M{"_id": id, "deletedAt": nil}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrVersionConflict
+	}
+	return mongo.ErrNoDocuments
 }
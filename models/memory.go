@@ -0,0 +1,676 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxMemoryChanges is the number of changes the in-memory backend keeps for
+// change feeds to resume from, like the oplog of a replica set.
+const maxMemoryChanges = 10000
+
+// NewMemoryMagazineDB returns a MagazineDB that keeps magazines in memory,
+// for tests and demos that run without Mongo. It stores magazines as BSON
+// and runs the same filters, sorts and updates as the Mongo backend, so
+// slugs, versions, the trash, cursors, duplicate keys and not-found errors
+// behave the same. Searches match whole words and word prefixes without
+// the stemming and synonyms of a real search index.
+func NewMemoryMagazineDB() MagazineDB {
+	return &memoryMagazine{
+		magazines: memoryCollection{name: "library.magazines", unique: []string{"slug"}},
+		notify:    make(chan struct{}),
+	}
+}
+
+var _ MagazineDB = &memoryMagazine{}
+
+type memoryMagazine struct {
+	environment
+	mu        sync.Mutex
+	magazines memoryCollection
+
+	// changes holds the latest changes, in order. The sequence number of
+	// changes[i] is firstChange+i.
+	changes     []MagazineChange
+	firstChange int64
+	// notify is closed and replaced whenever a change is recorded.
+	notify chan struct{}
+}
+
+func (m *memoryMagazine) FindById(id string) (*Magazine, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.findOne(bson.D{{Key: "_id", Value: objectId}, {Key: "deletedAt", Value: nil}})
+}
+
+func (m *memoryMagazine) FindBySlug(slug string) (*Magazine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	magazine, err := m.findOne(bson.D{{Key: "slug", Value: slug}, {Key: "deletedAt", Value: nil}})
+	if err == mongo.ErrNoDocuments {
+		magazine, err = m.findOne(bson.D{{Key: "previousSlugs", Value: slug}, {Key: "deletedAt", Value: nil}})
+	}
+	return magazine, err
+}
+
+func (m *memoryMagazine) FindAll(opts ListOptions) (*MagazinePage, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = query.DefaultLimit
+	}
+
+	sort := opts.Sort
+	if len(sort) == 0 {
+		sort = query.DefaultSort
+	}
+
+	filter := query.And(opts.Filter, live)
+	if opts.Trashed {
+		filter = query.And(opts.Filter, trashed)
+	}
+	if opts.Cursor != "" {
+		after, err := query.After(sort, opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter = query.And(filter, after)
+	}
+
+	m.mu.Lock()
+	magazines, err := m.find(filter, sort)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	page := MagazinePage{Magazines: magazines}
+	if int64(len(magazines)) > opts.Limit {
+		page.Magazines = magazines[:opts.Limit]
+		page.NextCursor, err = query.EncodeCursor(sort, page.Magazines[opts.Limit-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &page, nil
+}
+
+// Stream reads the matching magazines at once and then calls fn for each,
+// so fn may use the database itself.
+func (m *memoryMagazine) Stream(ctx context.Context, opts ListOptions, fn func(*Magazine) error) error {
+	sort := opts.Sort
+	if len(sort) == 0 {
+		sort = query.DefaultSort
+	}
+
+	filter := query.And(opts.Filter, live)
+	if opts.Trashed {
+		filter = query.And(opts.Filter, trashed)
+	}
+
+	m.mu.Lock()
+	magazines, err := m.find(filter, sort)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i := range magazines {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(&magazines[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryMagazine) Create(magazine Magazine) (*Magazine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if magazine.ID.IsZero() {
+		magazine.ID = primitive.NewObjectID()
+	}
+	magazine.Version = 1
+	magazine.UpdatedAt = m.now()
+	magazine.DeletedAt = nil
+
+	if err := renameSlug(&magazine, nil, m.uniqueSlug); err != nil {
+		return nil, err
+	}
+	doc, err := m.magazines.insert(magazine)
+	if err != nil {
+		return nil, err
+	}
+	m.recordChange(nil, doc)
+
+	return decodeMagazine(doc)
+}
+
+func (m *memoryMagazine) UpdateById(magazine Magazine) (*Magazine, error) {
+	_, updated, err := m.replace(magazine)
+	return updated, err
+}
+
+var _ magazineStore = &memoryMagazine{}
+
+func (m *memoryMagazine) replace(magazine Magazine) (string, *Magazine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, err := m.findOne(bson.D{{Key: "_id", Value: magazine.ID}, {Key: "deletedAt", Value: nil}})
+	if err != nil {
+		return "", nil, err
+	}
+
+	expected := magazine.Version
+	magazine.Version = 0
+	magazine.UpdatedAt = m.now()
+	magazine.DeletedAt = nil
+	if err := renameSlug(&magazine, current, m.uniqueSlug); err != nil {
+		return "", nil, err
+	}
+	update := bson.D{
+		{Key: "$set", Value: magazine},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	if cleared := clearedFields(magazine); len(cleared) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: cleared})
+	}
+
+	updated, err := m.updateOne(versionFilter(magazine.ID, expected), update)
+	if err == mongo.ErrNoDocuments && expected != 0 {
+		err = m.checkVersion(magazine.ID)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return current.Title, updated, nil
+}
+
+func (m *memoryMagazine) Patch(id string, patch MagazinePatch) (*Magazine, error) {
+	_, patched, err := m.patch(id, patch)
+	return patched, err
+}
+
+func (m *memoryMagazine) patch(id string, patch MagazinePatch) (string, *Magazine, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	filter := append(versionFilter(objectId, patch.Version), patch.Test...)
+
+	set := append(bson.D{}, patch.Set...)
+	set = append(set, bson.E{Key: "updatedAt", Value: m.now()})
+	previousTitle := ""
+	title, renaming := patchedTitle(patch)
+	if renaming {
+		current, err := m.findOne(bson.D{{Key: "_id", Value: objectId}, {Key: "deletedAt", Value: nil}})
+		if err != nil {
+			return "", nil, err
+		}
+		previousTitle = current.Title
+		renamed := Magazine{ID: objectId, Title: title}
+		if err := renameSlug(&renamed, current, m.uniqueSlug); err != nil {
+			return "", nil, err
+		}
+		set = append(set,
+			bson.E{Key: "slug", Value: renamed.Slug},
+			bson.E{Key: "previousSlugs", Value: renamed.PreviousSlugs})
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(patch.Unset) > 0 {
+		fields := bson.D{}
+		for _, field := range patch.Unset {
+			fields = append(fields, bson.E{Key: field, Value: ""})
+		}
+		update = append(update, bson.E{Key: "$unset", Value: fields})
+	}
+	update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}})
+
+	var magazine *Magazine
+	if patch.IsEmpty() {
+		magazine, err = m.findOne(filter)
+	} else {
+		magazine, err = m.updateOne(filter, update)
+	}
+	if err == mongo.ErrNoDocuments && patch.Version != 0 {
+		err = m.checkVersion(objectId)
+	}
+	if err == mongo.ErrNoDocuments && len(patch.Test) > 0 {
+		// Tell a failed test apart from a magazine that does not exist.
+		if _, findErr := m.findOne(bson.D{{Key: "_id", Value: objectId}, {Key: "deletedAt", Value: nil}}); findErr == nil {
+			return "", nil, ErrPatchTestFailed
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !renaming {
+		previousTitle = magazine.Title
+	}
+	return previousTitle, magazine, nil
+}
+
+func (m *memoryMagazine) Delete(id string, version int64) (*Magazine, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deletedAt := m.now()
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "deletedAt", Value: deletedAt}, {Key: "updatedAt", Value: deletedAt}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	deleted, err := m.updateOne(versionFilter(objectId, version), update)
+	if err == mongo.ErrNoDocuments && version != 0 {
+		err = m.checkVersion(objectId)
+	}
+	return deleted, err
+}
+
+func (m *memoryMagazine) Restore(id string) (*Magazine, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	filter := query.And(bson.D{{Key: "_id", Value: objectId}}, trashed)
+	update := bson.D{
+		{Key: "$unset", Value: bson.D{{Key: "deletedAt", Value: ""}}},
+		{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: m.now()}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	return m.updateOne(filter, update)
+}
+
+func (m *memoryMagazine) Purge(deletedBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.magazines.deleteMany(bson.M{"deletedAt": bson.M{"$lt": deletedBefore}})
+}
+
+// importBatch writes the rows of a batch one after the other. A row that
+// fails is rejected and leaves the others alone.
+func (m *memoryMagazine) importBatch(rows []ImportRow, dryRun bool) ([]ImportResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := []Magazine{}
+	found, err := m.magazines.find(importTargetsFilter(rows))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.magazines.decode(found, &existing); err != nil {
+		return nil, err
+	}
+	targets := importTargetsByKey(existing)
+
+	if dryRun {
+		return dryRunImport(rows, targets), nil
+	}
+
+	batchSlugs := map[string]bool{}
+	upserted := map[int]primitive.ObjectID{}
+	rejected := trashedRows(rows, targets)
+	for i, row := range rows {
+		if _, ok := rejected[i]; ok {
+			continue
+		}
+		update, err := importUpdate(row, m.now(), targets, batchSlugs, m.uniqueSlug)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := m.upsert(importFilter(row.Magazine), update)
+		if err != nil {
+			rejected[i] = writeErrorMessage(err)
+			continue
+		}
+		if !id.IsZero() {
+			upserted[i] = id
+		}
+	}
+
+	return importResults(rows, targets, upserted, rejected), nil
+}
+
+// upsert updates the first document matching filter or, if there is none,
+// inserts one made of the equality conditions of filter and update. It
+// returns the id of an inserted document.
+func (m *memoryMagazine) upsert(filter bson.D, update bson.D) (primitive.ObjectID, error) {
+	i, err := m.magazines.findOne(filter)
+	if err == nil {
+		before := m.magazines.docs[i]
+		after, err := m.magazines.update(i, update)
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		m.recordChange(before, after)
+		return primitive.NilObjectID, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return primitive.NilObjectID, err
+	}
+
+	id := primitive.NewObjectID()
+	inserted := bson.D{}
+	for _, condition := range filter {
+		if condition.Key == "_id" {
+			id = condition.Value.(primitive.ObjectID)
+		} else if condition.Value != nil {
+			inserted = append(inserted, condition)
+		}
+	}
+	doc, err := bson.Marshal(append(bson.D{{Key: "_id", Value: id}}, inserted...))
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	inserting, err := applyUpdate(doc, update, true)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if _, err := m.magazines.insert(inserting); err != nil {
+		return primitive.NilObjectID, err
+	}
+	m.recordChange(nil, inserting)
+	return id, nil
+}
+
+func (m *memoryMagazine) Changes(ctx context.Context, opts ChangeOptions) (ChangeFeed, error) {
+	ids, err := changeIDs(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	last := m.firstChange + int64(len(m.changes)) - 1
+	position := last
+	if opts.ResumeAfter != "" {
+		position, err = strconv.ParseInt(opts.ResumeAfter, 16, 64)
+		if err != nil || position < m.firstChange-1 || position > last {
+			return nil, fmt.Errorf("%w: unknown resume token %q", ErrChangeHistoryLost, opts.ResumeAfter)
+		}
+	}
+
+	feed := &memoryChangeFeed{db: m, position: position, fields: opts.Fields, wait: opts.Wait, ids: map[primitive.ObjectID]bool{}}
+	for _, id := range ids {
+		feed.ids[id.(primitive.ObjectID)] = true
+	}
+	return feed, nil
+}
+
+// recordChange adds the change from before to after, either of which is nil
+// for an insert or a removal, to the changes feeds read. Like a change
+// stream, it reports moving a magazine to and out of the trash as a delete
+// and a create, and nothing for removals.
+func (m *memoryMagazine) recordChange(before, after bson.Raw) {
+	if after == nil {
+		return
+	}
+	magazine, err := decodeMagazine(after)
+	if err != nil {
+		return
+	}
+
+	change := MagazineChange{MagazineID: magazine.ID, Magazine: magazine, Time: m.now().Truncate(time.Second)}
+	_, wasDeleted := lookupPath(before, "deletedAt")
+	isDeleted := magazine.DeletedAt != nil
+	switch {
+	case before == nil:
+		change.Type = ChangeCreate
+	case isDeleted && !wasDeleted:
+		change.Type = ChangeDelete
+		change.Magazine = nil
+	case wasDeleted && !isDeleted:
+		change.Type = ChangeCreate
+	default:
+		change.Type = ChangeUpdate
+		change.Fields = changedFields(before, after)
+	}
+
+	seq := m.firstChange + int64(len(m.changes))
+	change.ID = changeToken(seq)
+	m.changes = append(m.changes, change)
+	if len(m.changes) > maxMemoryChanges {
+		m.changes = m.changes[1:]
+		m.firstChange++
+	}
+
+	close(m.notify)
+	m.notify = make(chan struct{})
+}
+
+// changedFields lists the top-level fields that differ between two versions
+// of a document, leaving out bookkeeping fields.
+func changedFields(before, after bson.Raw) []string {
+	keys := map[string]bool{}
+	for _, doc := range []bson.Raw{before, after} {
+		elements, _ := doc.Elements()
+		for _, element := range elements {
+			keys[element.Key()] = true
+		}
+	}
+
+	fields := []string{}
+	for key := range keys {
+		x, inBefore := lookupPath(before, key)
+		y, inAfter := lookupPath(after, key)
+		if bookkeepingFields[key] || (inBefore == inAfter && x.Equal(y)) {
+			continue
+		}
+		fields = append(fields, key)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func changeToken(seq int64) string {
+	return fmt.Sprintf("%016x", seq)
+}
+
+// memoryChangeFeed reads the changes of a memoryMagazine after position.
+type memoryChangeFeed struct {
+	db       *memoryMagazine
+	position int64
+	ids      map[primitive.ObjectID]bool
+	fields   []string
+	wait     time.Duration
+}
+
+func (f *memoryChangeFeed) Next(ctx context.Context) (*MagazineChange, error) {
+	wait := f.wait
+	if wait <= 0 {
+		wait = time.Second
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		f.db.mu.Lock()
+		if f.position < f.db.firstChange-1 {
+			f.db.mu.Unlock()
+			return nil, fmt.Errorf("%w: the feed fell behind by more than %d changes", ErrChangeHistoryLost, maxMemoryChanges)
+		}
+		for f.position < f.db.firstChange+int64(len(f.db.changes))-1 {
+			f.position++
+			change := f.db.changes[f.position-f.db.firstChange]
+			if (len(f.ids) > 0 && !f.ids[change.MagazineID]) || !changesField(&change, f.fields) {
+				continue
+			}
+			f.db.mu.Unlock()
+			return &change, nil
+		}
+		notify := f.db.notify
+		f.db.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, nil
+		case <-notify:
+		}
+	}
+}
+
+func (f *memoryChangeFeed) ResumeToken() string {
+	f.db.mu.Lock()
+	defer f.db.mu.Unlock()
+	return changeToken(f.position)
+}
+
+func (f *memoryChangeFeed) Close() error {
+	return nil
+}
+
+// findOne returns the first magazine matching filter. The caller holds mu.
+func (m *memoryMagazine) findOne(filter interface{}) (*Magazine, error) {
+	i, err := m.magazines.findOne(filter)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMagazine(m.magazines.docs[i])
+}
+
+// find returns the magazines matching filter in sort order. The caller
+// holds mu.
+func (m *memoryMagazine) find(filter interface{}, sort bson.D) ([]Magazine, error) {
+	found, err := m.magazines.find(filter)
+	if err != nil {
+		return nil, err
+	}
+	m.magazines.sortPositions(found, sort)
+
+	magazines := []Magazine{}
+	if err := m.magazines.decode(found, &magazines); err != nil {
+		return nil, err
+	}
+	return magazines, nil
+}
+
+// updateOne applies update to the first magazine matching filter and
+// returns it as it is stored afterwards. The caller holds mu.
+func (m *memoryMagazine) updateOne(filter bson.D, update bson.D) (*Magazine, error) {
+	i, err := m.magazines.findOne(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	before := m.magazines.docs[i]
+	after, err := m.magazines.update(i, update)
+	if err != nil {
+		return nil, err
+	}
+	m.recordChange(before, after)
+	return decodeMagazine(after)
+}
+
+// checkVersion returns ErrVersionConflict if the live magazine with the
+// given id exists, and mongo.ErrNoDocuments otherwise. The caller holds mu.
+func (m *memoryMagazine) checkVersion(id primitive.ObjectID) error {
+	if _, err := m.magazines.findOne(bson.D{{Key: "_id", Value: id}, {Key: "deletedAt", Value: nil}}); err != nil {
+		return err
+	}
+	return ErrVersionConflict
+}
+
+// uniqueSlug is the in-memory counterpart of mongoMagazine.uniqueSlug. The
+// caller holds mu.
+func (m *memoryMagazine) uniqueSlug(title string, id primitive.ObjectID) (string, error) {
+	base, filter := slugQuery(title, id)
+	taken, err := m.find(filter, nil)
+	if err != nil {
+		return "", err
+	}
+	return freeSlug(base, taken), nil
+}
+
+func decodeMagazine(doc bson.Raw) (*Magazine, error) {
+	magazine := Magazine{}
+	if err := bson.Unmarshal(doc, &magazine); err != nil {
+		return nil, err
+	}
+	return &magazine, nil
+}
+
+// writeErrorMessage returns the message of the first write error of err,
+// as a BulkWrite reports it for a rejected import row.
+func writeErrorMessage(err error) string {
+	if writeErr, ok := err.(mongo.WriteException); ok && len(writeErr.WriteErrors) > 0 {
+		return writeErr.WriteErrors[0].Message
+	}
+	return err.Error()
+}
+
+// NewMemoryUserDB returns a UserDB that keeps users in memory, for tests and
+// demos that run without Mongo. Users without an id get one; two users with
+// the same id are a duplicate key error.
+func NewMemoryUserDB(users ...User) (UserDB, error) {
+	db := &memoryUser{users: memoryCollection{name: "users.authentication"}}
+	for _, user := range users {
+		if user.ID.IsZero() {
+			user.ID = primitive.NewObjectID()
+		}
+		if _, err := db.users.insert(user); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+var _ UserDB = &memoryUser{}
+
+type memoryUser struct {
+	mu    sync.Mutex
+	users memoryCollection
+}
+
+func (u *memoryUser) ByEmail(email string) (*User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	i, err := u.users.findOne(bson.M{"email": email})
+	if err != nil {
+		return nil, err
+	}
+	user := User{}
+	if err := bson.Unmarshal(u.users.docs[i], &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
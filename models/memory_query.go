@@ -0,0 +1,690 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memoryCollection is a list of documents in insertion order, which is the
+// order Mongo returns them in when no sort is given. It understands the
+// subset of the Mongo query and update language the models use, so that
+// the in-memory backends can run the same filters as the Mongo ones.
+type memoryCollection struct {
+	name string
+	docs []bson.Raw
+	// unique lists the paths of unique indexes besides _id. Like the
+	// partial slug index, they only cover string values.
+	unique []string
+}
+
+// find returns the positions of the documents matching filter.
+func (c *memoryCollection) find(filter interface{}) ([]int, error) {
+	found := []int{}
+	for i, doc := range c.docs {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, i)
+		}
+	}
+	return found, nil
+}
+
+// findOne returns the position of the first document matching filter, or
+// mongo.ErrNoDocuments.
+func (c *memoryCollection) findOne(filter interface{}) (int, error) {
+	found, err := c.find(filter)
+	if err != nil {
+		return 0, err
+	}
+	if len(found) == 0 {
+		return 0, mongo.ErrNoDocuments
+	}
+	return found[0], nil
+}
+
+// insert adds v as a new document, unless it collides with another one on
+// a unique key.
+func (c *memoryCollection) insert(v interface{}) (bson.Raw, error) {
+	doc, ok := v.(bson.Raw)
+	if !ok {
+		var err error
+		if doc, err = bson.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkUnique(doc, -1); err != nil {
+		return nil, err
+	}
+	c.docs = append(c.docs, doc)
+	return doc, nil
+}
+
+// update applies update to the document at position i and returns it as
+// it is stored afterwards.
+func (c *memoryCollection) update(i int, update bson.D) (bson.Raw, error) {
+	doc, err := applyUpdate(c.docs[i], update, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkUnique(doc, i); err != nil {
+		return nil, err
+	}
+	c.docs[i] = doc
+	return doc, nil
+}
+
+// deleteMany removes the documents matching filter and returns how many
+// there were.
+func (c *memoryCollection) deleteMany(filter interface{}) (int64, error) {
+	kept := c.docs[:0]
+	var deleted int64
+	for _, doc := range c.docs {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	c.docs = kept
+	return deleted, nil
+}
+
+// checkUnique returns the duplicate key error Mongo reports when doc, which
+// is to be stored at position self, shares a unique key with another
+// document.
+func (c *memoryCollection) checkUnique(doc bson.Raw, self int) error {
+	for _, path := range append([]string{"_id"}, c.unique...) {
+		value, err := doc.LookupErr(path)
+		if err != nil || (path != "_id" && value.Type != bsontype.String) {
+			continue
+		}
+		for i, other := range c.docs {
+			if i == self {
+				continue
+			}
+			if otherValue, err := other.LookupErr(path); err == nil && valuesEqual(value, otherValue) {
+				return mongo.WriteException{WriteErrors: []mongo.WriteError{{
+					Code:    11000,
+					Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s_1 dup key: { %s: %s }", c.name, path, path, value),
+				}}}
+			}
+		}
+	}
+	return nil
+}
+
+// decode decodes the documents at the positions found into v, which must
+// point to a slice.
+func (c *memoryCollection) decode(found []int, v interface{}) error {
+	docs := bson.A{}
+	for _, i := range found {
+		docs = append(docs, c.docs[i])
+	}
+	raw, err := bson.Marshal(bson.D{{Key: "docs", Value: docs}})
+	if err != nil {
+		return err
+	}
+	return bson.Raw(raw).Lookup("docs").Unmarshal(v)
+}
+
+// sortPositions orders the positions of documents by sort, a Mongo sort
+// specification.
+func (c *memoryCollection) sortPositions(found []int, sortSpec bson.D) {
+	sort.SliceStable(found, func(a, b int) bool {
+		for _, key := range sortSpec {
+			x, _ := lookupPath(c.docs[found[a]], key.Key)
+			y, _ := lookupPath(c.docs[found[b]], key.Key)
+			order := compareForSort(x, y)
+			if sortDirection(key.Value) < 0 {
+				order = -order
+			}
+			if order != 0 {
+				return order < 0
+			}
+		}
+		return false
+	})
+}
+
+func sortDirection(v interface{}) int {
+	switch d := v.(type) {
+	case int:
+		return d
+	case int32:
+		return int(d)
+	case int64:
+		return int(d)
+	default:
+		return 1
+	}
+}
+
+// matchDocument reports whether doc matches filter. Top-level conditions
+// may be combined with $and and $or; fields may be compared with $eq, $ne,
+// $gt, $gte, $lt, $lte, $in, $nin, $regex and $exists.
+func matchDocument(doc bson.Raw, filter interface{}) (bool, error) {
+	conditions, ok := toDocument(filter)
+	if !ok {
+		return false, fmt.Errorf("filter must be a document, not %T", filter)
+	}
+
+	for _, condition := range conditions {
+		var matched bool
+		var err error
+		switch condition.Key {
+		case "$and", "$or":
+			matched, err = matchClauses(doc, condition.Key, condition.Value)
+		default:
+			if strings.HasPrefix(condition.Key, "$") {
+				return false, fmt.Errorf("unsupported query operator %s", condition.Key)
+			}
+			matched, err = matchField(doc, condition.Key, condition.Value)
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchClauses(doc bson.Raw, operator string, clauses interface{}) (bool, error) {
+	list, ok := toArray(clauses)
+	if !ok || len(list) == 0 {
+		return false, fmt.Errorf("%s needs a non-empty array", operator)
+	}
+	for _, clause := range list {
+		matched, err := matchDocument(doc, clause)
+		if err != nil {
+			return false, err
+		}
+		if matched != (operator == "$and") {
+			return matched, nil
+		}
+	}
+	return operator == "$and", nil
+}
+
+// matchField matches the value at path against a condition, which is
+// either a document of operators or a value the field must equal.
+func matchField(doc bson.Raw, path string, condition interface{}) (bool, error) {
+	operators, ok := toDocument(condition)
+	if !ok || len(operators) == 0 || !strings.HasPrefix(operators[0].Key, "$") {
+		return matchOperator(doc, path, "$eq", condition, nil)
+	}
+
+	for _, op := range operators {
+		matched, err := matchOperator(doc, path, op.Key, op.Value, operators)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(doc bson.Raw, path, operator string, operand interface{}, operators bson.D) (bool, error) {
+	value, exists := lookupPath(doc, path)
+	// A condition on an array matches if one of its elements does.
+	candidates := []bson.RawValue{value}
+	if value.Type == bsontype.Array {
+		elements, _ := value.Array().Values()
+		candidates = append(candidates, elements...)
+	}
+
+	switch operator {
+	case "$eq":
+		return matchEqual(candidates, exists, operand)
+	case "$ne":
+		matched, err := matchEqual(candidates, exists, operand)
+		return !matched, err
+	case "$in", "$nin":
+		list, ok := toArray(operand)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", operator)
+		}
+		for _, item := range list {
+			matched, err := matchEqual(candidates, exists, item)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				return operator == "$in", nil
+			}
+		}
+		return operator == "$nin", nil
+	case "$gt", "$gte", "$lt", "$lte":
+		bound, err := toRawValue(operand)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+		for _, candidate := range candidates {
+			order, ok := compareValues(candidate, bound)
+			if !ok {
+				continue
+			}
+			if (operator == "$gt" && order > 0) || (operator == "$gte" && order >= 0) ||
+				(operator == "$lt" && order < 0) || (operator == "$lte" && order <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$regex":
+		pattern := primitive.Regex{}
+		switch p := operand.(type) {
+		case primitive.Regex:
+			pattern = p
+		case string:
+			pattern.Pattern = p
+		default:
+			return false, fmt.Errorf("$regex needs a string or regular expression")
+		}
+		for _, op := range operators {
+			if op.Key == "$options" {
+				pattern.Options, _ = op.Value.(string)
+			}
+		}
+		return matchEqual(candidates, exists, pattern)
+	case "$options":
+		// Read together with $regex.
+		return true, nil
+	case "$exists":
+		want, _ := operand.(bool)
+		return exists == want, nil
+	default:
+		return false, fmt.Errorf("unsupported query operator %s", operator)
+	}
+}
+
+// matchEqual reports whether one of candidates equals operand. A regular
+// expression matches the strings it matches, and null also matches a
+// missing field.
+func matchEqual(candidates []bson.RawValue, exists bool, operand interface{}) (bool, error) {
+	if pattern, ok := operand.(primitive.Regex); ok {
+		re, err := compileRegex(pattern)
+		if err != nil {
+			return false, err
+		}
+		for _, candidate := range candidates {
+			if s, ok := candidate.StringValueOK(); ok && re.MatchString(s) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	want, err := toRawValue(operand)
+	if err != nil {
+		return false, err
+	}
+	if want.Type == bsontype.Null && !exists {
+		return true, nil
+	}
+	for _, candidate := range candidates {
+		if exists && valuesEqual(candidate, want) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compileRegex translates a Mongo regular expression. The patterns the
+// models build only use syntax PCRE and RE2 share.
+func compileRegex(pattern primitive.Regex) (*regexp.Regexp, error) {
+	flags := ""
+	for _, option := range pattern.Options {
+		if strings.ContainsRune("ims", option) {
+			flags += string(option)
+		}
+	}
+	if flags != "" {
+		return regexp.Compile("(?" + flags + ")" + pattern.Pattern)
+	}
+	return regexp.Compile(pattern.Pattern)
+}
+
+// lookupPath returns the value at a dotted path of doc, or null if it has
+// none.
+func lookupPath(doc bson.Raw, path string) (bson.RawValue, bool) {
+	value, err := doc.LookupErr(strings.Split(path, ".")...)
+	if err != nil {
+		return bson.RawValue{Type: bsontype.Null}, false
+	}
+	return value, true
+}
+
+// toRawValue converts a Go value of a filter to its BSON form.
+func toRawValue(v interface{}) (bson.RawValue, error) {
+	switch value := v.(type) {
+	case nil:
+		return bson.RawValue{Type: bsontype.Null}, nil
+	case bson.RawValue:
+		return value, nil
+	}
+	t, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	return bson.RawValue{Type: t, Value: data}, nil
+}
+
+func toDocument(v interface{}) (bson.D, bool) {
+	switch doc := v.(type) {
+	case bson.D:
+		return doc, true
+	case bson.M:
+		d := bson.D{}
+		for key, value := range doc {
+			d = append(d, bson.E{Key: key, Value: value})
+		}
+		return d, true
+	case bson.Raw:
+		d := bson.D{}
+		return d, bson.Unmarshal(doc, &d) == nil
+	}
+	return nil, false
+}
+
+func toArray(v interface{}) ([]interface{}, bool) {
+	switch list := v.(type) {
+	case bson.A:
+		return list, true
+	case []interface{}:
+		return list, true
+	case []bson.D:
+		items := make([]interface{}, len(list))
+		for i, item := range list {
+			items[i] = item
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+// valuesEqual compares two BSON values the way Mongo does for equality:
+// numbers by value, whatever their type, and everything else by type and
+// bytes.
+func valuesEqual(a, b bson.RawValue) bool {
+	if order, ok := compareNumbers(a, b); ok {
+		return order == 0
+	}
+	return a.Type == b.Type && bytes.Equal(a.Value, b.Value)
+}
+
+// compareValues orders two values of the same kind, as the range
+// operators do. It returns false for values that cannot be compared, which
+// range operators never match.
+func compareValues(a, b bson.RawValue) (int, bool) {
+	if order, ok := compareNumbers(a, b); ok {
+		return order, true
+	}
+	if a.Type != b.Type {
+		return 0, false
+	}
+	switch a.Type {
+	case bsontype.String:
+		return strings.Compare(a.StringValue(), b.StringValue()), true
+	case bsontype.ObjectID:
+		x, y := a.ObjectID(), b.ObjectID()
+		return bytes.Compare(x[:], y[:]), true
+	case bsontype.DateTime:
+		return compareInts(a.DateTime(), b.DateTime()), true
+	case bsontype.Boolean:
+		x, y := 0, 0
+		if a.Boolean() {
+			x = 1
+		}
+		if b.Boolean() {
+			y = 1
+		}
+		return compareInts(int64(x), int64(y)), true
+	case bsontype.Null:
+		return 0, true
+	}
+	return 0, false
+}
+
+// compareForSort orders any two values, first by Mongo's order of BSON
+// types and then by value.
+func compareForSort(a, b bson.RawValue) int {
+	if x, y := typeOrder(a.Type), typeOrder(b.Type); x != y {
+		return compareInts(int64(x), int64(y))
+	}
+	if order, ok := compareValues(a, b); ok {
+		return order
+	}
+	return bytes.Compare(a.Value, b.Value)
+}
+
+func typeOrder(t bsontype.Type) int {
+	switch t {
+	case bsontype.Null, bsontype.Undefined:
+		return 1
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return 2
+	case bsontype.String, bsontype.Symbol:
+		return 3
+	case bsontype.EmbeddedDocument:
+		return 4
+	case bsontype.Array:
+		return 5
+	case bsontype.Binary:
+		return 6
+	case bsontype.ObjectID:
+		return 7
+	case bsontype.Boolean:
+		return 8
+	case bsontype.DateTime:
+		return 9
+	case bsontype.Timestamp:
+		return 10
+	case bsontype.Regex:
+		return 11
+	}
+	return 12
+}
+
+func compareNumbers(a, b bson.RawValue) (int, bool) {
+	x, ok := ratValue(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := ratValue(b)
+	if !ok {
+		return 0, false
+	}
+	return x.Cmp(y), true
+}
+
+// ratValue returns the exact value of a BSON number.
+func ratValue(v bson.RawValue) (*big.Rat, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return new(big.Rat).SetInt64(int64(v.Int32())), true
+	case bsontype.Int64:
+		return new(big.Rat).SetInt64(v.Int64()), true
+	case bsontype.Double:
+		r := new(big.Rat)
+		if r.SetFloat64(v.Double()) == nil {
+			return nil, false
+		}
+		return r, true
+	case bsontype.Decimal128:
+		return decimalRat(v.Decimal128())
+	}
+	return nil, false
+}
+
+// decimalRat returns the exact value of d, which is false for NaN and the
+// infinities.
+func decimalRat(d primitive.Decimal128) (*big.Rat, bool) {
+	coefficient, exponent, err := d.BigInt()
+	if err != nil {
+		return nil, false
+	}
+	r := new(big.Rat).SetInt(coefficient)
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(exponent))), nil)
+	if exponent < 0 {
+		return r.Quo(r, new(big.Rat).SetInt(scale)), true
+	}
+	return r.Mul(r, new(big.Rat).SetInt(scale)), true
+}
+
+// ratDecimal rounds r to the 34 significant digits of a Decimal128.
+func ratDecimal(r *big.Rat) primitive.Decimal128 {
+	text := new(big.Float).SetPrec(256).SetRat(r).Text('g', 34)
+	d, _ := primitive.ParseDecimal128(text)
+	return d
+}
+
+func compareInts(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// applyUpdate returns doc with update applied. $set, $unset, $inc and
+// $setOnInsert are supported on top-level fields; $setOnInsert only has an
+// effect when inserting.
+func applyUpdate(doc bson.Raw, update bson.D, inserting bool) (bson.Raw, error) {
+	fields := bson.D{}
+	if doc != nil {
+		if err := bson.Unmarshal(doc, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, op := range update {
+		changes, err := updateFields(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op.Key, err)
+		}
+		for _, change := range changes {
+			if strings.Contains(change.Key, ".") {
+				return nil, fmt.Errorf("%s: nested field %q is not supported", op.Key, change.Key)
+			}
+			switch op.Key {
+			case "$set":
+				fields = setField(fields, change.Key, change.Value)
+			case "$setOnInsert":
+				if inserting {
+					fields = setField(fields, change.Key, change.Value)
+				}
+			case "$unset":
+				fields = unsetField(fields, change.Key)
+			case "$inc":
+				current, _ := fieldValue(fields, change.Key)
+				sum, err := increment(current, change.Value)
+				if err != nil {
+					return nil, fmt.Errorf("$inc %s: %w", change.Key, err)
+				}
+				fields = setField(fields, change.Key, sum)
+			default:
+				return nil, fmt.Errorf("unsupported update operator %s", op.Key)
+			}
+		}
+	}
+
+	return bson.Marshal(fields)
+}
+
+// updateFields returns the fields of an update operator, which may be
+// given as a document or, for $set, as a struct.
+func updateFields(v interface{}) (bson.D, error) {
+	if doc, ok := toDocument(v); ok {
+		return doc, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.D{}
+	return doc, bson.Unmarshal(raw, &doc)
+}
+
+func fieldValue(fields bson.D, key string) (interface{}, bool) {
+	for _, field := range fields {
+		if field.Key == key {
+			return field.Value, true
+		}
+	}
+	return nil, false
+}
+
+func setField(fields bson.D, key string, value interface{}) bson.D {
+	for i := range fields {
+		if fields[i].Key == key {
+			fields[i].Value = value
+			return fields
+		}
+	}
+	return append(fields, bson.E{Key: key, Value: value})
+}
+
+func unsetField(fields bson.D, key string) bson.D {
+	for i := range fields {
+		if fields[i].Key == key {
+			return append(fields[:i], fields[i+1:]...)
+		}
+	}
+	return fields
+}
+
+// increment adds two integers. Like Mongo, it keeps 32 bits unless one of
+// them is a 64-bit integer.
+func increment(current, by interface{}) (interface{}, error) {
+	x, wide, err := integer(current)
+	if err != nil {
+		return nil, err
+	}
+	y, wideBy, err := integer(by)
+	if err != nil {
+		return nil, err
+	}
+	if wide || wideBy {
+		return x + y, nil
+	}
+	return int32(x + y), nil
+}
+
+func integer(v interface{}) (int64, bool, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, false, nil
+	case int:
+		return int64(n), false, nil
+	case int32:
+		return int64(n), false, nil
+	case int64:
+		return n, true, nil
+	}
+	return 0, false, fmt.Errorf("cannot increment a %T", v)
+}
@@ -0,0 +1,355 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Search ranks the magazines like the text backend with the default
+// search fields: magazines with a whole word of the term in a searched
+// field come first, scored by the weights of the fields they matched in,
+// followed by the magazines with a word starting with the term in an
+// autocomplete field.
+func (m *memoryMagazine) Search(opts SearchOptions) (*SearchResult, error) {
+	opts, err := searchDefaults(opts)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := DefaultSearchFields.selected(opts.Field)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	candidates, err := m.find(query.And(live, opts.Filter), nil)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	words := map[string]bool{}
+	for _, word := range termWords(opts.Term) {
+		words[word] = true
+	}
+	wordStart := regexp.MustCompile(`(?i)(^|\s)` + regexp.QuoteMeta(opts.Term))
+
+	ranked := []SearchHit{}
+	prefixed := []SearchHit{}
+	for _, magazine := range candidates {
+		var score float64
+		for _, field := range fields {
+			for _, word := range termWords(searchableText[field](&magazine)) {
+				if words[word] {
+					score += float64(DefaultSearchFields[field].Weight)
+				}
+			}
+		}
+		if score > 0 {
+			ranked = append(ranked, SearchHit{Magazine: magazine, Score: score})
+			continue
+		}
+		for _, field := range fields {
+			if DefaultSearchFields[field].Autocomplete && wordStart.MatchString(searchableText[field](&magazine)) {
+				prefixed = append(prefixed, SearchHit{Magazine: magazine})
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].ID.Hex() < ranked[j].ID.Hex()
+	})
+	sort.SliceStable(prefixed, func(i, j int) bool {
+		for _, field := range fields {
+			if !DefaultSearchFields[field].Autocomplete {
+				continue
+			}
+			x, y := searchableText[field](&prefixed[i].Magazine), searchableText[field](&prefixed[j].Magazine)
+			if x != y {
+				return x < y
+			}
+		}
+		return prefixed[i].ID.Hex() < prefixed[j].ID.Hex()
+	})
+	hits := append(ranked, prefixed...)
+
+	result := &SearchResult{
+		Hits:   []SearchHit{},
+		Total:  int64(len(hits)),
+		Limit:  opts.Limit,
+		Offset: opts.Offset,
+	}
+	for i := opts.Offset; i < int64(len(hits)) && i < opts.Offset+opts.Limit; i++ {
+		hit := hits[i]
+		hit.Highlights = highlights(fields, &hit.Magazine, opts.Term)
+		result.Hits = append(result.Hits, hit)
+	}
+
+	result.Facets, err = memoryFacets(hits)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// termWords splits text into lower-case words.
+func termWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+// memoryFacets counts the facets of hits the way facetStage does.
+func memoryFacets(hits []SearchHit) (map[string][]FacetBucket, error) {
+	raw := map[string][]rawFacetBucket{}
+	for _, f := range searchFacets {
+		counts := map[string]int64{}
+		values := map[string]bson.RawValue{}
+		for _, hit := range hits {
+			doc, err := bson.Marshal(hit.Magazine)
+			if err != nil {
+				return nil, err
+			}
+			value, ok := lookupPath(doc, f.path)
+			if !ok || (value.Type == bsontype.String && value.StringValue() == "") {
+				continue
+			}
+			if f.boundaries != nil {
+				if value, ok = facetBoundary(f.boundaries, value); !ok {
+					continue
+				}
+			}
+			key := value.String()
+			counts[key]++
+			values[key] = value
+		}
+		for key, count := range counts {
+			raw[f.name] = append(raw[f.name], rawFacetBucket{ID: values[key], Count: count})
+		}
+	}
+	return facetResults(raw)
+}
+
+// facetBoundary returns the lower boundary of the range value falls in.
+func facetBoundary(boundaries []string, value bson.RawValue) (bson.RawValue, bool) {
+	for i := 0; i < len(boundaries)-1; i++ {
+		from, _ := primitive.ParseDecimal128(boundaries[i])
+		to, _ := primitive.ParseDecimal128(boundaries[i+1])
+		lower, _ := toRawValue(from)
+		upper, _ := toRawValue(to)
+		above, ok := compareNumbers(value, lower)
+		below, _ := compareNumbers(value, upper)
+		if ok && above >= 0 && below < 0 {
+			return lower, true
+		}
+	}
+	return bson.RawValue{}, false
+}
+
+// pricedGroup is the prices of one group of magazines, in ascending order.
+type pricedGroup struct {
+	key    bson.RawValue
+	prices []*big.Rat
+	// decimals holds the prices as they are stored.
+	decimals []primitive.Decimal128
+}
+
+// pricedGroups collects the prices of the live magazines matching filter,
+// grouped by the value at groupBy, in group order.
+func (m *memoryMagazine) pricedGroups(filter bson.D, groupBy string) ([]*pricedGroup, error) {
+	m.mu.Lock()
+	found, err := m.magazines.find(query.And(filter, live))
+	docs := make([]bson.Raw, len(found))
+	for i, position := range found {
+		docs[i] = m.magazines.docs[position]
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := map[string]*pricedGroup{}
+	groups := []*pricedGroup{}
+	for _, doc := range docs {
+		price, ok := lookupPath(doc, "price")
+		amount, isNumber := ratValue(price)
+		if !ok || !isNumber {
+			continue
+		}
+		key := bson.RawValue{Type: bsontype.Null}
+		if groupBy != "" {
+			key, _ = lookupPath(doc, groupBy)
+		}
+		group, ok := byKey[key.String()]
+		if !ok {
+			group = &pricedGroup{key: key}
+			byKey[key.String()] = group
+			groups = append(groups, group)
+		}
+		decimal, ok := price.Decimal128OK()
+		if !ok {
+			decimal = ratDecimal(amount)
+		}
+		group.prices = append(group.prices, amount)
+		group.decimals = append(group.decimals, decimal)
+	}
+
+	for _, group := range groups {
+		sort.Sort(byPrice(*group))
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return compareForSort(groups[i].key, groups[j].key) < 0
+	})
+	return groups, nil
+}
+
+// byPrice sorts the prices of a group together with their decimal form.
+type byPrice pricedGroup
+
+func (g byPrice) Len() int           { return len(g.prices) }
+func (g byPrice) Less(i, j int) bool { return g.prices[i].Cmp(g.prices[j]) < 0 }
+func (g byPrice) Swap(i, j int) {
+	g.prices[i], g.prices[j] = g.prices[j], g.prices[i]
+	g.decimals[i], g.decimals[j] = g.decimals[j], g.decimals[i]
+}
+
+// groupValue decodes the key of a group for PriceStats and PriceHistogram.
+func groupValue(key bson.RawValue) (interface{}, error) {
+	if key.Type == bsontype.Null {
+		return nil, nil
+	}
+	var value interface{}
+	err := key.Unmarshal(&value)
+	return value, err
+}
+
+func (m *memoryMagazine) PriceStats(opts AggregateOptions) ([]PriceStats, error) {
+	groups, err := m.pricedGroups(opts.Filter, opts.GroupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []PriceStats{}
+	for _, group := range groups {
+		value, err := groupValue(group.key)
+		if err != nil {
+			return nil, err
+		}
+
+		count := len(group.prices)
+		sum := new(big.Rat)
+		for _, price := range group.prices {
+			sum.Add(sum, price)
+		}
+		median := group.prices[count/2]
+		if count%2 == 0 {
+			median = new(big.Rat).Add(group.prices[count/2-1], median)
+			median.Quo(median, big.NewRat(2, 1))
+		}
+
+		stats = append(stats, PriceStats{
+			Group:  value,
+			Count:  int64(count),
+			Min:    group.decimals[0],
+			Max:    group.decimals[count-1],
+			Avg:    ratDecimal(sum.Quo(sum, big.NewRat(int64(count), 1))),
+			Median: ratDecimal(median),
+		})
+	}
+	return stats, nil
+}
+
+// PriceHistogram counts the prices in fixed boundaries like $bucket. Buckets
+// Mongo picks itself are approximated by filling each with an equal share
+// of the prices, keeping equal prices together.
+func (m *memoryMagazine) PriceHistogram(opts HistogramOptions) ([]PriceHistogram, error) {
+	groups, err := m.pricedGroups(opts.Filter, opts.GroupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.GroupBy == "" {
+		buckets := []PriceBucket{}
+		if len(groups) > 0 {
+			buckets = memoryBuckets(opts, groups[0])
+		} else if len(opts.Boundaries) > 0 {
+			buckets = memoryBuckets(opts, &pricedGroup{})
+		}
+		return []PriceHistogram{{Buckets: buckets}}, nil
+	}
+
+	// Like a distinct, only magazines that have the field form groups.
+	present := groups[:0]
+	for _, group := range groups {
+		if group.key.Type != bsontype.Null {
+			present = append(present, group)
+		}
+	}
+	if len(present) > maxHistogramGroups {
+		return nil, &query.Error{Param: "groupBy", Message: fmt.Sprintf("splits the histogram into more than %d groups", maxHistogramGroups)}
+	}
+
+	histograms := make([]PriceHistogram, 0, len(present))
+	for _, group := range present {
+		value, err := groupValue(group.key)
+		if err != nil {
+			return nil, err
+		}
+		histograms = append(histograms, PriceHistogram{Group: value, Buckets: memoryBuckets(opts, group)})
+	}
+	return histograms, nil
+}
+
+func memoryBuckets(opts HistogramOptions, group *pricedGroup) []PriceBucket {
+	buckets := []PriceBucket{}
+
+	if len(opts.Boundaries) > 0 {
+		for i := 0; i < len(opts.Boundaries)-1; i++ {
+			lower, _ := decimalRat(opts.Boundaries[i])
+			upper, _ := decimalRat(opts.Boundaries[i+1])
+			bucket := PriceBucket{Min: opts.Boundaries[i], Max: opts.Boundaries[i+1]}
+			for _, price := range group.prices {
+				if price.Cmp(lower) >= 0 && price.Cmp(upper) < 0 {
+					bucket.Count++
+				}
+			}
+			buckets = append(buckets, bucket)
+		}
+		return buckets
+	}
+
+	count := len(group.prices)
+	if count == 0 || opts.Buckets <= 0 {
+		return buckets
+	}
+	size := (count + opts.Buckets - 1) / opts.Buckets
+	for start := 0; start < count; {
+		end := start + size
+		if end > count || len(buckets) == opts.Buckets-1 {
+			end = count
+		}
+		for end < count && group.prices[end].Cmp(group.prices[end-1]) == 0 {
+			end++
+		}
+		bucket := PriceBucket{Min: group.decimals[start], Count: int64(end - start)}
+		if end < count {
+			bucket.Max = group.decimals[end]
+		} else {
+			bucket.Max = group.decimals[count-1]
+		}
+		buckets = append(buckets, bucket)
+		start = end
+	}
+	return buckets
+}
@@ -0,0 +1,281 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Magazine lifecycle events.
+const (
+	EventMagazineCreated = "magazine.created"
+	EventMagazineUpdated = "magazine.updated"
+	// EventMagazineDeleted is recorded when a magazine is moved to the
+	// trash.
+	EventMagazineDeleted = "magazine.deleted"
+	// EventMagazineRestored is recorded when a magazine is taken back out
+	// of the trash, with the same id it was deleted with.
+	EventMagazineRestored = "magazine.restored"
+)
+
+const (
+	outboxCollection  = "outbox"
+	counterCollection = "counters"
+	leaseCollection   = "leases"
+	// outboxLease is how long a dispatcher may publish before it has to
+	// renew its lease. Another instance takes over once it runs out.
+	outboxLease = 30 * time.Second
+	// outboxRetention is how long published events are kept.
+	outboxRetention = 7 * 24 * time.Hour
+	// outboxBatch is the number of pending events read at a time.
+	outboxBatch = 100
+	// codeIllegalOperation is returned by servers that cannot run
+	// transactions.
+	codeIllegalOperation = 20
+)
+
+// MagazineEvent records one write of a magazine. Seq orders the events in
+// the order their writes committed.
+type MagazineEvent struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Seq         int64              `bson:"seq,omitempty" json:"-"`
+	Type        string             `bson:"type" json:"type"`
+	Time        time.Time          `bson:"time" json:"time"`
+	Magazine    *Magazine          `bson:"magazine" json:"magazine"`
+	PublishedAt *time.Time         `bson:"publishedAt,omitempty" json:"-"`
+}
+
+// EventPublisher passes magazine events on. Publish may be called more than
+// once for the same event, so it must be idempotent by event ID.
+type EventPublisher interface {
+	Publish(ctx context.Context, event MagazineEvent) error
+}
+
+// Outbox holds the events of magazine writes until they are published.
+// Writes record their event in the same transaction as the change itself,
+// so no event is lost if the process dies in between.
+type Outbox interface {
+	// Dispatch publishes the pending events in order while it holds the
+	// outbox lease, and returns how many it published. It stops at the
+	// first event that fails to publish; that event is retried on the
+	// next call, before any later one.
+	Dispatch(ctx context.Context, publisher EventPublisher) (int, error)
+}
+
+func NewOutbox(db *mongo.Client) Outbox {
+	return newOutbox(db, "")
+}
+
+// newOutbox returns the outbox kept in the named database, see
+// libraryDatabase.
+func newOutbox(db *mongo.Client, database string) *mongoOutbox {
+	owner := make([]byte, 12)
+	rand.Read(owner)
+	return &mongoOutbox{db: db, database: database, owner: hex.EncodeToString(owner)}
+}
+
+var _ Outbox = &mongoOutbox{}
+
+type mongoOutbox struct {
+	environment
+	db       *mongo.Client
+	database string
+	// owner identifies this instance in the lease.
+	owner string
+
+	mu      sync.Mutex
+	indexed bool
+}
+
+func (o *mongoOutbox) collection(name string) *mongo.Collection {
+	return libraryDatabase(o.db, o.database).Collection(name)
+}
+
+func (o *mongoOutbox) Dispatch(ctx context.Context, publisher EventPublisher) (int, error) {
+	if err := o.ensureIndexes(ctx); err != nil {
+		return 0, err
+	}
+
+	db := o.collection(outboxCollection)
+	pending := bson.D{{Key: "publishedAt", Value: nil}}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(outboxBatch)
+
+	published := 0
+	for ctx.Err() == nil {
+		cursor, err := db.Find(ctx, pending, opts)
+		if err != nil {
+			return published, err
+		}
+		events := []MagazineEvent{}
+		if err := cursor.All(ctx, &events); err != nil {
+			return published, err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			// Renewing the lease before every event keeps two instances
+			// from publishing at once, which would break the order.
+			if held, err := o.acquire(ctx); !held {
+				return published, err
+			}
+			if err := publisher.Publish(ctx, event); err != nil {
+				return published, fmt.Errorf("publishing event %s: %w", event.ID.Hex(), err)
+			}
+			update := bson.D{{Key: "$set", Value: bson.D{{Key: "publishedAt", Value: o.now()}}}}
+			if _, err := db.UpdateByID(ctx, event.ID, update); err != nil {
+				return published, err
+			}
+			published++
+		}
+	}
+	return published, nil
+}
+
+// acquire takes or renews the outbox lease and reports whether this
+// instance holds it.
+func (o *mongoOutbox) acquire(ctx context.Context) (bool, error) {
+	db := o.collection(leaseCollection)
+
+	acquired := o.now()
+	filter := bson.D{
+		{Key: "_id", Value: outboxCollection},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "owner", Value: o.owner}},
+			bson.D{{Key: "lockedUntil", Value: bson.D{{Key: "$lt", Value: acquired}}}},
+		}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "owner", Value: o.owner},
+		{Key: "lockedUntil", Value: acquired.Add(outboxLease)},
+	}}}
+
+	// When another instance holds the lease, nothing matches and the upsert
+	// collides with its lease document.
+	_, err := db.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ensureIndexes creates the index pending events are read by and expires
+// published events after outboxRetention. It is retried on the next call if
+// it fails.
+func (o *mongoOutbox) ensureIndexes(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.indexed {
+		return nil
+	}
+
+	db := o.collection(outboxCollection)
+	_, err := db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "publishedAt", Value: 1}, {Key: "seq", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "publishedAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(outboxRetention.Seconds())),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	o.indexed = true
+	return nil
+}
+
+// DispatchOutbox publishes the events of the outbox to the webhooks once
+// every interval until ctx is done.
+func (s *Services) DispatchOutbox(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Outbox.Dispatch(ctx, s.Webhook); err != nil && ctx.Err() == nil {
+			s.env.logf("dispatching outbox events failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordEvent adds the event of a magazine write to the outbox. Called
+// inside the write's transaction, it takes the next sequence number there
+// too, which makes concurrent writes commit in sequence order.
+func (mM *mongoMagazine) recordEvent(ctx context.Context, eventType string, magazine *Magazine) error {
+	counters := mM.collection(counterCollection)
+	counter := struct {
+		Seq int64 `bson:"seq"`
+	}{}
+	err := counters.FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: outboxCollection}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: 1}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return err
+	}
+
+	event := MagazineEvent{
+		ID:       primitive.NewObjectID(),
+		Seq:      counter.Seq,
+		Type:     eventType,
+		Time:     mM.now(),
+		Magazine: magazine,
+	}
+	_, err = mM.collection(outboxCollection).InsertOne(ctx, event)
+	return err
+}
+
+// transact runs fn in a transaction, which is retried on transient errors.
+// A server that cannot run transactions, such as a standalone one used in
+// development, runs fn without one; a write and its event are then not
+// atomic.
+func (mM *mongoMagazine) transact(fn func(ctx context.Context) error) error {
+	if mM.noTransactions.Load() {
+		return fn(context.Background())
+	}
+
+	session, err := mM.db.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(context.Background(), func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	if transactionsUnsupported(err) {
+		if !mM.noTransactions.Swap(true) {
+			mM.logf("the database does not support transactions, magazine events are recorded without them: %v", err)
+		}
+		return fn(context.Background())
+	}
+	return err
+}
+
+// transactionsUnsupported reports whether err is the error a standalone
+// server answers the first command of a transaction with.
+func transactionsUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) &&
+		serverErr.HasErrorCode(codeIllegalOperation) &&
+		strings.Contains(err.Error(), "Transaction numbers")
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestTransactionsUnsupported(t *testing.T) {
+	standalone := mongo.CommandError{Code: codeIllegalOperation, Message: "Transaction numbers are only allowed on a replica set member or mongos"}
+	if !transactionsUnsupported(fmt.Errorf("insert: %w", standalone)) {
+		t.Error("the standalone server error was not recognised")
+	}
+
+	other := []error{
+		mongo.CommandError{Code: codeIllegalOperation, Message: "cannot run on a view"},
+		mongo.CommandError{Code: 11000, Message: "duplicate key"},
+		errors.New("Transaction numbers"),
+	}
+	for _, err := range other {
+		if transactionsUnsupported(err) {
+			t.Errorf("transactionsUnsupported(%v) = true", err)
+		}
+	}
+}
+
+// publishedTypes records the types of the events it publishes.
+type publishedTypes []string
+
+func (p *publishedTypes) Publish(ctx context.Context, event MagazineEvent) error {
+	*p = append(*p, event.Type)
+	return nil
+}
+
+func TestOutboxDispatchesFromServicesDatabase(t *testing.T) {
+	client := testMongoClient(t)
+	if client == nil {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	services, err := newServices(client, testDatabase(t, client), SearchConfig{Backend: SearchText}, CacheConfig{Size: 10, TTL: time.Minute}, environment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := services.Magazine.Create(Magazine{Title: "Wired", Price: decimal(t, "5.99")}); err != nil {
+		t.Fatal(err)
+	}
+	published := publishedTypes{}
+	if _, err := services.Outbox.Dispatch(context.Background(), &published); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || published[0] != EventMagazineCreated {
+		t.Errorf("published %v, want one %s event", published, EventMagazineCreated)
+	}
+}
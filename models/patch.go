@@ -0,0 +1,242 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var (
+	ErrInvalidPatch    = errors.New("patch document is invalid")
+	ErrPatchTestFailed = errors.New("patch test operation failed")
+)
+
+// magazinePatchFields maps the JSON names of the magazine fields a client
+// may patch to their names in Mongo.
+var magazinePatchFields = map[string]string{
+	"title":           "title",
+	"price":           "price",
+	"category":        "category",
+	"publisher":       "publisher",
+	"publicationYear": "publicationYear",
+}
+
+// MagazinePatch is a partial update of a magazine. Only the fields in Set
+// and Unset are written. Test holds field values the stored document must
+// have for the patch to be applied, and a non-zero Version the version it
+// must be at.
+type MagazinePatch struct {
+	Test    bson.D
+	Set     bson.D
+	Unset   []string
+	Version int64
+}
+
+// IsEmpty reports whether the patch changes no fields.
+func (p *MagazinePatch) IsEmpty() bool {
+	return len(p.Set) == 0 && len(p.Unset) == 0
+}
+
+// patchedTitle returns the new title set by the patch, if it sets one.
+func patchedTitle(patch MagazinePatch) (string, bool) {
+	for _, e := range patch.Set {
+		if e.Key != "title" {
+			continue
+		}
+		if value, ok := e.Value.(bson.RawValue); ok {
+			return value.StringValueOK()
+		}
+		title, ok := e.Value.(string)
+		return title, ok
+	}
+	return "", false
+}
+
+// ParseMergePatch translates an RFC 7396 JSON Merge Patch document. Members
+// set to null are removed from the magazine, every other member replaces the
+// stored value.
+func ParseMergePatch(data []byte) (*MagazinePatch, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	changes := newPatchBuilder()
+	for name, value := range doc {
+		if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			if err := changes.remove(name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := changes.replace(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes.build(), nil
+}
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+	From  string          `json:"from,omitempty"`
+}
+
+// ParseJSONPatch translates an RFC 6902 JSON Patch document. The add,
+// replace, remove and test operations are supported on top-level magazine
+// fields; test operations are checked atomically by the update filter.
+func ParseJSONPatch(data []byte) (*MagazinePatch, error) {
+	var operations []jsonPatchOperation
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&operations); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	changes := newPatchBuilder()
+	for i, operation := range operations {
+		name, err := pointerField(operation.Path)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+
+		switch operation.Op {
+		case "add", "replace":
+			err = changes.replace(name, operation.Value)
+		case "remove":
+			err = changes.remove(name)
+		case "test":
+			err = changes.test(name, operation.Value)
+		default:
+			err = fmt.Errorf("%w: unsupported operation %q", ErrInvalidPatch, operation.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+
+	return changes.build(), nil
+}
+
+// pointerField returns the field named by a JSON Pointer to a top-level
+// member such as "/title".
+func pointerField(pointer string) (string, error) {
+	if !strings.HasPrefix(pointer, "/") || strings.Count(pointer, "/") != 1 {
+		return "", fmt.Errorf("%w: path %q must point at a top-level field", ErrInvalidPatch, pointer)
+	}
+
+	name := strings.NewReplacer("~1", "/", "~0", "~").Replace(pointer[1:])
+	return name, nil
+}
+
+// patchBuilder collects field changes in order. A later change to the same
+// field replaces an earlier one.
+type patchBuilder struct {
+	fields  []string
+	changes map[string]interface{}
+	tests   bson.D
+}
+
+// unset marks a field that is removed rather than set.
+type unset struct{}
+
+func newPatchBuilder() *patchBuilder {
+	return &patchBuilder{changes: map[string]interface{}{}}
+}
+
+func (b *patchBuilder) replace(name string, value json.RawMessage) error {
+	field, converted, err := magazineFieldValue(name, value)
+	if err != nil {
+		return err
+	}
+	if converted == nil {
+		b.set(field, unset{})
+		return nil
+	}
+	b.set(field, converted)
+	return nil
+}
+
+func (b *patchBuilder) remove(name string) error {
+	field, ok := magazinePatchFields[name]
+	if !ok {
+		return fmt.Errorf("%w: field %q cannot be patched", ErrInvalidPatch, name)
+	}
+	b.set(field, unset{})
+	return nil
+}
+
+func (b *patchBuilder) test(name string, value json.RawMessage) error {
+	field, converted, err := magazineFieldValue(name, value)
+	if err != nil {
+		return err
+	}
+	b.tests = append(b.tests, bson.E{Key: field, Value: converted})
+	return nil
+}
+
+func (b *patchBuilder) set(field string, value interface{}) {
+	if _, ok := b.changes[field]; !ok {
+		b.fields = append(b.fields, field)
+	}
+	b.changes[field] = value
+}
+
+func (b *patchBuilder) build() *MagazinePatch {
+	patch := &MagazinePatch{Test: b.tests}
+	for _, field := range b.fields {
+		value := b.changes[field]
+		if _, ok := value.(unset); ok {
+			patch.Unset = append(patch.Unset, field)
+			continue
+		}
+		patch.Set = append(patch.Set, bson.E{Key: field, Value: value})
+	}
+	return patch
+}
+
+// magazineFieldValue decodes a JSON value for the named magazine field and
+// returns the field's Mongo name together with the value as it would be
+// stored, or nil if an empty value would not be stored at all. Decoding
+// through Magazine keeps the types identical to a full write.
+func magazineFieldValue(name string, value json.RawMessage) (string, interface{}, error) {
+	field, ok := magazinePatchFields[name]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: field %q cannot be patched", ErrInvalidPatch, name)
+	}
+	if len(value) == 0 {
+		return "", nil, fmt.Errorf("%w: field %q is missing a value", ErrInvalidPatch, name)
+	}
+
+	doc, err := json.Marshal(map[string]json.RawMessage{name: value})
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	var magazine Magazine
+	if err := json.Unmarshal(doc, &magazine); err != nil {
+		return "", nil, fmt.Errorf("%w: field %q: %v", ErrInvalidPatch, name, err)
+	}
+
+	raw, err := bson.Marshal(magazine)
+	if err != nil {
+		return "", nil, err
+	}
+	stored, err := bson.Raw(raw).LookupErr(field)
+	if errors.Is(err, bsoncore.ErrElementNotFound) {
+		// Optional fields are not stored when empty.
+		return field, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return field, stored, nil
+}
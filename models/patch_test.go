@@ -0,0 +1,75 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseMergePatch(t *testing.T) {
+	patch, err := ParseMergePatch([]byte(`{"title": "Wired 2024", "price": null}`))
+	if err != nil {
+		t.Fatalf("ParseMergePatch() error = %v", err)
+	}
+
+	if len(patch.Set) != 1 || patch.Set[0].Key != "title" {
+		t.Fatalf("Set = %v, want only title", patch.Set)
+	}
+	if got := patch.Set[0].Value.(bson.RawValue).StringValue(); got != "Wired 2024" {
+		t.Errorf("title = %q, want %q", got, "Wired 2024")
+	}
+	if !reflect.DeepEqual(patch.Unset, []string{"price"}) {
+		t.Errorf("Unset = %v, want [price]", patch.Unset)
+	}
+}
+
+func TestParseMergePatchClearsEmptyOptionalField(t *testing.T) {
+	patch, err := ParseMergePatch([]byte(`{"category": ""}`))
+	if err != nil {
+		t.Fatalf("ParseMergePatch() error = %v", err)
+	}
+	if len(patch.Set) != 0 || !reflect.DeepEqual(patch.Unset, []string{"category"}) {
+		t.Errorf("patch = %+v, want category unset", patch)
+	}
+}
+
+func TestParseJSONPatch(t *testing.T) {
+	patch, err := ParseJSONPatch([]byte(`[
+		{"op": "test", "path": "/title", "value": "Wired"},
+		{"op": "remove", "path": "/title"},
+		{"op": "replace", "path": "/title", "value": "Wired 2024"},
+		{"op": "add", "path": "/price", "value": "4.50"}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseJSONPatch() error = %v", err)
+	}
+
+	if len(patch.Test) != 1 || patch.Test[0].Key != "title" {
+		t.Errorf("Test = %v, want a test on title", patch.Test)
+	}
+	if len(patch.Set) != 2 || patch.Set[0].Key != "title" || patch.Set[1].Key != "price" {
+		t.Errorf("Set = %v, want title and price", patch.Set)
+	}
+	if len(patch.Unset) != 0 {
+		t.Errorf("Unset = %v, want none", patch.Unset)
+	}
+}
+
+func TestParsePatchRejects(t *testing.T) {
+	tests := map[string]func([]byte) (*MagazinePatch, error){
+		`{"id": "5f0c7d1e2a4b3c0012345678"}`:                  ParseMergePatch,
+		`{"price": "cheap"}`:                                  ParseMergePatch,
+		`{"$set": {"title": "x"}}`:                            ParseMergePatch,
+		`[{"op": "move", "from": "/title", "path": "/x"}]`:    ParseJSONPatch,
+		`[{"op": "replace", "path": "/title/0", "value": 1}]`: ParseJSONPatch,
+		`[{"op": "replace", "path": "/title"}]`:               ParseJSONPatch,
+	}
+
+	for doc, parse := range tests {
+		if _, err := parse([]byte(doc)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("parse(%s) error = %v, want ErrInvalidPatch", doc, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Search backends that can be selected with NewSearcher.
+const (
+	// SearchAtlas uses the Atlas Search index magazine_title, which only
+	// exists on MongoDB Atlas.
+	SearchAtlas = "atlas"
+	// SearchText uses a regular $text index and prefix matching, and works
+	// on any MongoDB deployment.
+	SearchText = "text"
+)
+
+const (
+	// maxSearchTermLength caps the length of a search term in bytes.
+	maxSearchTermLength = 200
+	// maxTextHits caps the number of $text matches the text backend ranks
+	// before it moves on to prefix matches.
+	maxTextHits = 1000
+	// searchTimeout bounds the run time of a single search.
+	searchTimeout = 5 * time.Second
+)
+
+// SearchOptions selects one page of search hits. Field restricts the search
+// to one registered field; empty searches all of them. Filter narrows the hits,
+// usually to facet values the client selected; it is built by
+// MagazineFields.Parse.
+type SearchOptions struct {
+	Field  string
+	Term   string
+	Filter bson.D
+	Limit  int64
+	Offset int64
+}
+
+// SearchResult is one page of search hits, best match first. Total counts
+// the hits on all pages, and Facets counts them by category, publisher,
+// price range and publication year. Searches with few hits come with
+// Suggestions, queries that are spelled like the term and match titles.
+type SearchResult struct {
+	Hits        []SearchHit              `json:"hits"`
+	Total       int64                    `json:"total"`
+	Limit       int64                    `json:"limit"`
+	Offset      int64                    `json:"offset"`
+	Facets      map[string][]FacetBucket `json:"facets"`
+	Suggestions []string                 `json:"suggestions,omitempty"`
+}
+
+// SearchHit is a magazine that matched a search, with its relevance score
+// and the parts of the searched field that matched.
+type SearchHit struct {
+	Magazine   `bson:",inline"`
+	Score      float64     `bson:"score" json:"score"`
+	Highlights []Highlight `bson:"highlights" json:"highlights,omitempty"`
+}
+
+// Highlight splits the value of one field into the parts that matched the
+// search term, of type "hit", and the parts around them, of type "text".
+// It has the shape of an Atlas Search highlight.
+type Highlight struct {
+	Path  string          `bson:"path" json:"path"`
+	Score float64         `bson:"score" json:"score"`
+	Texts []HighlightText `bson:"texts" json:"texts"`
+}
+
+type HighlightText struct {
+	Value string `bson:"value" json:"value"`
+	Type  string `bson:"type" json:"type"`
+}
+
+// SearchIndex describes the index a search backend runs on.
+type SearchIndex struct {
+	Backend    string          `json:"backend"`
+	Name       string          `json:"name"`
+	Definition json.RawMessage `json:"definition"`
+}
+
+// Searcher runs searches against one search backend. Every backend returns
+// the same SearchResult, so callers do not need to know which one is in
+// use.
+type Searcher interface {
+	Search(ctx context.Context, opts SearchOptions) (*SearchResult, error)
+	// SyncIndex creates the backend's index, or updates it to match the
+	// configured fields and synonyms.
+	SyncIndex(ctx context.Context) (*SearchIndex, error)
+}
+
+// NewSearcher returns the search backend selected by config.
+func NewSearcher(config SearchConfig, db *mongo.Client) (Searcher, error) {
+	return newSearcher(config, db, "", environment{})
+}
+
+// newSearcher returns the search backend selected by config, searching the
+// named database, see libraryDatabase.
+func newSearcher(config SearchConfig, db *mongo.Client, database string, env environment) (Searcher, error) {
+	fields := config.Fields
+	if len(fields) == 0 {
+		fields = DefaultSearchFields
+	}
+	if err := fields.validate(); err != nil {
+		return nil, err
+	}
+
+	switch config.Backend {
+	case SearchAtlas:
+		return &atlasSearch{environment: env, db: db, database: database, fields: fields}, nil
+	case SearchText:
+		return &textSearch{db: db, database: database, fields: fields}, nil
+	default:
+		return nil, fmt.Errorf("unknown search backend %q, want %q or %q", config.Backend, SearchAtlas, SearchText)
+	}
+}
+
+func (mM *mongoMagazine) Search(opts SearchOptions) (*SearchResult, error) {
+	opts, err := searchDefaults(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+	defer cancel()
+
+	return mM.search.Search(ctx, opts)
+}
+
+// searchDefaults checks the term of opts and fills in the default page.
+func searchDefaults(opts SearchOptions) (SearchOptions, error) {
+	if strings.TrimSpace(opts.Term) == "" {
+		return opts, &query.Error{Param: "q", Message: "must not be empty"}
+	}
+	if len(opts.Term) > maxSearchTermLength {
+		return opts, &query.Error{Param: "q", Message: fmt.Sprintf("must not be longer than %d bytes", maxSearchTermLength)}
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = query.DefaultLimit
+	}
+	if opts.Offset < 0 {
+		opts.Offset = 0
+	}
+	return opts, nil
+}
+
+// indexDefinition renders an index definition as JSON for SearchIndex.
+func indexDefinition(definition interface{}) (json.RawMessage, error) {
+	data, err := bson.MarshalExtJSON(definition, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// highlights marks the words of the searched fields of magazine that start
+// with one of the words of term.
+func highlights(fields []string, magazine *Magazine, term string) []Highlight {
+	found := []Highlight{}
+	for _, field := range fields {
+		found = append(found, highlight(field, searchableText[field](magazine), term)...)
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return found
+}
+
+// highlight marks the words of value that start with one of the words of
+// term. It returns nil if none do.
+func highlight(path, value, term string) []Highlight {
+	words := strings.Fields(term)
+	if len(words) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	pattern := regexp.MustCompile(`(?i)(?:` + strings.Join(quoted, "|") + `)[\p{L}\p{N}]*`)
+
+	texts := []HighlightText{}
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(value, -1) {
+		// Only matches at the start of a word count.
+		if before, _ := utf8.DecodeLastRuneInString(value[:match[0]]); match[0] > 0 && isWordRune(before) {
+			continue
+		}
+		if match[0] > last {
+			texts = append(texts, HighlightText{Value: value[last:match[0]], Type: "text"})
+		}
+		texts = append(texts, HighlightText{Value: value[match[0]:match[1]], Type: "hit"})
+		last = match[1]
+	}
+	if last == 0 {
+		return nil
+	}
+	if last < len(value) {
+		texts = append(texts, HighlightText{Value: value[last:], Type: "text"})
+	}
+	return []Highlight{{Path: path, Texts: texts}}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
@@ -0,0 +1,297 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// atlasIndexName is the name of the Atlas Search index on magazines.
+	atlasIndexName = "magazine_title"
+	// atlasSynonyms is the name of the synonym mapping in the index. It
+	// reads the synonym sets managed through SearchService.
+	atlasSynonyms = "magazine_synonyms"
+	// atlasSynonymAnalyzer is the analyzer of the synonym mapping. Atlas
+	// only applies synonyms to fields with the same analyzer.
+	atlasSynonymAnalyzer = "lucene.standard"
+)
+
+// atlasSearch runs searches against an Atlas Search index.
+type atlasSearch struct {
+	environment
+	db *mongo.Client
+	// database is the name of the database searched, see libraryDatabase.
+	database string
+	fields   SearchFields
+}
+
+func (s *atlasSearch) Search(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+	fields, err := s.fields.selected(opts.Field)
+	if err != nil {
+		return nil, err
+	}
+	filters, excluded, err := atlasFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trashed magazines are filtered out inside the search operator so that
+	// $searchMeta counts the same documents as $search returns.
+	excluded = append(excluded, bson.D{{Key: "exists", Value: bson.D{{Key: "path", Value: "deletedAt"}}}})
+	compound := bson.D{
+		{Key: "must", Value: bson.A{s.matchTerm(fields, opts.Term)}},
+		{Key: "mustNot", Value: excluded},
+	}
+	if len(filters) > 0 {
+		compound = append(compound, bson.E{Key: "filter", Value: filters})
+	}
+	operator := bson.D{{Key: "compound", Value: compound}}
+
+	paths := bson.A{}
+	for _, field := range fields {
+		paths = append(paths, field)
+	}
+	search := bson.D{{Key: "index", Value: atlasIndexName}}
+	search = append(search, operator...)
+	search = append(search, bson.E{Key: "highlight", Value: bson.D{{Key: "path", Value: paths}}})
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$search", Value: search}},
+		{{Key: "$match", Value: live}},
+		{{Key: "$skip", Value: opts.Offset}},
+		{{Key: "$limit", Value: opts.Limit}},
+		{{Key: "$addFields", Value: bson.D{
+			{Key: "score", Value: bson.D{{Key: "$meta", Value: "searchScore"}}},
+			{Key: "highlights", Value: bson.D{{Key: "$meta", Value: "searchHighlights"}}},
+		}}},
+	}
+
+	db := libraryDatabase(s.db, s.database).Collection("magazines")
+	cursor, err := db.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	hits := []SearchHit{}
+	if err := cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+
+	meta := bson.D{
+		{Key: "index", Value: atlasIndexName},
+		{Key: "facet", Value: bson.D{
+			{Key: "operator", Value: operator},
+			{Key: "facets", Value: atlasFacets(s.now())},
+		}},
+		{Key: "count", Value: bson.D{{Key: "type", Value: "total"}}},
+	}
+	cursor, err = db.Aggregate(ctx, mongo.Pipeline{{{Key: "$searchMeta", Value: meta}}})
+	if err != nil {
+		return nil, err
+	}
+	var metas []struct {
+		Count struct {
+			Total int64 `bson:"total"`
+		} `bson:"count"`
+		Facet map[string]struct {
+			Buckets []rawFacetBucket `bson:"buckets"`
+		} `bson:"facet"`
+	}
+	if err := cursor.All(ctx, &metas); err != nil {
+		return nil, err
+	}
+
+	result := &SearchResult{Hits: hits, Limit: opts.Limit, Offset: opts.Offset}
+	raw := map[string][]rawFacetBucket{}
+	if len(metas) > 0 {
+		result.Total = metas[0].Count.Total
+		for name, facet := range metas[0].Facet {
+			raw[name] = facet.Buckets
+		}
+	}
+	result.Facets, err = facetResults(raw)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// matchTerm builds the operator that matches term in any of fields, each
+// boosted by its weight. Fields with autocomplete also match partly typed
+// words.
+func (s *atlasSearch) matchTerm(fields []string, term string) bson.D {
+	should := bson.A{}
+	for _, field := range fields {
+		config := s.fields[field]
+		score := bson.D{{Key: "boost", Value: bson.D{{Key: "value", Value: config.Weight}}}}
+
+		text := bson.D{
+			{Key: "path", Value: field},
+			{Key: "query", Value: term},
+			{Key: "score", Value: score},
+		}
+		if analyzer(config) == atlasSynonymAnalyzer {
+			text = append(text, bson.E{Key: "synonyms", Value: atlasSynonyms})
+		}
+		should = append(should, bson.D{{Key: "text", Value: text}})
+
+		if config.Autocomplete {
+			should = append(should, bson.D{{Key: "autocomplete", Value: bson.D{
+				{Key: "path", Value: field},
+				{Key: "query", Value: term},
+				{Key: "score", Value: score},
+			}}})
+		}
+	}
+	return bson.D{{Key: "compound", Value: bson.D{
+		{Key: "should", Value: should},
+		{Key: "minimumShouldMatch", Value: 1},
+	}}}
+}
+
+// SyncIndex updates the Atlas Search index definition, or creates the index
+// if it does not exist yet. Atlas rebuilds the index in the background.
+func (s *atlasSearch) SyncIndex(ctx context.Context) (*SearchIndex, error) {
+	db := libraryDatabase(s.db, s.database)
+
+	// The synonym source collection has to exist before an index can use it.
+	err := db.CreateCollection(ctx, synonymCollection)
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Name == "NamespaceExists") {
+		return nil, err
+	}
+
+	definition := atlasIndexDefinition(s.fields)
+	err = db.RunCommand(ctx, bson.D{
+		{Key: "updateSearchIndex", Value: "magazines"},
+		{Key: "name", Value: atlasIndexName},
+		{Key: "definition", Value: definition},
+	}).Err()
+	if errors.As(err, &commandErr) && commandErr.Name == "IndexNotFound" {
+		err = db.RunCommand(ctx, bson.D{
+			{Key: "createSearchIndexes", Value: "magazines"},
+			{Key: "indexes", Value: bson.A{bson.D{
+				{Key: "name", Value: atlasIndexName},
+				{Key: "definition", Value: definition},
+			}}},
+		}).Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := indexDefinition(definition)
+	if err != nil {
+		return nil, err
+	}
+	return &SearchIndex{Backend: SearchAtlas, Name: atlasIndexName, Definition: rendered}, nil
+}
+
+// atlasIndexDefinition builds the static mappings of the Atlas Search index:
+// the searchable fields with their analyzers, plus the fields facets and
+// filters rely on.
+func atlasIndexDefinition(fields SearchFields) bson.D {
+	mappings := map[string]bson.A{
+		"category":        {bson.D{{Key: "type", Value: "token"}}, bson.D{{Key: "type", Value: "stringFacet"}}},
+		"publisher":       {bson.D{{Key: "type", Value: "token"}}, bson.D{{Key: "type", Value: "stringFacet"}}},
+		"price":           {bson.D{{Key: "type", Value: "number"}}, bson.D{{Key: "type", Value: "numberFacet"}}},
+		"publicationYear": {bson.D{{Key: "type", Value: "number"}}, bson.D{{Key: "type", Value: "numberFacet"}}},
+		"deletedAt":       {bson.D{{Key: "type", Value: "date"}}},
+	}
+	for _, name := range fields.names() {
+		config := fields[name]
+		mappings[name] = append(mappings[name], bson.D{
+			{Key: "type", Value: "string"},
+			{Key: "analyzer", Value: analyzer(config)},
+		})
+		if config.Autocomplete {
+			mappings[name] = append(mappings[name], bson.D{
+				{Key: "type", Value: "autocomplete"},
+				{Key: "analyzer", Value: analyzer(config)},
+			})
+		}
+	}
+
+	paths := make([]string, 0, len(mappings))
+	for path := range mappings {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	fieldMappings := bson.D{}
+	for _, path := range paths {
+		fieldMappings = append(fieldMappings, bson.E{Key: path, Value: mappings[path]})
+	}
+
+	return bson.D{
+		{Key: "mappings", Value: bson.D{
+			{Key: "dynamic", Value: false},
+			{Key: "fields", Value: fieldMappings},
+		}},
+		{Key: "synonyms", Value: bson.A{bson.D{
+			{Key: "name", Value: atlasSynonyms},
+			{Key: "analyzer", Value: atlasSynonymAnalyzer},
+			{Key: "source", Value: bson.D{{Key: "collection", Value: synonymCollection}}},
+		}}},
+	}
+}
+
+// analyzer returns the Atlas analyzer of a field, lucene.standard unless
+// configured otherwise.
+func analyzer(field SearchField) string {
+	if field.Analyzer == "" {
+		return "lucene.standard"
+	}
+	return field.Analyzer
+}
+
+// atlasFilter translates a filter built by MagazineFields.Parse into Atlas
+// Search operators: the clauses a hit must match and those it must not.
+func atlasFilter(filter bson.D) (must, mustNot bson.A, err error) {
+	must, mustNot = bson.A{}, bson.A{}
+	for _, e := range filter {
+		conditions, ok := e.Value.(bson.D)
+		if !ok {
+			return nil, nil, fmt.Errorf("search filter on %q is not supported", e.Key)
+		}
+		for _, c := range conditions {
+			value := atlasValue(c.Value)
+			switch c.Key {
+			case "$eq":
+				must = append(must, bson.D{{Key: "equals", Value: bson.D{{Key: "path", Value: e.Key}, {Key: "value", Value: value}}}})
+			case "$ne":
+				mustNot = append(mustNot, bson.D{{Key: "equals", Value: bson.D{{Key: "path", Value: e.Key}, {Key: "value", Value: value}}}})
+			case "$gt", "$gte", "$lt", "$lte":
+				must = append(must, bson.D{{Key: "range", Value: bson.D{{Key: "path", Value: e.Key}, {Key: c.Key[1:], Value: value}}}})
+			case "$in":
+				must = append(must, bson.D{{Key: "in", Value: bson.D{{Key: "path", Value: e.Key}, {Key: "value", Value: value}}}})
+			default:
+				return nil, nil, &query.Error{Param: e.Key, Message: fmt.Sprintf("operator %s cannot be used in a search", c.Key)}
+			}
+		}
+	}
+	return must, mustNot, nil
+}
+
+// atlasValue converts Decimal128 values, which Atlas Search does not index
+// as numbers, to doubles.
+func atlasValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.Decimal128:
+		f, _ := strconv.ParseFloat(v.String(), 64)
+		return f
+	case bson.A:
+		converted := bson.A{}
+		for _, item := range v {
+			converted = append(converted, atlasValue(item))
+		}
+		return converted
+	}
+	return value
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewSearcher(t *testing.T) {
+	for _, name := range []string{SearchAtlas, SearchText} {
+		if _, err := NewSearcher(SearchConfig{Backend: name}, nil); err != nil {
+			t.Errorf("NewSearcher(%q) error = %v", name, err)
+		}
+	}
+
+	invalid := []SearchConfig{
+		{Backend: "elastic"},
+		{Backend: SearchText, Fields: SearchFields{"price": {Weight: 1}}},
+		{Backend: SearchText, Fields: SearchFields{"title": {Weight: 0}}},
+	}
+	for _, config := range invalid {
+		if _, err := NewSearcher(config, nil); err == nil {
+			t.Errorf("NewSearcher(%+v) succeeded, want error", config)
+		}
+	}
+}
+
+func TestSearchFieldsSelected(t *testing.T) {
+	fields, err := DefaultSearchFields.selected("")
+	if err != nil || !reflect.DeepEqual(fields, []string{"category", "publisher", "title"}) {
+		t.Errorf("selected(\"\") = %v, %v", fields, err)
+	}
+	if _, err := DefaultSearchFields.selected("slug"); err == nil {
+		t.Error("selected(\"slug\") succeeded, want error")
+	}
+}
+
+func TestSearchRejectsInvalidOptions(t *testing.T) {
+	mM := &mongoMagazine{}
+	tests := []SearchOptions{
+		{Field: "title", Term: "  "},
+		{Field: "title", Term: strings.Repeat("a", maxSearchTermLength+1)},
+	}
+	for _, opts := range tests {
+		if _, err := mM.Search(opts); err == nil {
+			t.Errorf("Search(%+v) succeeded, want error", opts)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got := highlight("title", "The New Yorker, New York edition", "new york")
+	want := []Highlight{{Path: "title", Texts: []HighlightText{
+		{Value: "The ", Type: "text"},
+		{Value: "New", Type: "hit"},
+		{Value: " ", Type: "text"},
+		{Value: "Yorker", Type: "hit"},
+		{Value: ", ", Type: "text"},
+		{Value: "New", Type: "hit"},
+		{Value: " ", Type: "text"},
+		{Value: "York", Type: "hit"},
+		{Value: " edition", Type: "text"},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("highlight() = %+v, want %+v", got, want)
+	}
+
+	if got := highlight("title", "Renewal", "new"); got != nil {
+		t.Errorf("highlight() matched inside a word: %+v", got)
+	}
+}
@@ -0,0 +1,302 @@
+package models
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// textIndexName is the name of the text index the text backend creates.
+const textIndexName = "magazine_search_text"
+
+// textSearch answers searches with a weighted $text index over the
+// registered fields, which matches whole words, followed by the magazines
+// that have a word starting with the term in an autocomplete field, so that
+// partly typed words still match. Prefix matches have no text score and
+// rank after all $text matches. Synonyms are applied by adding them to the
+// term.
+type textSearch struct {
+	db *mongo.Client
+	// database is the name of the database searched, see libraryDatabase.
+	database string
+	fields   SearchFields
+
+	mu      sync.Mutex
+	indexed bool
+}
+
+func (s *textSearch) collection(name string) *mongo.Collection {
+	return libraryDatabase(s.db, s.database).Collection(name)
+}
+
+func (s *textSearch) Search(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+	fields, err := s.fields.selected(opts.Field)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureIndex(ctx); err != nil {
+		return nil, err
+	}
+	term, err := expandSynonyms(ctx, libraryDatabase(s.db, s.database), opts.Term)
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.collection("magazines")
+	textScore := bson.D{{Key: "$meta", Value: "textScore"}}
+
+	// Rank the $text matches first. Only their ids and scores are loaded,
+	// so the page can be cut from the combined ranking.
+	textFilter := query.And(live, opts.Filter, bson.D{{Key: "$text", Value: bson.D{{Key: "$search", Value: term}}}})
+	if opts.Field != "" {
+		// The text index covers every registered field, so keep only the
+		// matches that have one of the words in the field asked for.
+		textFilter = query.And(textFilter, bson.D{{Key: opts.Field, Value: wordsStart(term)}})
+	}
+	cursor, err := db.Find(ctx, textFilter, options.Find().
+		SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "score", Value: textScore}}).
+		SetSort(bson.D{{Key: "score", Value: textScore}, {Key: "_id", Value: 1}}).
+		SetLimit(maxTextHits))
+	if err != nil {
+		return nil, err
+	}
+	var ranked []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Score float64            `bson:"score"`
+	}
+	if err := cursor.All(ctx, &ranked); err != nil {
+		return nil, err
+	}
+
+	textIDs := bson.A{}
+	for _, r := range ranked {
+		textIDs = append(textIDs, r.ID)
+	}
+	hitClauses := bson.A{bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: textIDs}}}}}
+
+	// Prefix matches on the autocomplete fields.
+	wordStart := primitive.Regex{Pattern: `(^|\s)` + regexp.QuoteMeta(opts.Term), Options: "i"}
+	prefixClauses := bson.A{}
+	prefixSort := bson.D{}
+	for _, field := range fields {
+		if s.fields[field].Autocomplete {
+			prefixClauses = append(prefixClauses, bson.D{{Key: field, Value: wordStart}})
+			prefixSort = append(prefixSort, bson.E{Key: field, Value: 1})
+		}
+	}
+	prefixSort = append(prefixSort, bson.E{Key: "_id", Value: 1})
+	hitClauses = append(hitClauses, prefixClauses...)
+
+	var prefixFilter bson.D
+	var prefixTotal int64
+	if len(prefixClauses) > 0 {
+		prefixFilter = query.And(live, opts.Filter, bson.D{
+			{Key: "$or", Value: prefixClauses},
+			{Key: "_id", Value: bson.D{{Key: "$nin", Value: textIDs}}},
+		})
+		prefixTotal, err = db.CountDocuments(ctx, prefixFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &SearchResult{
+		Hits:   []SearchHit{},
+		Total:  int64(len(ranked)) + prefixTotal,
+		Limit:  opts.Limit,
+		Offset: opts.Offset,
+	}
+
+	// The part of the page made of $text matches.
+	if opts.Offset < int64(len(ranked)) {
+		end := opts.Offset + opts.Limit
+		if end > int64(len(ranked)) {
+			end = int64(len(ranked))
+		}
+		page := ranked[opts.Offset:end]
+
+		ids := bson.A{}
+		for _, r := range page {
+			ids = append(ids, r.ID)
+		}
+		cursor, err := db.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+		if err != nil {
+			return nil, err
+		}
+		magazines := []Magazine{}
+		if err := cursor.All(ctx, &magazines); err != nil {
+			return nil, err
+		}
+		byID := map[primitive.ObjectID]Magazine{}
+		for _, magazine := range magazines {
+			byID[magazine.ID] = magazine
+		}
+		for _, r := range page {
+			if magazine, ok := byID[r.ID]; ok {
+				result.Hits = append(result.Hits, SearchHit{Magazine: magazine, Score: r.Score})
+			}
+		}
+	}
+
+	// The rest of the page is filled with prefix matches.
+	if remaining := opts.Limit - int64(len(result.Hits)); remaining > 0 && prefixTotal > 0 {
+		skip := opts.Offset - int64(len(ranked))
+		if skip < 0 {
+			skip = 0
+		}
+		cursor, err := db.Find(ctx, prefixFilter, options.Find().
+			SetSort(prefixSort).
+			SetSkip(skip).
+			SetLimit(remaining))
+		if err != nil {
+			return nil, err
+		}
+		magazines := []Magazine{}
+		if err := cursor.All(ctx, &magazines); err != nil {
+			return nil, err
+		}
+		for _, magazine := range magazines {
+			result.Hits = append(result.Hits, SearchHit{Magazine: magazine})
+		}
+	}
+
+	for i := range result.Hits {
+		result.Hits[i].Highlights = highlights(fields, &result.Hits[i].Magazine, term)
+	}
+
+	// The facets count every hit, not just the ones on this page.
+	hitFilter := query.And(live, opts.Filter, bson.D{{Key: "$or", Value: hitClauses}})
+	cursor, err = db.Aggregate(ctx, mongo.Pipeline{{{Key: "$match", Value: hitFilter}}, facetStage()})
+	if err != nil {
+		return nil, err
+	}
+	var counted []map[string][]rawFacetBucket
+	if err := cursor.All(ctx, &counted); err != nil {
+		return nil, err
+	}
+	raw := map[string][]rawFacetBucket{}
+	if len(counted) > 0 {
+		raw = counted[0]
+	}
+	result.Facets, err = facetResults(raw)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// wordsStart matches text with a word that starts with one of the words of
+// term.
+func wordsStart(term string) primitive.Regex {
+	words := strings.Fields(term)
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	return primitive.Regex{Pattern: `(^|\s)(` + strings.Join(words, "|") + `)`, Options: "i"}
+}
+
+// textIndex returns the keys and options of the text index for the
+// configured fields.
+func (s *textSearch) textIndex() mongo.IndexModel {
+	keys := bson.D{}
+	weights := bson.D{}
+	for _, name := range s.fields.names() {
+		keys = append(keys, bson.E{Key: name, Value: "text"})
+		weights = append(weights, bson.E{Key: name, Value: s.fields[name].Weight})
+	}
+	return mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetName(textIndexName).SetWeights(weights),
+	}
+}
+
+// ensureIndex creates the text index on the first search unless the
+// collection already has one; use SyncIndex to replace an outdated one. It
+// is retried on the next search if it fails.
+func (s *textSearch) ensureIndex(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.indexed {
+		return nil
+	}
+
+	existing, err := s.textIndexNames(ctx)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		db := s.collection("magazines")
+		if _, err := db.Indexes().CreateOne(ctx, s.textIndex()); err != nil {
+			return err
+		}
+	}
+
+	s.indexed = true
+	return nil
+}
+
+// SyncIndex replaces the text index with one built from the configured
+// fields and weights. A collection can only have one text index, so the old
+// one is dropped first.
+func (s *textSearch) SyncIndex(ctx context.Context) (*SearchIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.textIndexNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db := s.collection("magazines")
+	for _, name := range existing {
+		if _, err := db.Indexes().DropOne(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	index := s.textIndex()
+	if _, err := db.Indexes().CreateOne(ctx, index); err != nil {
+		return nil, err
+	}
+	s.indexed = true
+
+	rendered, err := indexDefinition(bson.D{
+		{Key: "key", Value: index.Keys},
+		{Key: "weights", Value: index.Options.Weights},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SearchIndex{Backend: SearchText, Name: textIndexName, Definition: rendered}, nil
+}
+
+// textIndexNames returns the names of the text indexes on magazines.
+func (s *textSearch) textIndexNames(ctx context.Context) ([]string, error) {
+	db := s.collection("magazines")
+	cursor, err := db.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []struct {
+		Name    string   `bson:"name"`
+		Weights bson.Raw `bson:"weights"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, index := range indexes {
+		if index.Weights != nil {
+			names = append(names, index.Name)
+		}
+	}
+	return names, nil
+}
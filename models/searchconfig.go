@@ -0,0 +1,88 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jgsheppa/mongo-go/query"
+)
+
+// SearchConfig selects and tunes the magazine search backend.
+type SearchConfig struct {
+	// Backend is SearchAtlas or SearchText.
+	Backend string
+	// Fields lists the fields clients may search. DefaultSearchFields is
+	// used when it is empty.
+	Fields SearchFields
+}
+
+// SearchField configures how one magazine field is searched.
+type SearchField struct {
+	// Weight ranks matches in this field relative to the other fields. It
+	// is the score boost on Atlas and the text index weight otherwise.
+	Weight int `mapstructure:"weight"`
+	// Analyzer is the Atlas Search analyzer of the field. The text backend
+	// ignores it.
+	Analyzer string `mapstructure:"analyzer"`
+	// Autocomplete also matches words the client has only partly typed.
+	Autocomplete bool `mapstructure:"autocomplete"`
+}
+
+// SearchFields is the registry of searchable fields, keyed by the field's
+// name in Mongo. Only the text fields of a magazine can be registered.
+type SearchFields map[string]SearchField
+
+// DefaultSearchFields searches the title with autocomplete, and the category
+// and publisher at a lower weight.
+var DefaultSearchFields = SearchFields{
+	"title":     {Weight: 3, Analyzer: "lucene.standard", Autocomplete: true},
+	"category":  {Weight: 1, Analyzer: "lucene.standard"},
+	"publisher": {Weight: 1, Analyzer: "lucene.standard"},
+}
+
+// searchableText lists the magazine fields a SearchFields registry may
+// contain, with a function returning the field's value.
+var searchableText = map[string]func(*Magazine) string{
+	"title":     func(m *Magazine) string { return m.Title },
+	"category":  func(m *Magazine) string { return m.Category },
+	"publisher": func(m *Magazine) string { return m.Publisher },
+}
+
+// validate checks that only text fields are registered, with a positive
+// weight.
+func (f SearchFields) validate() error {
+	if len(f) == 0 {
+		return fmt.Errorf("search: no searchable fields configured")
+	}
+	for _, name := range f.names() {
+		if _, ok := searchableText[name]; !ok {
+			return fmt.Errorf("search: field %q cannot be searched", name)
+		}
+		if f[name].Weight < 1 {
+			return fmt.Errorf("search: field %q needs a weight of at least 1", name)
+		}
+	}
+	return nil
+}
+
+// names returns the registered field names in a stable order.
+func (f SearchFields) names() []string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selected returns the fields a search covers: the one asked for, or every
+// registered field when none is.
+func (f SearchFields) selected(field string) ([]string, error) {
+	if field == "" {
+		return f.names(), nil
+	}
+	if _, ok := f[field]; !ok {
+		return nil, &query.Error{Param: "field", Message: fmt.Sprintf("cannot search %q", field)}
+	}
+	return []string{field}, nil
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -9,12 +11,83 @@ import (
 )
 
 type Services struct {
-	User     UserService
+	// User is the user store. Logins are checked against it with the
+	// pepper of the server, see NewUserService.
+	User     UserDB
 	Magazine MagazineService
-	mongo    *mongo.Client
+	// MagazineCache is the cache the magazine service reads through.
+	MagazineCache MagazineCache
+	Search        SearchService
+	Webhook       WebhookService
+	Outbox        Outbox
+	mongo         *mongo.Client
+	env           environment
 }
 
-func NewServices(connectionString string) (*Services, error) {
+// Logger is where services log what goes wrong in the background, such as a
+// failed purge or webhook delivery. *log.Logger and the request loggers of
+// chi satisfy it.
+type Logger interface {
+	Print(v ...any)
+}
+
+// Option configures the services built by NewServices and
+// NewMemoryServices.
+type Option func(*environment)
+
+// WithLogger sets where the services and their workers log. It defaults to
+// the standard logger.
+func WithLogger(logger Logger) Option {
+	return func(env *environment) {
+		env.logger = logger
+	}
+}
+
+// WithClock sets the clock writes are stamped by, which also times the
+// trash retention, outbox leases and webhook retries. It defaults to
+// time.Now.
+func WithClock(clock func() time.Time) Option {
+	return func(env *environment) {
+		env.clock = clock
+	}
+}
+
+// environment is what the types making up a set of services share. Its zero
+// value logs through the standard logger and reads time.Now.
+type environment struct {
+	logger Logger
+	clock  func() time.Time
+}
+
+func newEnvironment(opts []Option) environment {
+	env := environment{}
+	for _, opt := range opts {
+		opt(&env)
+	}
+	return env
+}
+
+// now returns the current time at the millisecond precision Mongo stores.
+func (env environment) now() time.Time {
+	clock := env.clock
+	if clock == nil {
+		clock = time.Now
+	}
+	return clock().UTC().Truncate(time.Millisecond)
+}
+
+func (env environment) logf(format string, v ...any) {
+	if env.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	env.logger.Print(fmt.Sprintf(format, v...))
+}
+
+// NewServices connects to Mongo and builds the services on top of it.
+// search selects and tunes the magazine search backend, cache sizes the
+// cache magazine reads go through.
+func NewServices(connectionString string, search SearchConfig, cache CacheConfig, opts ...Option) (*Services, error) {
 	serverAPIOptions := options.ServerAPI(options.ServerAPIVersion1)
 	clientOptions := options.Client().
 		ApplyURI(connectionString).
@@ -27,9 +100,62 @@ func NewServices(connectionString string) (*Services, error) {
 		return nil, err
 	}
 
+	return newServices(db, "", search, cache, newEnvironment(opts))
+}
+
+// newServices builds the services on db. Everything but users is kept in
+// the named database, see libraryDatabase.
+func newServices(db *mongo.Client, database string, search SearchConfig, cache CacheConfig, env environment) (*Services, error) {
+	searcher, err := newSearcher(search, db, database, env)
+	if err != nil {
+		return nil, err
+	}
+
+	magazines := &mongoMagazine{environment: env, db: db, database: database, search: searcher}
+	if err := magazines.ensureIndexes(); err != nil {
+		return nil, err
+	}
+
+	entries := NewLRUCache(cache.Size, cache.TTL).(*lruCache)
+	entries.clock = env.now
+	magazineCache := &cachedMagazine{
+		environment: env,
+		MagazineDB:  magazines,
+		cache:       entries,
+	}
+
+	outbox := newOutbox(db, database)
+	outbox.environment = env
+
+	return &Services{
+		Magazine:      newMagazineService(db, database, magazineCache, env),
+		MagazineCache: magazineCache,
+		Search:        &mongoSearch{db: db, database: database, searcher: searcher},
+		User:          NewUserDB(db),
+		Webhook:       &mongoWebhooks{environment: env, db: db, database: database, client: NewWebhookClient()},
+		Outbox:        outbox,
+		mongo:         db,
+		env:           env,
+	}, nil
+}
+
+// NewMemoryServices builds the magazine and user services on in-memory
+// databases holding users, so tests and demos can run without Mongo.
+// Search administration, webhooks, the outbox and the magazine cache need
+// Mongo and are left nil.
+func NewMemoryServices(users []User, opts ...Option) (*Services, error) {
+	userDB, err := NewMemoryUserDB(users...)
+	if err != nil {
+		return nil, err
+	}
+
+	env := newEnvironment(opts)
+	magazines := NewMemoryMagazineDB().(*memoryMagazine)
+	magazines.environment = env
+
 	return &Services{
-		Magazine: NewMagazineService(db),
-		User:     NewUserService(db),
-		mongo:    db,
+		Magazine: &magazineService{environment: env, MagazineDB: magazines},
+		User:     userDB,
+		env:      env,
 	}, nil
 }
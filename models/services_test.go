@@ -0,0 +1,51 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the lines logged to it.
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Print(v ...any) {
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+func TestServicesUseTheirClockAndLogger(t *testing.T) {
+	clock := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	logger := &recordingLogger{}
+	services, err := NewMemoryServices(nil, WithClock(func() time.Time { return clock }), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := services.Magazine.Create(Magazine{Title: "Wired", Price: decimal(t, "5.99")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.UpdatedAt.Equal(clock) {
+		t.Errorf("UpdatedAt = %v, want %v", created.UpdatedAt, clock)
+	}
+	deleted, err := services.Magazine.Delete(created.ID.Hex(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted.DeletedAt.Equal(clock) {
+		t.Errorf("DeletedAt = %v, want %v", deleted.DeletedAt, clock)
+	}
+
+	// The purge runs once before it sees that ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	clock = clock.Add(48 * time.Hour)
+	services.PurgeTrash(ctx, 24*time.Hour, time.Hour)
+
+	if len(logger.lines) != 1 || logger.lines[0] != "purged 1 magazines from the trash" {
+		t.Errorf("logged %q, want the purge", logger.lines)
+	}
+}
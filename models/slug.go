@@ -0,0 +1,224 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxSlugAttempts bounds how often a write retries with a new slug after
+// losing a race for the same slug to a concurrent write.
+const maxSlugAttempts = 5
+
+// transliterations spells out letters that do not decompose into an ASCII
+// letter plus combining marks.
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'þ': "th", 'ł': "l", 'ı': "i",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh", 'з': "z",
+	'и': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+	'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "iu", 'я': "ia", 'і': "i", 'ї': "i", 'є': "ie", 'ґ': "g",
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th", 'ι': "i",
+	'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s",
+	'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+}
+
+// Slugify turns a title into a URL-safe slug. Accents are stripped, other
+// scripts are transliterated to ASCII and every run of remaining characters
+// becomes a single hyphen, so "Der Spiegel – Ausgabe" becomes
+// "der-spiegel-ausgabe".
+func Slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+
+	for _, r := range norm.NFKD.String(strings.ToLower(title)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+
+		out := string(r)
+		if t, ok := transliterations[r]; ok {
+			out = t
+		} else if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			out = ""
+			hyphen = b.Len() > 0
+		}
+		if out == "" {
+			continue
+		}
+
+		if hyphen {
+			b.WriteByte('-')
+			hyphen = false
+		}
+		b.WriteString(out)
+	}
+
+	if b.Len() == 0 {
+		return "magazine"
+	}
+	return b.String()
+}
+
+// uniqueSlug returns the slug for title, with a numeric suffix when the plain
+// slug is already used, currently or formerly, by another magazine than id.
+func (mM *mongoMagazine) uniqueSlug(title string, id primitive.ObjectID) (string, error) {
+	base, filter := slugQuery(title, id)
+
+	db := mM.collection("magazines")
+	opts := options.Find().SetProjection(bson.D{{Key: "slug", Value: 1}, {Key: "previousSlugs", Value: 1}})
+
+	cursor, err := db.Find(context.Background(), filter, opts)
+	if err != nil {
+		return "", err
+	}
+	taken := []Magazine{}
+	if err := cursor.All(context.Background(), &taken); err != nil {
+		return "", err
+	}
+
+	return freeSlug(base, taken), nil
+}
+
+// slugQuery returns the plain slug for title and a filter matching the
+// magazines other than id that use it or one of its numbered variants.
+func slugQuery(title string, id primitive.ObjectID) (string, bson.D) {
+	base := Slugify(title)
+	pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(base) + `(-[0-9]+)?$`}
+
+	return base, bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$ne", Value: id}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "slug", Value: pattern}},
+			bson.D{{Key: "previousSlugs", Value: pattern}},
+		}},
+	}
+}
+
+// freeSlug returns base, or base with the lowest numeric suffix, that none
+// of the taken magazines uses.
+func freeSlug(base string, taken []Magazine) string {
+	used := map[string]bool{}
+	for _, magazine := range taken {
+		used[magazine.Slug] = true
+		for _, slug := range magazine.PreviousSlugs {
+			used[slug] = true
+		}
+	}
+
+	slug := base
+	for n := 2; used[slug]; n++ {
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+	return slug
+}
+
+// renameSlug sets the slug of magazine for its new title, picking it with
+// uniqueSlug. The slug the magazine had before is kept in PreviousSlugs so
+// old links keep working.
+func renameSlug(magazine *Magazine, current *Magazine, uniqueSlug func(title string, id primitive.ObjectID) (string, error)) error {
+	if current != nil && current.Title == magazine.Title && current.Slug != "" {
+		magazine.Slug = current.Slug
+		magazine.PreviousSlugs = current.PreviousSlugs
+		return nil
+	}
+
+	slug, err := uniqueSlug(magazine.Title, magazine.ID)
+	if err != nil {
+		return err
+	}
+	magazine.Slug = slug
+	magazine.PreviousSlugs = nil
+
+	if current == nil {
+		return nil
+	}
+	for _, previous := range append(current.PreviousSlugs, current.Slug) {
+		if previous != "" && previous != slug {
+			magazine.PreviousSlugs = append(magazine.PreviousSlugs, previous)
+		}
+	}
+	return nil
+}
+
+// isSlugConflict reports whether err is a duplicate key error, which on the
+// magazines collection can only come from the unique slug index.
+func isSlugConflict(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
+
+// magazineIndexes makes sure the indexes the magazine queries rely on exist
+// and that magazines stored before slugs were introduced get one. It runs
+// when the services are built and is retried on the next slug lookup or
+// write if it fails.
+type magazineIndexes struct {
+	mu   sync.Mutex
+	done bool
+}
+
+func (mM *mongoMagazine) ensureIndexes() error {
+	mM.indexes.mu.Lock()
+	defer mM.indexes.mu.Unlock()
+
+	if mM.indexes.done {
+		return nil
+	}
+
+	db := mM.collection("magazines")
+	_, err := db.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "slug", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "slug", Value: bson.D{{Key: "$type", Value: "string"}}}}),
+		},
+		{Keys: bson.D{{Key: "previousSlugs", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := mM.backfillSlugs(); err != nil {
+		return err
+	}
+
+	mM.indexes.done = true
+	return nil
+}
+
+// backfillSlugs gives every magazine without a slug one derived from its
+// title.
+func (mM *mongoMagazine) backfillSlugs() error {
+	db := mM.collection("magazines")
+	filter := bson.D{{Key: "slug", Value: bson.D{{Key: "$exists", Value: false}}}}
+
+	cursor, err := db.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	missing := []Magazine{}
+	if err := cursor.All(context.Background(), &missing); err != nil {
+		return err
+	}
+
+	for _, magazine := range missing {
+		slug, err := mM.uniqueSlug(magazine.Title, magazine.ID)
+		if err != nil {
+			return err
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "slug", Value: slug}}}}
+		if _, err := db.UpdateByID(context.Background(), magazine.ID, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package models
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"Wired 2024":            "wired-2024",
+		"Der Spiegel – Ausgabe": "der-spiegel-ausgabe",
+		"  Straße & Café!  ":    "strasse-cafe",
+		"Ærø / Øresund":         "aero-oresund",
+		"Огонёк":                "ogonek",
+		"The New Yorker's Best": "the-new-yorker-s-best",
+		"日本":                    "magazine",
+	}
+
+	for title, want := range tests {
+		if got := Slugify(title); got != want {
+			t.Errorf("Slugify(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
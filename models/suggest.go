@@ -0,0 +1,394 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// termCollection is the dictionary of title terms suggestions are drawn
+	// from. Each document counts the live magazines whose title has the
+	// term.
+	termCollection = "search_terms"
+	// suggestBelowHits is the number of hits under which a search comes
+	// with suggestions.
+	suggestBelowHits = 3
+	// maxSuggestions caps the number of suggested queries.
+	maxSuggestions = 3
+	// suggestScanLimit caps the dictionary terms of each length a word of a
+	// query is compared with. The most common terms are compared first, so
+	// a large dictionary costs no more than this and only loses rare terms.
+	suggestScanLimit = 200
+	// termTimeout bounds dictionary reads and updates.
+	termTimeout = 5 * time.Second
+)
+
+// termDictionary keeps the terms of the titles of live magazines. It is
+// built from the collection on first use and updated by magazineService on
+// every write that changes which titles are live. A nil dictionary, as used
+// by services without Mongo, keeps nothing and suggests nothing.
+type termDictionary struct {
+	environment
+	db       *mongo.Client
+	database string
+
+	mu    sync.Mutex
+	built bool
+}
+
+type termEntry struct {
+	Term   string `bson:"_id"`
+	Count  int64  `bson:"count"`
+	Length int    `bson:"length"`
+}
+
+func (d *termDictionary) collection(name string) *mongo.Collection {
+	return libraryDatabase(d.db, d.database).Collection(name)
+}
+
+// titleTerms splits a title or query into lower-case words.
+func titleTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// ensure builds the dictionary from the live magazines if it has not been
+// built yet. It is retried on the next call if it fails.
+func (d *termDictionary) ensure(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.built {
+		return nil
+	}
+
+	terms := d.collection(termCollection)
+	// Suggestions read the most common terms of one length at a time.
+	index := mongo.IndexModel{Keys: bson.D{{Key: "length", Value: 1}, {Key: "count", Value: -1}}}
+	if _, err := terms.Indexes().CreateOne(ctx, index); err != nil {
+		return err
+	}
+
+	existing, err := terms.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return err
+	}
+	if existing == 0 {
+		if err := d.rebuild(ctx); err != nil {
+			return err
+		}
+	}
+
+	d.built = true
+	return nil
+}
+
+// rebuild recounts the terms of every live title.
+func (d *termDictionary) rebuild(ctx context.Context) error {
+	magazines := d.collection("magazines")
+	cursor, err := magazines.Find(ctx, live, options.Find().SetProjection(bson.D{{Key: "title", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	counts := map[string]int64{}
+	for cursor.Next(ctx) {
+		var magazine Magazine
+		if err := cursor.Decode(&magazine); err != nil {
+			return err
+		}
+		for _, term := range uniqueTerms(magazine.Title) {
+			counts[term]++
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return d.apply(ctx, counts)
+}
+
+// update moves the dictionary from the titles in removed to those in added.
+// Either may be empty. Failures are logged rather than returned, since the
+// magazine write they follow has already happened.
+func (d *termDictionary) update(removed, added []string) {
+	if d == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), termTimeout)
+	defer cancel()
+
+	if err := d.ensure(ctx); err != nil {
+		d.logf("updating search terms failed: %v", err)
+		return
+	}
+
+	counts := map[string]int64{}
+	for _, title := range removed {
+		for _, term := range uniqueTerms(title) {
+			counts[term]--
+		}
+	}
+	for _, title := range added {
+		for _, term := range uniqueTerms(title) {
+			counts[term]++
+		}
+	}
+	if err := d.apply(ctx, counts); err != nil {
+		d.logf("updating search terms failed: %v", err)
+	}
+}
+
+// reset recounts the dictionary from the live magazines. Failures are
+// logged like those of update.
+func (d *termDictionary) reset() {
+	if d == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	d.mu.Lock()
+	terms := d.collection(termCollection)
+	_, err := terms.DeleteMany(ctx, bson.D{})
+	d.built = false
+	d.mu.Unlock()
+
+	if err == nil {
+		// The dictionary is empty now, so ensure builds it again.
+		err = d.ensure(ctx)
+	}
+	if err != nil {
+		d.logf("recounting search terms failed: %v", err)
+	}
+}
+
+// apply adds counts to the dictionary and drops terms no title has any
+// more.
+func (d *termDictionary) apply(ctx context.Context, counts map[string]int64) error {
+	writes := []mongo.WriteModel{}
+	for term, delta := range counts {
+		if delta == 0 {
+			continue
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: term}}).
+			SetUpdate(bson.D{
+				{Key: "$inc", Value: bson.D{{Key: "count", Value: delta}}},
+				{Key: "$setOnInsert", Value: bson.D{{Key: "length", Value: utf8.RuneCountInString(term)}}},
+			}).
+			SetUpsert(true))
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+
+	terms := d.collection(termCollection)
+	if _, err := terms.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+		return err
+	}
+	_, err := terms.DeleteMany(ctx, bson.D{{Key: "count", Value: bson.D{{Key: "$lte", Value: 0}}}})
+	return err
+}
+
+// suggest returns up to maxSuggestions queries like query with its unknown
+// words replaced by the closest dictionary terms, most likely first.
+func (d *termDictionary) suggest(ctx context.Context, query string) ([]string, error) {
+	if d == nil {
+		return []string{}, nil
+	}
+	if err := d.ensure(ctx); err != nil {
+		return nil, err
+	}
+	words := titleTerms(query)
+	if len(words) == 0 {
+		return []string{}, nil
+	}
+
+	candidates := make([][]string, len(words))
+	corrected := false
+	for i, word := range words {
+		maxDistance := maxEditDistance(utf8.RuneCountInString(word))
+		entries, err := d.nearbyTerms(ctx, word, maxDistance)
+		if err != nil {
+			return nil, err
+		}
+
+		alternatives := closestTerms(word, entries, maxDistance)
+		if len(alternatives) == 0 {
+			// Keep words nothing resembles.
+			alternatives = []string{word}
+		}
+		if alternatives[0] != word {
+			corrected = true
+		}
+		candidates[i] = alternatives
+	}
+	if !corrected {
+		return []string{}, nil
+	}
+
+	original := strings.Join(words, " ")
+	suggestions := []string{}
+	seen := map[string]bool{original: true}
+	for rank := 0; rank < maxSuggestions; rank++ {
+		parts := make([]string, len(words))
+		for i, alternatives := range candidates {
+			if rank < len(alternatives) {
+				parts[i] = alternatives[rank]
+			} else {
+				parts[i] = alternatives[0]
+			}
+		}
+		suggestion := strings.Join(parts, " ")
+		if !seen[suggestion] {
+			seen[suggestion] = true
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	return suggestions, nil
+}
+
+// nearbyTerms returns the dictionary terms word is compared with: word
+// itself if the dictionary has it, and otherwise the suggestScanLimit most
+// common terms of every length within maxDistance of that of word.
+func (d *termDictionary) nearbyTerms(ctx context.Context, word string, maxDistance int) ([]termEntry, error) {
+	terms := d.collection(termCollection)
+
+	var exact termEntry
+	err := terms.FindOne(ctx, bson.D{{Key: "_id", Value: word}}).Decode(&exact)
+	if err == nil {
+		return []termEntry{exact}, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	length := utf8.RuneCountInString(word)
+	opts := options.Find().SetSort(bson.D{{Key: "count", Value: -1}}).SetLimit(suggestScanLimit)
+	entries := []termEntry{}
+	for l := length - maxDistance; l <= length+maxDistance; l++ {
+		cursor, err := terms.Find(ctx, bson.D{{Key: "length", Value: l}}, opts)
+		if err != nil {
+			return nil, err
+		}
+		var found []termEntry
+		if err := cursor.All(ctx, &found); err != nil {
+			return nil, err
+		}
+		entries = append(entries, found...)
+	}
+	return entries, nil
+}
+
+// closestTerms returns the dictionary terms within maxDistance edits of
+// word, nearest and then most common first. If word itself is in the
+// dictionary it is the only result.
+func closestTerms(word string, entries []termEntry, maxDistance int) []string {
+	type candidate struct {
+		term     string
+		distance int
+		count    int64
+	}
+
+	found := []candidate{}
+	for _, entry := range entries {
+		if entry.Term == word {
+			return []string{word}
+		}
+		if distance := editDistance(word, entry.Term); distance <= maxDistance {
+			found = append(found, candidate{entry.Term, distance, entry.Count})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].distance != found[j].distance {
+			return found[i].distance < found[j].distance
+		}
+		if found[i].count != found[j].count {
+			return found[i].count > found[j].count
+		}
+		return found[i].term < found[j].term
+	})
+
+	terms := []string{}
+	for i := 0; i < len(found) && i < maxSuggestions; i++ {
+		terms = append(terms, found[i].term)
+	}
+	return terms
+}
+
+// maxEditDistance allows one typo in short words and two in longer ones.
+func maxEditDistance(length int) int {
+	switch {
+	case length <= 2:
+		return 0
+	case length <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the Damerau-Levenshtein distance between a and b in
+// its optimal string alignment form: the number of single-rune insertions,
+// deletions, substitutions and transpositions of neighbours that turn a
+// into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	m := first
+	for _, v := range rest {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// uniqueTerms returns the distinct terms of a title.
+func uniqueTerms(title string) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+	for _, term := range titleTerms(title) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"wired", "wired", 0},
+		{"", "vogue", 5},
+		{"wird", "wired", 1},
+		{"wirde", "wired", 1},
+		{"vouge", "vogue", 1},
+		{"economist", "ecnomits", 2},
+		{"café", "cafe", 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTitleTerms(t *testing.T) {
+	got := titleTerms("The New-Yorker: 2023 Edition")
+	want := []string{"the", "new", "yorker", "2023", "edition"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("titleTerms() = %v, want %v", got, want)
+	}
+	if got := uniqueTerms("Time Out of Time"); !reflect.DeepEqual(got, []string{"time", "out", "of"}) {
+		t.Errorf("uniqueTerms() = %v", got)
+	}
+}
+
+func TestClosestTerms(t *testing.T) {
+	entries := []termEntry{
+		{Term: "wired", Count: 1},
+		{Term: "weird", Count: 5},
+		{Term: "wire", Count: 2},
+		{Term: "vogue", Count: 3},
+	}
+
+	got := closestTerms("wirde", entries, 2)
+	want := []string{"wire", "wired", "weird"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("closestTerms(wirde) = %v, want %v", got, want)
+	}
+
+	if got := closestTerms("vogue", entries, 1); !reflect.DeepEqual(got, []string{"vogue"}) {
+		t.Errorf("closestTerms(vogue) = %v, want the term itself", got)
+	}
+	if got := closestTerms("time", entries, 1); len(got) != 0 {
+		t.Errorf("closestTerms(time) = %v, want none", got)
+	}
+}
+
+func TestSuggestScansCommonTermsOnly(t *testing.T) {
+	client := testMongoClient(t)
+	if client == nil {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	d := &termDictionary{db: client, database: testDatabase(t, client)}
+
+	// More rare terms of the same length than a suggestion compares.
+	counts := map[string]int64{"wired": 5, "vogue": 1}
+	for i := 0; i < 2*suggestScanLimit; i++ {
+		counts[fmt.Sprintf("x%04d", i)] = 2
+	}
+	ctx := context.Background()
+	if err := d.apply(ctx, counts); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := d.suggest(ctx, "wirde"); err != nil || !reflect.DeepEqual(got, []string{"wired"}) {
+		t.Errorf("suggest(wirde) = %v, %v, want [wired]", got, err)
+	}
+	// vogue is too rare to be scanned, but is still known.
+	if got, err := d.suggest(ctx, "vogue"); err != nil || len(got) != 0 {
+		t.Errorf("suggest(vogue) = %v, %v, want none", got, err)
+	}
+}
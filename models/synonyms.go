@@ -0,0 +1,206 @@
+package models
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// synonymCollection holds the synonym sets. Its documents have the shape
+// Atlas Search expects of a synonym source collection.
+const synonymCollection = "search_synonyms"
+
+// Synonym mapping types.
+const (
+	// SynonymsEquivalent makes every word of the set match every other.
+	SynonymsEquivalent = "equivalent"
+	// SynonymsExplicit makes the Input words also match the Synonyms, but
+	// not the other way round.
+	SynonymsExplicit = "explicit"
+)
+
+var synonymSetName = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+// SynonymSet is one group of words searches treat as the same. The words
+// are stored in lower case.
+type SynonymSet struct {
+	Name        string   `bson:"_id" json:"name"`
+	MappingType string   `bson:"mappingType" json:"mappingType"`
+	Synonyms    []string `bson:"synonyms" json:"synonyms"`
+	Input       []string `bson:"input,omitempty" json:"input,omitempty"`
+}
+
+// SearchService manages the synonym sets and the index of the magazine
+// search.
+type SearchService interface {
+	Synonyms() ([]SynonymSet, error)
+	SynonymSet(name string) (*SynonymSet, error)
+	// PutSynonymSet creates the synonym set or replaces the one with the
+	// same name.
+	PutSynonymSet(set SynonymSet) (*SynonymSet, error)
+	DeleteSynonymSet(name string) error
+	// SyncIndex creates or updates the search index from the configured
+	// fields.
+	SyncIndex() (*SearchIndex, error)
+}
+
+func NewSearchService(db *mongo.Client, searcher Searcher) SearchService {
+	return &mongoSearch{db: db, searcher: searcher}
+}
+
+var _ SearchService = &mongoSearch{}
+
+type mongoSearch struct {
+	db       *mongo.Client
+	database string
+	searcher Searcher
+}
+
+func (mS *mongoSearch) collection(name string) *mongo.Collection {
+	return libraryDatabase(mS.db, mS.database).Collection(name)
+}
+
+func (mS *mongoSearch) Synonyms() ([]SynonymSet, error) {
+	db := mS.collection(synonymCollection)
+
+	cursor, err := db.Find(context.Background(), bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	sets := []SynonymSet{}
+	if err := cursor.All(context.Background(), &sets); err != nil {
+		return nil, err
+	}
+	return sets, nil
+}
+
+func (mS *mongoSearch) SynonymSet(name string) (*SynonymSet, error) {
+	db := mS.collection(synonymCollection)
+
+	set := SynonymSet{}
+	if err := db.FindOne(context.Background(), bson.M{"_id": name}).Decode(&set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+func (mS *mongoSearch) PutSynonymSet(set SynonymSet) (*SynonymSet, error) {
+	set.Synonyms = normalizeWords(set.Synonyms)
+	set.Input = normalizeWords(set.Input)
+	if err := validateSynonymSet(set); err != nil {
+		return nil, err
+	}
+	if set.MappingType == SynonymsEquivalent {
+		set.Input = nil
+	}
+
+	db := mS.collection(synonymCollection)
+	_, err := db.ReplaceOne(context.Background(), bson.M{"_id": set.Name}, set, options.Replace().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+func (mS *mongoSearch) DeleteSynonymSet(name string) error {
+	db := mS.collection(synonymCollection)
+
+	res, err := db.DeleteOne(context.Background(), bson.M{"_id": name})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (mS *mongoSearch) SyncIndex() (*SearchIndex, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	return mS.searcher.SyncIndex(ctx)
+}
+
+// validateSynonymSet returns a *ValidationError listing what is wrong with
+// set.
+func validateSynonymSet(set SynonymSet) error {
+	invalid := &ValidationError{}
+	if !synonymSetName.MatchString(set.Name) || len(set.Name) > 100 {
+		invalid.Fields = append(invalid.Fields, FieldError{Field: "name", Rule: "pattern", Message: "must be lower case words joined by hyphens, at most 100 characters"})
+	}
+
+	switch set.MappingType {
+	case SynonymsEquivalent:
+		if len(set.Synonyms) < 2 {
+			invalid.Fields = append(invalid.Fields, FieldError{Field: "synonyms", Rule: "min", Message: "must list at least 2 words"})
+		}
+	case SynonymsExplicit:
+		if len(set.Synonyms) < 1 {
+			invalid.Fields = append(invalid.Fields, FieldError{Field: "synonyms", Rule: "min", Message: "must list at least 1 word"})
+		}
+		if len(set.Input) < 1 {
+			invalid.Fields = append(invalid.Fields, FieldError{Field: "input", Rule: "min", Message: "must list at least 1 word"})
+		}
+	default:
+		invalid.Fields = append(invalid.Fields, FieldError{Field: "mappingType", Rule: "oneof", Message: "must be equivalent or explicit"})
+	}
+
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// normalizeWords lower-cases and trims words, dropping blanks and
+// duplicates.
+func normalizeWords(words []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, word := range words {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word == "" || seen[word] {
+			continue
+		}
+		seen[word] = true
+		normalized = append(normalized, word)
+	}
+	return normalized
+}
+
+// expandSynonyms adds the synonyms of the words of term to it, for search
+// backends that have no synonym support of their own.
+func expandSynonyms(ctx context.Context, library *mongo.Database, term string) (string, error) {
+	words := bson.A{}
+	for _, word := range normalizeWords(strings.Fields(term)) {
+		words = append(words, word)
+	}
+	if len(words) == 0 {
+		return term, nil
+	}
+
+	db := library.Collection(synonymCollection)
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "mappingType", Value: SynonymsEquivalent}, {Key: "synonyms", Value: bson.D{{Key: "$in", Value: words}}}},
+		bson.D{{Key: "mappingType", Value: SynonymsExplicit}, {Key: "input", Value: bson.D{{Key: "$in", Value: words}}}},
+	}}}
+	cursor, err := db.Find(ctx, filter)
+	if err != nil {
+		return "", err
+	}
+	sets := []SynonymSet{}
+	if err := cursor.All(ctx, &sets); err != nil {
+		return "", err
+	}
+
+	expanded := strings.Fields(term)
+	for _, set := range sets {
+		expanded = append(expanded, set.Synonyms...)
+	}
+	return strings.Join(normalizeWords(expanded), " "), nil
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeWords(t *testing.T) {
+	got := normalizeWords([]string{" Mag ", "magazine", "MAG", "", "zine"})
+	want := []string{"mag", "magazine", "zine"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeWords() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateSynonymSet(t *testing.T) {
+	valid := []SynonymSet{
+		{Name: "magazine", MappingType: SynonymsEquivalent, Synonyms: []string{"magazine", "zine"}},
+		{Name: "tech-news", MappingType: SynonymsExplicit, Input: []string{"tech"}, Synonyms: []string{"technology"}},
+	}
+	for _, set := range valid {
+		if err := validateSynonymSet(set); err != nil {
+			t.Errorf("validateSynonymSet(%+v) error = %v", set, err)
+		}
+	}
+
+	invalid := []SynonymSet{
+		{Name: "Magazine", MappingType: SynonymsEquivalent, Synonyms: []string{"magazine", "zine"}},
+		{Name: "magazine", MappingType: SynonymsEquivalent, Synonyms: []string{"magazine"}},
+		{Name: "tech", MappingType: SynonymsExplicit, Synonyms: []string{"technology"}},
+		{Name: "tech", MappingType: "oneway", Synonyms: []string{"technology"}},
+	}
+	for _, set := range invalid {
+		var invalidErr *ValidationError
+		if err := validateSynonymSet(set); !errors.As(err, &invalidErr) {
+			t.Errorf("validateSynonymSet(%+v) error = %v, want a *ValidationError", set, err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// PurgeTrash permanently removes magazines that have been in the trash for
+// longer than retention. It checks once every interval until ctx is done.
+func (s *Services) PurgeTrash(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.Magazine.Purge(s.env.now().Add(-retention))
+		if err != nil {
+			s.env.logf("purging magazine trash failed: %v", err)
+		} else if purged > 0 {
+			s.env.logf("purged %d magazines from the trash", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
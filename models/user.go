@@ -2,6 +2,7 @@ package models
 
 import (
 	"context"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -9,7 +10,9 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var PasswordPepper string
+// ErrInvalidCredentials is reported for a failed login, whether the email is
+// unknown or the password is wrong.
+var ErrInvalidCredentials = errors.New("invalid email or password")
 
 type User struct {
 	ID       primitive.ObjectID `bson:"_id" json:"id,omitempty"`
@@ -27,11 +30,17 @@ type UserService interface {
 	UserDB
 }
 
-func NewUserService(db *mongo.Client) UserService {
-	uM := &userMongo{db}
+// NewUserDB returns the users stored in Mongo.
+func NewUserDB(db *mongo.Client) UserDB {
+	return &userMongo{db: db}
+}
 
+// NewUserService authenticates the users of db. pepper is appended to
+// passwords before they are compared with the stored bcrypt hashes.
+func NewUserService(db UserDB, pepper string) UserService {
 	return &userService{
-		UserDB: uM,
+		UserDB: db,
+		pepper: pepper,
 	}
 }
 
@@ -39,17 +48,25 @@ var _ UserDB = &userService{}
 
 type userService struct {
 	UserDB
+	pepper string
 }
 
 var _ UserDB = &userMongo{}
 
 type userMongo struct {
 	db *mongo.Client
+	// database is the name of the database the users are in, "users"
+	// unless tests give their own.
+	database string
 }
 
 func (u *userMongo) ByEmail(email string) (*User, error) {
 	user := User{}
-	db := u.db.Database("users").Collection("authentication")
+	database := u.database
+	if database == "" {
+		database = "users"
+	}
+	db := u.db.Database(database).Collection("authentication")
 
 	collection := db.FindOne(context.TODO(), bson.M{"email": email})
 	err := collection.Decode(&user)
@@ -60,17 +77,22 @@ func (u *userMongo) ByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// Authenticate returns the user with the given email if password matches.
+// An unknown email and a wrong password both yield ErrInvalidCredentials.
 func (us *userService) Authenticate(email, password string) (*User, error) {
 	foundUser, err := us.ByEmail(email)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.Password), []byte(password+PasswordPepper))
+	err = bcrypt.CompareHashAndPassword([]byte(foundUser.Password), []byte(password+us.pepper))
 	if err != nil {
 		switch err {
 		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, bcrypt.ErrMismatchedHashAndPassword
+			return nil, ErrInvalidCredentials
 		default:
 			return nil, err
 		}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FieldError describes why one field of a document is invalid. Field is the
+// field's JSON name so clients can map it onto their form inputs.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a document.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, f.Field+": "+f.Message)
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+var decimalType = reflect.TypeOf(primitive.Decimal128{})
+
+// Validate checks v, a struct or pointer to one, against the rules in the
+// `validate` tags of its fields and returns a *ValidationError listing every
+// field that breaks one. Rules are separated by commas:
+//
+//	required     the field must not be its zero value
+//	omitempty    skip the remaining rules if the field is its zero value
+//	min=N, max=N numbers must lie within the bound
+//	minlen=N,    text must have at least or at most N characters
+//	maxlen=N
+func Validate(v interface{}) error {
+	return validateFields(v, nil)
+}
+
+// validatePatch checks the fields a patch sets or removes against the rules
+// of Magazine. Fields the patch leaves alone are not checked.
+func validatePatch(patch MagazinePatch) error {
+	raw, err := bson.Marshal(patch.Set)
+	if err != nil {
+		return err
+	}
+	var magazine Magazine
+	if err := bson.Unmarshal(raw, &magazine); err != nil {
+		return err
+	}
+
+	only := map[string]bool{}
+	for _, e := range patch.Set {
+		only[e.Key] = true
+	}
+	for _, field := range patch.Unset {
+		only[field] = true
+	}
+	return validateFields(&magazine, only)
+}
+
+// validateFields validates v; when only is not nil, just the fields whose
+// bson names it contains.
+func validateFields(v interface{}, only map[string]bool) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	typ := value.Type()
+
+	invalid := &ValidationError{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		if only != nil && !only[tagName(field, "bson")] {
+			continue
+		}
+
+		name := tagName(field, "json")
+		for _, rule := range strings.Split(tag, ",") {
+			if rule == "omitempty" {
+				if isBlank(value.Field(i)) {
+					break
+				}
+				continue
+			}
+			if message := checkRule(value.Field(i), rule); message != "" {
+				rule, _, _ := strings.Cut(rule, "=")
+				invalid.Fields = append(invalid.Fields, FieldError{Field: name, Rule: rule, Message: message})
+				// Report one broken rule per field.
+				break
+			}
+		}
+	}
+
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// checkRule returns a message describing how value breaks rule, or "" when
+// it does not.
+func checkRule(value reflect.Value, rule string) string {
+	name, arg, _ := strings.Cut(rule, "=")
+
+	switch name {
+	case "required":
+		if isBlank(value) {
+			return "is required"
+		}
+	case "min", "max":
+		bound, ok := new(big.Float).SetString(arg)
+		number, isNumber := numberOf(value)
+		if !ok {
+			panic(fmt.Sprintf("validate: invalid bound in rule %q", rule))
+		}
+		if !isNumber {
+			return "must be a number"
+		}
+		if name == "min" && number.Cmp(bound) < 0 {
+			return "must be at least " + arg
+		}
+		if name == "max" && number.Cmp(bound) > 0 {
+			return "must be at most " + arg
+		}
+	case "minlen", "maxlen":
+		limit, err := strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Sprintf("validate: invalid length in rule %q", rule))
+		}
+		length := utf8.RuneCountInString(value.String())
+		if name == "minlen" && length < limit {
+			return fmt.Sprintf("must be at least %d characters long", limit)
+		}
+		if name == "maxlen" && length > limit {
+			return fmt.Sprintf("must be at most %d characters long", limit)
+		}
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", rule))
+	}
+	return ""
+}
+
+func isBlank(value reflect.Value) bool {
+	if value.Kind() == reflect.String {
+		return strings.TrimSpace(value.String()) == ""
+	}
+	return value.IsZero()
+}
+
+func numberOf(value reflect.Value) (*big.Float, bool) {
+	switch {
+	case value.Type() == decimalType:
+		d := value.Interface().(primitive.Decimal128)
+		if d.IsNaN() || d.IsInf() != 0 {
+			return nil, false
+		}
+		number, ok := new(big.Float).SetString(d.String())
+		return number, ok
+	case value.CanInt():
+		return new(big.Float).SetInt64(value.Int()), true
+	case value.CanFloat():
+		return big.NewFloat(value.Float()), true
+	}
+	return nil, false
+}
+
+// tagName returns the name a struct field has in the given encoding.
+func tagName(field reflect.StructField, key string) string {
+	name, _, _ := strings.Cut(field.Tag.Get(key), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateMagazine(t *testing.T) {
+	price := func(s string) primitive.Decimal128 {
+		d, err := primitive.ParseDecimal128(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		name     string
+		magazine Magazine
+		want     []string
+	}{
+		{"valid", Magazine{Title: "Wired", Price: price("5.99")}, nil},
+		{"empty", Magazine{}, []string{"title", "price"}},
+		{"blank title", Magazine{Title: "   ", Price: price("1")}, []string{"title"}},
+		{"long title", Magazine{Title: strings.Repeat("a", 201), Price: price("1")}, []string{"title"}},
+		{"negative price", Magazine{Title: "Wired", Price: price("-0.01")}, []string{"price"}},
+		{"NaN price", Magazine{Title: "Wired", Price: price("NaN")}, []string{"price"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.magazine)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("Validate() error = %v, want a *ValidationError", err)
+			}
+			var got []string
+			for _, f := range invalid.Fields {
+				got = append(got, f.Field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("invalid fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePatchOnlyChecksPatchedFields(t *testing.T) {
+	patch, err := ParseMergePatch([]byte(`{"price": "4.50"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validatePatch(*patch); err != nil {
+		t.Errorf("validatePatch() error = %v, want nil", err)
+	}
+
+	patch, err = ParseMergePatch([]byte(`{"title": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validatePatch(*patch); err == nil {
+		t.Error("validatePatch() removing the title succeeded, want error")
+	}
+}
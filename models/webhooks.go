@@ -0,0 +1,642 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jgsheppa/mongo-go/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// webhookEvents lists the events webhooks can subscribe to.
+var webhookEvents = map[string]bool{
+	EventMagazineCreated:  true,
+	EventMagazineUpdated:  true,
+	EventMagazineDeleted:  true,
+	EventMagazineRestored: true,
+}
+
+// Delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	// DeliveryDead marks a delivery that failed every attempt. Dead
+	// deliveries make up the dead-letter store and are only sent again when
+	// they are replayed.
+	DeliveryDead = "dead"
+)
+
+// Headers of a webhook request.
+const (
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	// WebhookSignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the
+	// timestamp header, a dot and the body, keyed with the webhook's secret.
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	webhookCollection  = "webhooks"
+	deliveryCollection = "webhook_deliveries"
+	// maxDeliveryTries is the number of attempts before a delivery is
+	// declared dead.
+	maxDeliveryTries = 8
+	// firstRetryDelay doubles with every failed attempt, up to
+	// maxRetryDelay.
+	firstRetryDelay = 30 * time.Second
+	maxRetryDelay   = 6 * time.Hour
+	// deliveryLease is how long a dispatcher holds a delivery it is
+	// sending. A delivery whose dispatcher died is picked up again once
+	// its lease runs out.
+	deliveryLease = time.Minute
+	// deliveryTimeout bounds a single webhook request.
+	deliveryTimeout = 10 * time.Second
+	// maxDeliveriesPerRun caps the deliveries DeliverDue sends at once.
+	maxDeliveriesPerRun = 100
+)
+
+// Webhook subscribes a URL to magazine lifecycle events. Secret signs the
+// requests; it is generated when the webhook is created and only returned
+// then.
+type Webhook struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	URL       string             `bson:"url" json:"url"`
+	Events    []string           `bson:"events" json:"events"`
+	Secret    string             `bson:"secret" json:"secret,omitempty"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// WebhookDelivery is the delivery of one event to one webhook, with every
+// attempt made so far. The event is the JSON body of the request. Tries
+// counts the attempts since the delivery was queued or last replayed.
+type WebhookDelivery struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	WebhookID     primitive.ObjectID `bson:"webhookId" json:"webhookId"`
+	Event         MagazineEvent      `bson:"event" json:"event"`
+	Status        string             `bson:"status" json:"status"`
+	Tries         int                `bson:"tries" json:"tries"`
+	Attempts      []DeliveryAttempt  `bson:"attempts" json:"attempts"`
+	NextAttemptAt *time.Time         `bson:"nextAttemptAt,omitempty" json:"nextAttemptAt,omitempty"`
+	LockedUntil   *time.Time         `bson:"lockedUntil,omitempty" json:"-"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// DeliveryAttempt records one request to a webhook. StatusCode is zero when
+// no response arrived.
+type DeliveryAttempt struct {
+	At         time.Time `bson:"at" json:"at"`
+	StatusCode int       `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	DurationMs int64     `bson:"durationMs" json:"durationMs"`
+}
+
+// WebhookService manages webhook subscriptions and delivers magazine events
+// to them. As an EventPublisher, it queues a delivery of every event to each
+// webhook subscribed to it; publishing an event again queues nothing new.
+type WebhookService interface {
+	EventPublisher
+	Webhooks() ([]Webhook, error)
+	Webhook(id string) (*Webhook, error)
+	CreateWebhook(hook Webhook) (*Webhook, error)
+	// DeleteWebhook removes the webhook and its deliveries.
+	DeleteWebhook(id string) error
+	// Deliveries lists the deliveries of a webhook, newest first. A
+	// non-empty status only lists the deliveries with that status.
+	Deliveries(webhookID, status string) ([]WebhookDelivery, error)
+	// DeadLetters lists the dead deliveries of every webhook, newest first.
+	DeadLetters() ([]WebhookDelivery, error)
+	// ReplayDelivery queues a delivery to be sent again, whatever its
+	// status.
+	ReplayDelivery(id string) (*WebhookDelivery, error)
+	// DeliverDue sends the deliveries that are due and returns how many it
+	// attempted.
+	DeliverDue(ctx context.Context) (int, error)
+}
+
+func NewWebhookService(db *mongo.Client, client *http.Client) WebhookService {
+	return &mongoWebhooks{db: db, client: client}
+}
+
+var _ WebhookService = &mongoWebhooks{}
+
+type mongoWebhooks struct {
+	environment
+	db       *mongo.Client
+	database string
+	client   *http.Client
+
+	mu      sync.Mutex
+	indexed bool
+}
+
+func (mW *mongoWebhooks) collection(name string) *mongo.Collection {
+	return libraryDatabase(mW.db, mW.database).Collection(name)
+}
+
+// ensureIndexes creates the indexes the dispatcher and the delivery
+// listings run on, and the one that keeps an event from being queued twice
+// for a webhook. It is retried on the next call if it fails.
+func (mW *mongoWebhooks) ensureIndexes(ctx context.Context) error {
+	mW.mu.Lock()
+	defer mW.mu.Unlock()
+
+	if mW.indexed {
+		return nil
+	}
+
+	db := mW.collection(deliveryCollection)
+	_, err := db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "webhookId", Value: 1}, {Key: "_id", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "event._id", Value: 1}, {Key: "webhookId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	mW.indexed = true
+	return nil
+}
+
+func (mW *mongoWebhooks) Webhooks() ([]Webhook, error) {
+	db := mW.collection(webhookCollection)
+
+	cursor, err := db.Find(context.Background(), bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	if err := cursor.All(context.Background(), &hooks); err != nil {
+		return nil, err
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, nil
+}
+
+func (mW *mongoWebhooks) Webhook(id string) (*Webhook, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	hook, err := mW.findWebhook(context.Background(), objectId)
+	if err != nil {
+		return nil, err
+	}
+	hook.Secret = ""
+	return hook, nil
+}
+
+func (mW *mongoWebhooks) findWebhook(ctx context.Context, id primitive.ObjectID) (*Webhook, error) {
+	db := mW.collection(webhookCollection)
+
+	hook := Webhook{}
+	if err := db.FindOne(ctx, bson.M{"_id": id}).Decode(&hook); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (mW *mongoWebhooks) CreateWebhook(hook Webhook) (*Webhook, error) {
+	hook.Events = normalizeWords(hook.Events)
+	if err := validateWebhook(hook); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	if err := checkWebhookHost(ctx, hook.URL); err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	hook.ID = primitive.NewObjectID()
+	hook.Secret = hex.EncodeToString(secret)
+	hook.CreatedAt = mW.now()
+
+	db := mW.collection(webhookCollection)
+	if _, err := db.InsertOne(context.Background(), hook); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (mW *mongoWebhooks) DeleteWebhook(id string) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	db := mW.collection(webhookCollection)
+	res, err := db.DeleteOne(context.Background(), bson.M{"_id": objectId})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	deliveries := mW.collection(deliveryCollection)
+	_, err = deliveries.DeleteMany(context.Background(), bson.M{"webhookId": objectId})
+	return err
+}
+
+func (mW *mongoWebhooks) Deliveries(webhookID, status string) ([]WebhookDelivery, error) {
+	objectId, err := primitive.ObjectIDFromHex(webhookID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mW.findWebhook(context.Background(), objectId); err != nil {
+		return nil, err
+	}
+
+	filter := bson.D{{Key: "webhookId", Value: objectId}}
+	switch status {
+	case "":
+	case DeliveryPending, DeliverySucceeded, DeliveryDead:
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	default:
+		return nil, &query.Error{Param: "status", Message: fmt.Sprintf("must be %s, %s or %s", DeliveryPending, DeliverySucceeded, DeliveryDead)}
+	}
+	return mW.findDeliveries(filter)
+}
+
+func (mW *mongoWebhooks) DeadLetters() ([]WebhookDelivery, error) {
+	return mW.findDeliveries(bson.D{{Key: "status", Value: DeliveryDead}})
+}
+
+func (mW *mongoWebhooks) findDeliveries(filter bson.D) ([]WebhookDelivery, error) {
+	if err := mW.ensureIndexes(context.Background()); err != nil {
+		return nil, err
+	}
+	db := mW.collection(deliveryCollection)
+
+	cursor, err := db.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []WebhookDelivery{}
+	if err := cursor.All(context.Background(), &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (mW *mongoWebhooks) ReplayDelivery(id string) (*WebhookDelivery, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	db := mW.collection(deliveryCollection)
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "status", Value: DeliveryPending},
+			{Key: "tries", Value: 0},
+			{Key: "nextAttemptAt", Value: mW.now()},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "lockedUntil", Value: ""}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	delivery := WebhookDelivery{}
+	if err := db.FindOneAndUpdate(context.Background(), bson.M{"_id": objectId}, update, opts).Decode(&delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (mW *mongoWebhooks) Publish(ctx context.Context, event MagazineEvent) error {
+	if err := mW.ensureIndexes(ctx); err != nil {
+		return err
+	}
+
+	hooks := mW.collection(webhookCollection)
+	cursor, err := hooks.Find(ctx, bson.M{"events": event.Type}, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var subscribed []Webhook
+	if err := cursor.All(ctx, &subscribed); err != nil {
+		return err
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	event.Seq = 0
+	event.PublishedAt = nil
+	queued := mW.now()
+	deliveries := make([]interface{}, 0, len(subscribed))
+	for _, hook := range subscribed {
+		deliveries = append(deliveries, WebhookDelivery{
+			ID:            primitive.NewObjectID(),
+			WebhookID:     hook.ID,
+			Event:         event,
+			Status:        DeliveryPending,
+			Attempts:      []DeliveryAttempt{},
+			NextAttemptAt: &queued,
+			CreatedAt:     queued,
+		})
+	}
+
+	// The unique index on event and webhook turns the deliveries of an
+	// event published before into duplicate key errors.
+	db := mW.collection(deliveryCollection)
+	_, err = db.InsertMany(ctx, deliveries, options.InsertMany().SetOrdered(false))
+	if onlyDuplicates(err) {
+		return nil
+	}
+	return err
+}
+
+// onlyDuplicates reports whether err is a bulk write error made up of
+// duplicate key errors alone.
+func onlyDuplicates(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+func (mW *mongoWebhooks) DeliverDue(ctx context.Context) (int, error) {
+	if err := mW.ensureIndexes(ctx); err != nil {
+		return 0, err
+	}
+
+	attempted := 0
+	for attempted < maxDeliveriesPerRun && ctx.Err() == nil {
+		delivery, err := mW.claimDelivery(ctx)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return attempted, err
+		}
+		if err := mW.deliver(ctx, delivery); err != nil {
+			return attempted, err
+		}
+		attempted++
+	}
+	return attempted, nil
+}
+
+// claimDelivery leases the pending delivery that has been due the longest,
+// so that no other dispatcher sends it at the same time.
+func (mW *mongoWebhooks) claimDelivery(ctx context.Context) (*WebhookDelivery, error) {
+	db := mW.collection(deliveryCollection)
+
+	claimed := mW.now()
+	filter := bson.D{
+		{Key: "status", Value: DeliveryPending},
+		{Key: "nextAttemptAt", Value: bson.D{{Key: "$lte", Value: claimed}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "lockedUntil", Value: nil}},
+			bson.D{{Key: "lockedUntil", Value: bson.D{{Key: "$lt", Value: claimed}}}},
+		}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "lockedUntil", Value: claimed.Add(deliveryLease)}}}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	delivery := WebhookDelivery{}
+	if err := db.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// deliver makes one attempt at a claimed delivery and records it. A failed
+// attempt is retried after retryDelay, or marks the delivery dead after
+// maxDeliveryTries.
+func (mW *mongoWebhooks) deliver(ctx context.Context, delivery *WebhookDelivery) error {
+	attempt := DeliveryAttempt{At: mW.now()}
+	hook, err := mW.findWebhook(ctx, delivery.WebhookID)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		attempt.Error = "the webhook has been deleted"
+	case err != nil:
+		return err
+	default:
+		attempt.StatusCode, err = mW.send(ctx, hook, delivery)
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+	}
+	attempt.DurationMs = time.Since(attempt.At).Milliseconds()
+
+	tries := delivery.Tries + 1
+	set := bson.D{{Key: "tries", Value: tries}}
+	unset := bson.D{{Key: "lockedUntil", Value: ""}}
+	switch {
+	case attempt.Error == "":
+		set = append(set, bson.E{Key: "status", Value: DeliverySucceeded})
+		unset = append(unset, bson.E{Key: "nextAttemptAt", Value: ""})
+	case hook == nil || tries >= maxDeliveryTries:
+		set = append(set, bson.E{Key: "status", Value: DeliveryDead})
+		unset = append(unset, bson.E{Key: "nextAttemptAt", Value: ""})
+		mW.logf("webhook delivery %s is dead after %d tries: %s", delivery.ID.Hex(), tries, attempt.Error)
+	default:
+		set = append(set, bson.E{Key: "nextAttemptAt", Value: mW.now().Add(retryDelay(tries))})
+	}
+
+	db := mW.collection(deliveryCollection)
+	_, err = db.UpdateByID(ctx, delivery.ID, bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$unset", Value: unset},
+		{Key: "$push", Value: bson.D{{Key: "attempts", Value: attempt}}},
+	})
+	return err
+}
+
+// send posts the event of delivery to hook and returns the response status.
+// Any status outside 2xx is an error.
+func (mW *mongoWebhooks) send(ctx context.Context, hook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(mW.now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID.Hex())
+	req.Header.Set(WebhookEventHeader, delivery.Event.Type)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, timestamp, body))
+
+	res, err := mW.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// Drain a little of the body so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("the webhook answered %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// SignWebhook returns the WebhookSignatureHeader value of a request with the
+// given timestamp header and body. Receivers compute it with their copy of
+// the secret and compare it to the header in constant time.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay is the wait before the next attempt of a delivery that failed
+// tries times.
+func retryDelay(tries int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < tries && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// validateWebhook returns a *ValidationError listing what is wrong with
+// hook.
+func validateWebhook(hook Webhook) error {
+	invalid := &ValidationError{}
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid.Fields = append(invalid.Fields, FieldError{Field: "url", Rule: "url", Message: "must be an absolute http or https URL"})
+	}
+	if len(hook.Events) == 0 {
+		invalid.Fields = append(invalid.Fields, FieldError{Field: "events", Rule: "min", Message: "must list at least 1 event"})
+	}
+	for _, event := range hook.Events {
+		if !webhookEvents[event] {
+			invalid.Fields = append(invalid.Fields, FieldError{Field: "events", Rule: "oneof", Message: fmt.Sprintf("%q is not an event; use %s, %s, %s or %s", event, EventMagazineCreated, EventMagazineUpdated, EventMagazineDeleted, EventMagazineRestored)})
+		}
+	}
+
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// checkWebhookHost resolves the host of a webhook URL and refuses it unless
+// all its addresses are public, so that webhooks cannot be aimed at the
+// services next to this one, such as the database or a cloud metadata
+// endpoint.
+func checkWebhookHost(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return &ValidationError{Fields: []FieldError{{Field: "url", Rule: "resolvable", Message: "host does not resolve"}}}
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return &ValidationError{Fields: []FieldError{{Field: "url", Rule: "public", Message: "must not point at a loopback, private or link-local address"}}}
+		}
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which is
+// no more reachable from the internet than the private ranges.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip may be the address of a webhook.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// NewWebhookClient returns the client webhook deliveries are best sent
+// with. It only connects to public addresses, which also covers redirects
+// and hosts that were public when the webhook was registered but resolve
+// to a private address since.
+func NewWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: deliveryTimeout, Control: refusePrivateAddress}
+	return &http.Client{Transport: &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: deliveryTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+	}}
+}
+
+// refusePrivateAddress is a dialer control that fails connections to
+// addresses publicIP rejects.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// DeliverWebhooks sends due webhook deliveries once every interval until
+// ctx is done.
+func (s *Services) DeliverWebhooks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Webhook.DeliverDue(ctx); err != nil && ctx.Err() == nil {
+			s.env.logf("delivering webhooks failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
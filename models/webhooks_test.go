@@ -0,0 +1,148 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		tries int
+		want  time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{20, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.tries); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.tries, got, tt.want)
+		}
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	valid := Webhook{URL: "https://partner.example/hooks", Events: []string{EventMagazineCreated, EventMagazineDeleted, EventMagazineRestored}}
+	if err := validateWebhook(valid); err != nil {
+		t.Errorf("validateWebhook(%+v) error = %v", valid, err)
+	}
+
+	invalid := []Webhook{
+		{URL: "ftp://partner.example/hooks", Events: []string{EventMagazineCreated}},
+		{URL: "/hooks", Events: []string{EventMagazineCreated}},
+		{URL: "https://partner.example/hooks"},
+		{URL: "https://partner.example/hooks", Events: []string{"magazine.read"}},
+	}
+	for _, hook := range invalid {
+		var invalidErr *ValidationError
+		if err := validateWebhook(hook); !errors.As(err, &invalidErr) {
+			t.Errorf("validateWebhook(%+v) error = %v, want a *ValidationError", hook, err)
+		}
+	}
+}
+
+func TestCheckWebhookHost(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://93.184.216.34/hooks", true},
+		{"https://[2606:2800:220:1::248]/hooks", true},
+		{"http://localhost:8080/hooks", false},
+		{"http://127.0.0.1/hooks", false},
+		{"http://[::1]/hooks", false},
+		{"http://10.0.0.5/hooks", false},
+		{"http://192.168.1.1/hooks", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://100.64.0.1/hooks", false},
+		{"http://0.0.0.0/hooks", false},
+		{"http://[fd00::1]/hooks", false},
+	}
+	for _, tt := range tests {
+		err := checkWebhookHost(context.Background(), tt.url)
+		if got := err == nil; got != tt.want {
+			t.Errorf("checkWebhookHost(%q) error = %v, want allowed %v", tt.url, err, tt.want)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	if _, err := NewWebhookClient().Get(server.URL); err == nil {
+		t.Errorf("delivering to %s succeeded", server.URL)
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	hook := &Webhook{Secret: "s3cret"}
+	delivery := &WebhookDelivery{
+		ID:    primitive.NewObjectID(),
+		Event: MagazineEvent{ID: primitive.NewObjectID(), Type: EventMagazineUpdated, Magazine: &Magazine{Title: "Wired"}},
+	}
+
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := SignWebhook(hook.Secret, r.Header.Get(WebhookTimestampHeader), body)
+		if got := r.Header.Get(WebhookSignatureHeader); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		if got := r.Header.Get(WebhookEventHeader); got != EventMagazineUpdated {
+			t.Errorf("event header = %q", got)
+		}
+		if got := r.Header.Get(WebhookDeliveryHeader); got != delivery.ID.Hex() {
+			t.Errorf("delivery header = %q", got)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	hook.URL = server.URL
+
+	mW := &mongoWebhooks{client: server.Client()}
+	if code, err := mW.send(context.Background(), hook, delivery); err != nil || code != http.StatusNoContent {
+		t.Errorf("send() = %d, %v, want 204 and no error", code, err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if code, err := mW.send(context.Background(), hook, delivery); err == nil || code != http.StatusServiceUnavailable {
+		t.Errorf("send() = %d, %v, want 503 and an error", code, err)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac key
+	got := SignWebhook("key", "1700000000", []byte("{}"))
+	want := "sha256=9d713ed406bb7076d4123f0dc2c39d2df5c654ed4b0cd56b52c8b4c940bd63ae"
+	if got != want {
+		t.Errorf("SignWebhook() = %q, want %q", got, want)
+	}
+}
+
+func TestOnlyDuplicates(t *testing.T) {
+	duplicates := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Code: 11000}},
+		{WriteError: mongo.WriteError{Code: 11000}},
+	}}
+	if !onlyDuplicates(duplicates) {
+		t.Error("duplicate deliveries were reported as a failure")
+	}
+
+	mixed := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Code: 11000}},
+		{WriteError: mongo.WriteError{Code: 121}},
+	}}
+	if onlyDuplicates(mixed) || onlyDuplicates(errors.New("boom")) || onlyDuplicates(nil) {
+		t.Error("a failed insert was reported as duplicates only")
+	}
+}
@@ -0,0 +1,148 @@
+// Package query contains helpers for listing documents from a collection:
+// opaque page cursors today, and the building blocks for filtering and
+// sorting that any collection can reuse.
+package query
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+const (
+	// DefaultLimit is the page size used when a client does not ask for one.
+	DefaultLimit = 20
+	// MaxLimit is the largest page size a client may ask for.
+	MaxLimit = 100
+)
+
+var ErrInvalidCursor = errors.New("cursor is invalid or does not match the requested sort")
+
+// DefaultSort orders documents by their ObjectID, which is the order they
+// were inserted in.
+var DefaultSort = bson.D{{Key: "_id", Value: 1}}
+
+// EncodeCursor returns an opaque cursor pointing just past last. The cursor
+// stores the values of every sort key of last, so the next page can resume
+// from them even when documents are inserted or removed in between. A sort
+// key last does not have is stored as null, which is how Mongo sorts it.
+func EncodeCursor(sort bson.D, last interface{}) (string, error) {
+	raw, err := bson.Marshal(last)
+	if err != nil {
+		return "", err
+	}
+
+	keys := bson.D{}
+	for _, s := range sort {
+		value, err := bson.Raw(raw).LookupErr(s.Key)
+		if err == bsoncore.ErrElementNotFound {
+			keys = append(keys, bson.E{Key: s.Key, Value: nil})
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, bson.E{Key: s.Key, Value: value})
+	}
+
+	b, err := bson.Marshal(keys)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// After decodes cursor and returns a filter matching the documents that come
+// after it in sort order. sort must be the same sort the cursor was encoded
+// with and must end with a unique key such as _id.
+func After(sort bson.D, cursor string) (bson.D, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var keys bson.D
+	if err := bson.Unmarshal(b, &keys); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if len(keys) != len(sort) {
+		return nil, ErrInvalidCursor
+	}
+	for i, s := range sort {
+		if keys[i].Key != s.Key || !scalar(keys[i].Value) {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	// A document comes after the cursor when it ties on the first i sort
+	// keys and is strictly past the cursor on key i. Equality on null also
+	// matches a missing field, so ties need no special case.
+	or := bson.A{}
+	for i, s := range sort {
+		past, ok := pastKey(s.Key, keys[i].Value, direction(s.Value) < 0)
+		if !ok {
+			continue
+		}
+		clause := bson.D{}
+		for _, k := range keys[:i] {
+			clause = append(clause, bson.E{Key: k.Key, Value: k.Value})
+		}
+		or = append(or, append(clause, past))
+	}
+
+	if len(or) == 1 {
+		return or[0].(bson.D), nil
+	}
+	return bson.D{{Key: "$or", Value: or}}, nil
+}
+
+// scalar reports whether a cursor value is one a sort key can hold. The
+// values are copied into the filter as they are, so anything else, such as a
+// document of operators or a regular expression, could only come from a
+// tampered cursor and would be run by Mongo instead of compared.
+func scalar(value interface{}) bool {
+	switch value.(type) {
+	case nil, string, bool, int32, int64, float64,
+		primitive.ObjectID, primitive.DateTime, primitive.Decimal128, primitive.Timestamp:
+		return true
+	default:
+		return false
+	}
+}
+
+// pastKey returns the condition matching the values of key that sort
+// strictly past value. Null and missing values sort before all others, and
+// comparison operators never match them, so they need conditions of their
+// own. Nothing sorts past null in descending order, which ok reports.
+func pastKey(key string, value interface{}, descending bool) (past bson.E, ok bool) {
+	switch {
+	case value == nil && descending:
+		return bson.E{}, false
+	case value == nil:
+		return bson.E{Key: key, Value: bson.D{{Key: "$ne", Value: nil}}}, true
+	case descending:
+		return bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: key, Value: bson.D{{Key: "$lt", Value: value}}}},
+			bson.D{{Key: key, Value: nil}},
+		}}, true
+	default:
+		return bson.E{Key: key, Value: bson.D{{Key: "$gt", Value: value}}}, true
+	}
+}
+
+func direction(v interface{}) int {
+	switch d := v.(type) {
+	case int:
+		return d
+	case int32:
+		return int(d)
+	case int64:
+		return int(d)
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,108 @@
+package query
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	id := primitive.NewObjectID()
+	last := bson.D{{Key: "_id", Value: id}, {Key: "title", Value: "Wired"}, {Key: "price", Value: int32(5)}}
+
+	sort := bson.D{{Key: "price", Value: -1}, {Key: "_id", Value: 1}}
+	cursor, err := EncodeCursor(sort, last)
+	if err != nil {
+		t.Fatalf("EncodeCursor() error = %v", err)
+	}
+
+	got, err := After(sort, cursor)
+	if err != nil {
+		t.Fatalf("After() error = %v", err)
+	}
+
+	want := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "price", Value: bson.D{{Key: "$lt", Value: int32(5)}}}},
+			bson.D{{Key: "price", Value: nil}},
+		}}},
+		bson.D{{Key: "price", Value: int32(5)}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: id}}}},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("After() = %v, want %v", got, want)
+	}
+}
+
+func TestCursorMissingKey(t *testing.T) {
+	id := primitive.NewObjectID()
+	last := bson.D{{Key: "_id", Value: id}, {Key: "title", Value: "Wired"}}
+
+	tests := []struct {
+		name string
+		sort bson.D
+		want bson.D
+	}{
+		{"ascending", bson.D{{Key: "category", Value: 1}, {Key: "_id", Value: 1}}, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "category", Value: bson.D{{Key: "$ne", Value: nil}}}},
+			bson.D{{Key: "category", Value: nil}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: id}}}},
+		}}}},
+		{"descending", bson.D{{Key: "category", Value: -1}, {Key: "_id", Value: 1}}, bson.D{
+			{Key: "category", Value: nil}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: id}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := EncodeCursor(tt.sort, last)
+			if err != nil {
+				t.Fatalf("EncodeCursor() error = %v", err)
+			}
+			got, err := After(tt.sort, cursor)
+			if err != nil {
+				t.Fatalf("After() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("After() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAfterRejectsMismatchedCursor(t *testing.T) {
+	cursor, err := EncodeCursor(DefaultSort, bson.D{{Key: "_id", Value: primitive.NewObjectID()}})
+	if err != nil {
+		t.Fatalf("EncodeCursor() error = %v", err)
+	}
+
+	sort := bson.D{{Key: "title", Value: 1}, {Key: "_id", Value: 1}}
+	if _, err := After(sort, cursor); err != ErrInvalidCursor {
+		t.Errorf("After() error = %v, want %v", err, ErrInvalidCursor)
+	}
+	if _, err := After(DefaultSort, "not-a-cursor"); err != ErrInvalidCursor {
+		t.Errorf("After() error = %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func TestAfterRejectsTamperedCursor(t *testing.T) {
+	sort := bson.D{{Key: "title", Value: 1}, {Key: "_id", Value: 1}}
+	values := []interface{}{
+		bson.D{{Key: "$ne", Value: nil}},
+		bson.D{{Key: "$regex", Value: ".*"}},
+		bson.A{"Wired"},
+		primitive.Regex{Pattern: ".*"},
+		primitive.JavaScript("true"),
+	}
+
+	for _, value := range values {
+		b, err := bson.Marshal(bson.D{{Key: "title", Value: value}, {Key: "_id", Value: primitive.NewObjectID()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := After(sort, base64.RawURLEncoding.EncodeToString(b)); err != ErrInvalidCursor {
+			t.Errorf("After() with title %v error = %v, want %v", value, err, ErrInvalidCursor)
+		}
+	}
+}
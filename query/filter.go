@@ -0,0 +1,286 @@
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Type is the type a filter value is converted to before it is sent to
+// Mongo.
+type Type int
+
+const (
+	String Type = iota
+	Decimal
+	Int
+	ObjectID
+)
+
+// Operators a client may use as field[op]=value. A bare field=value is
+// shorthand for field[eq]=value.
+const (
+	Eq     = "eq"
+	Ne     = "ne"
+	Gt     = "gt"
+	Gte    = "gte"
+	Lt     = "lt"
+	Lte    = "lte"
+	In     = "in"
+	Prefix = "prefix"
+)
+
+var mongoOperators = map[string]string{
+	Eq:  "$eq",
+	Ne:  "$ne",
+	Gt:  "$gt",
+	Gte: "$gte",
+	Lt:  "$lt",
+	Lte: "$lte",
+	In:  "$in",
+}
+
+// reserved holds the query parameters that control paging and sorting rather
+// than filtering.
+var reserved = map[string]bool{
+	"limit":  true,
+	"cursor": true,
+	"sort":   true,
+}
+
+var paramPattern = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)(?:\[([a-z]+)\])?$`)
+
+// Field describes how clients may filter and sort on one field.
+type Field struct {
+	// Path is the document path in Mongo. It defaults to the field name.
+	Path      string
+	Type      Type
+	Operators []string
+	Sortable  bool
+	// Groupable fields may be used as the groupBy of an aggregation.
+	Groupable bool
+}
+
+// Schema is the allowlist of fields a collection can be filtered and sorted
+// on, keyed by the name clients use in query parameters.
+type Schema map[string]Field
+
+// Query is the Mongo translation of a listing request.
+type Query struct {
+	Filter bson.D
+	Sort   bson.D
+}
+
+// Error reports a query parameter that could not be translated.
+type Error struct {
+	Param   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("query parameter %q: %s", e.Param, e.Message)
+}
+
+// Parse translates the filter and sort parameters in values into a Query.
+// Only the fields and operators allowed by s are accepted, so clients cannot
+// smuggle their own Mongo operators into the filter. The sort always ends
+// with _id so that it is total and can be paged through with a cursor.
+func (s Schema) Parse(values url.Values) (*Query, error) {
+	filter, err := s.filter(values)
+	if err != nil {
+		return nil, err
+	}
+
+	sort, err := s.sort(values.Get("sort"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Query{Filter: filter, Sort: sort}, nil
+}
+
+func (s Schema) filter(values url.Values) (bson.D, error) {
+	params := make([]string, 0, len(values))
+	for param := range values {
+		if !reserved[param] {
+			params = append(params, param)
+		}
+	}
+	sort.Strings(params)
+
+	conditions := map[string]bson.D{}
+	paths := []string{}
+	for _, param := range params {
+		match := paramPattern.FindStringSubmatch(param)
+		if match == nil {
+			return nil, &Error{Param: param, Message: "malformed parameter"}
+		}
+		name, op := match[1], match[2]
+		if op == "" {
+			op = Eq
+		}
+
+		field, ok := s[name]
+		if !ok {
+			return nil, &Error{Param: param, Message: "unknown field"}
+		}
+		if !field.allows(op) {
+			return nil, &Error{Param: param, Message: fmt.Sprintf("operator %q is not allowed", op)}
+		}
+
+		path := field.path(name)
+		for _, raw := range values[param] {
+			condition, err := field.condition(op, raw)
+			if err != nil {
+				return nil, &Error{Param: param, Message: err.Error()}
+			}
+			if _, ok := conditions[path]; !ok {
+				paths = append(paths, path)
+			}
+			conditions[path] = append(conditions[path], condition)
+		}
+	}
+
+	filter := bson.D{}
+	for _, path := range paths {
+		filter = append(filter, bson.E{Key: path, Value: conditions[path]})
+	}
+	return filter, nil
+}
+
+func (s Schema) sort(param string) (bson.D, error) {
+	if param == "" {
+		return DefaultSort, nil
+	}
+
+	spec := bson.D{}
+	seen := map[string]bool{}
+	for _, key := range strings.Split(param, ",") {
+		direction := 1
+		name := strings.TrimSpace(key)
+		if strings.HasPrefix(name, "-") {
+			direction = -1
+			name = name[1:]
+		}
+
+		field, ok := s[name]
+		if !ok || !field.Sortable {
+			return nil, &Error{Param: "sort", Message: fmt.Sprintf("cannot sort by %q", name)}
+		}
+		path := field.path(name)
+		if seen[path] {
+			return nil, &Error{Param: "sort", Message: fmt.Sprintf("%q is listed more than once", name)}
+		}
+		seen[path] = true
+		spec = append(spec, bson.E{Key: path, Value: direction})
+	}
+
+	if !seen["_id"] {
+		spec = append(spec, bson.E{Key: "_id", Value: 1})
+	}
+	return spec, nil
+}
+
+// GroupPath returns the document path of the field called name, provided
+// aggregations may group by it.
+func (s Schema) GroupPath(name string) (string, error) {
+	field, ok := s[name]
+	if !ok || !field.Groupable {
+		return "", &Error{Param: "groupBy", Message: fmt.Sprintf("cannot group by %q", name)}
+	}
+	return field.path(name), nil
+}
+
+func (f Field) path(name string) string {
+	if f.Path != "" {
+		return f.Path
+	}
+	return name
+}
+
+func (f Field) allows(op string) bool {
+	for _, allowed := range f.Operators {
+		if allowed == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Field) condition(op, raw string) (bson.E, error) {
+	switch op {
+	case Prefix:
+		if f.Type != String {
+			return bson.E{}, fmt.Errorf("operator %q only applies to text fields", op)
+		}
+		pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(raw)}
+		return bson.E{Key: "$regex", Value: pattern}, nil
+	case In:
+		list := bson.A{}
+		for _, item := range strings.Split(raw, ",") {
+			value, err := f.convert(item)
+			if err != nil {
+				return bson.E{}, err
+			}
+			list = append(list, value)
+		}
+		return bson.E{Key: "$in", Value: list}, nil
+	default:
+		value, err := f.convert(raw)
+		if err != nil {
+			return bson.E{}, err
+		}
+		return bson.E{Key: mongoOperators[op], Value: value}, nil
+	}
+}
+
+func (f Field) convert(raw string) (interface{}, error) {
+	switch f.Type {
+	case Decimal:
+		value, err := primitive.ParseDecimal128(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a decimal number", raw)
+		}
+		return value, nil
+	case Int:
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", raw)
+		}
+		return value, nil
+	case ObjectID:
+		value, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid id", raw)
+		}
+		return value, nil
+	default:
+		return raw, nil
+	}
+}
+
+// And combines filters so that a document must match all of them. Empty
+// filters are dropped.
+func And(filters ...bson.D) bson.D {
+	clauses := bson.A{}
+	for _, f := range filters {
+		if len(f) > 0 {
+			clauses = append(clauses, f)
+		}
+	}
+
+	switch len(clauses) {
+	case 0:
+		return bson.D{}
+	case 1:
+		return clauses[0].(bson.D)
+	default:
+		return bson.D{{Key: "$and", Value: clauses}}
+	}
+}
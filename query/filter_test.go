@@ -0,0 +1,60 @@
+package query
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testSchema = Schema{
+	"title": {Type: String, Operators: []string{Eq, Prefix}, Sortable: true},
+	"price": {Type: Decimal, Operators: []string{Gte, Lt}, Sortable: true},
+	"id":    {Path: "_id", Type: ObjectID, Operators: []string{Eq}},
+}
+
+func TestSchemaParse(t *testing.T) {
+	values, _ := url.ParseQuery("price[gte]=5&price[lt]=10&title[prefix]=Na.&sort=-price,title&limit=5")
+
+	got, err := testSchema.Parse(values)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	five, _ := primitive.ParseDecimal128("5")
+	ten, _ := primitive.ParseDecimal128("10")
+	wantFilter := bson.D{
+		{Key: "price", Value: bson.D{{Key: "$gte", Value: five}, {Key: "$lt", Value: ten}}},
+		{Key: "title", Value: bson.D{{Key: "$regex", Value: primitive.Regex{Pattern: `^Na\.`}}}},
+	}
+	wantSort := bson.D{{Key: "price", Value: -1}, {Key: "title", Value: 1}, {Key: "_id", Value: 1}}
+
+	if !reflect.DeepEqual(got.Filter, wantFilter) {
+		t.Errorf("Filter = %v, want %v", got.Filter, wantFilter)
+	}
+	if !reflect.DeepEqual(got.Sort, wantSort) {
+		t.Errorf("Sort = %v, want %v", got.Sort, wantSort)
+	}
+}
+
+func TestSchemaParseRejects(t *testing.T) {
+	tests := []string{
+		"price[gt]=5",
+		"price[gte]=cheap",
+		"title[$where]=1",
+		"$where=1",
+		"publisher=Conde",
+		"sort=publisher",
+		"sort=id",
+		"sort=title,-title",
+	}
+
+	for _, raw := range tests {
+		values, _ := url.ParseQuery(raw)
+		if _, err := testSchema.Parse(values); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", raw)
+		}
+	}
+}